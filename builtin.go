@@ -0,0 +1,411 @@
+package smtpx
+
+import (
+	"fmt"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"net/mail"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// builtins are the extensions of every server, in the order they are advertised in the EHLO reply
+func builtins() []Extension {
+	return []Extension{
+		{Verb: "HELO", Handler: verbHELO},
+		{Verb: "EHLO", Handler: verbEHLO},
+		{Verb: "MAIL", Handler: verbMAIL},
+		{Verb: "RCPT", Handler: verbRCPT},
+		{Verb: "DATA", Handler: verbDATA},
+		{Verb: "RSET", Handler: verbRSET},
+		{Verb: "VRFY", Handler: verbVRFY},
+		{Verb: "NOOP", Handler: verbNOOP},
+		{Verb: "QUIT", Handler: verbQUIT},
+		{
+			Keyword: "SIZE",
+			Params: func(s *Session) string {
+				return strconv.FormatInt(s.server.MaxSize, 10)
+			},
+		},
+		{Keyword: "PIPELINING"},
+		{
+			Keyword: "STARTTLS",
+			Enabled: func(s *Session) bool {
+				// STARTTLS turned off, or already active, don't advertise it
+				return s.server.TLSConfig != nil && !s.conn.TLS
+			},
+		},
+		{
+			// The verb is handled even if STARTTLS is turned off, which is replied to with a 502
+			Verb: "STARTTLS",
+			Enabled: func(s *Session) bool {
+				return !s.conn.TLS
+			},
+			Handler: verbSTARTTLS,
+		},
+		{Keyword: "ENHANCEDSTATUSCODES"},
+		{Keyword: "SMTPUTF8"},
+		{
+			Verb:   "XCLIENT",
+			Phases: PhaseConnect | PhaseHelo,
+			Enabled: func(s *Session) bool {
+				return s.server.XClientOn
+			},
+			Handler: verbXCLIENT,
+		},
+		{
+			Verb:   "PROXY",
+			Phases: PhaseConnect,
+			Enabled: func(s *Session) bool {
+				return s.server.ProxyOn
+			},
+			Handler: verbPROXY,
+		},
+		{Verb: "HELP", Keyword: "HELP", Handler: verbHELP},
+	}
+}
+
+// greeting is the initial reply to a client
+func (s *Server) greeting(session *Session) Response {
+	var text string
+	if s.Greeting != nil {
+		text = s.Greeting(session)
+	} else {
+		text = fmt.Sprintf("SMTP %s(%s) #%d  %s", Name, Version, session.conn.ID, time.Now().Format(time.RFC3339))
+	}
+	return responses.New(220, s.Hostname+" "+text)
+}
+
+// cutPrefixFold is strings.CutPrefix, ignoring case
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return strings.TrimSpace(s[len(prefix):]), true
+}
+
+func verbHELO(s *Session, args string) {
+	// Client: HELO example.com
+	// The client sends the HELO command, followed by its own fully qualified domain name (FQDN) or IP address.
+	// HELO is the older "Hello" command, used in basic SMTP sessions
+	//  (as opposed to the extended ESMTP sessions initiated by EHLO).
+	//
+	// helo = "HELO" SP Domain CRLF
+	// HELO example.com\r\n
+	// HELO 192.168.1.10\r\n
+	conn := s.conn
+	conn.resetTransaction()
+
+	var err error
+	conn.Helo = args
+	conn.HeloName, err = envelope.ParseHelo(args)
+	if err != nil {
+		conn.log.Debug("HELO, parse error", "data", args, "err", err)
+	}
+
+	if res := s.server.heloHooks(conn.Envelope); res != nil {
+		conn.Helo = ""
+		conn.HeloName = envelope.HeloName{}
+		conn.rejected(res)
+		return
+	}
+
+	conn.sendResponse(fmt.Sprintf("250 %s Hello", s.server.Hostname))
+}
+
+func verbEHLO(s *Session, args string) {
+	// Client: EHLO example.com
+	// The client sends the EHLO command, followed by its own fully qualified domain name (FQDN) or IP address.
+	// Client is saying "Hello, I am example.com, and I would like to establish an ESMTP connection."
+	//
+	// ehlo = "EHLO" SP ( Domain / address-literal ) CRLF
+	//  - SP is a single space
+	//  - Domain: A fully qualified domain name (FQDN).
+	//  - address-literal: An IP address enclosed in square brackets
+	// EHLO mail.example.com\r\n
+	// EHLO [192.168.1.10]\r\n
+	// EHLO [IPv6:2001:0db8:85a3:0000:0000:8a2e:0370:7334]\r\n
+	conn := s.conn
+	conn.resetTransaction()
+
+	var err error
+	conn.Helo = args
+	conn.HeloName, err = envelope.ParseHelo(args)
+	if err != nil {
+		conn.log.Debug("EHLO, parse error", "data", args, "err", err)
+	}
+	conn.ESMTP = true
+
+	if res := s.server.heloHooks(conn.Envelope); res != nil {
+		conn.Helo = ""
+		conn.HeloName = envelope.HeloName{}
+		conn.ESMTP = false
+		conn.rejected(res)
+		return
+	}
+
+	// Extended feature advertisements, ehlo is a multi-line reply where the last line has no dash
+	lines := []string{fmt.Sprintf("%s Hello", s.server.Hostname)}
+	for _, ext := range s.Extensions() {
+		if line := ext.ehlo(s); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for i, line := range lines {
+		if i == len(lines)-1 {
+			lines[i] = "250 " + line
+			continue
+		}
+		lines[i] = "250-" + line
+	}
+	conn.sendResponse(strings.Join(lines, "\r\n"))
+}
+
+func verbHELP(s *Session, _ string) {
+	// Client: HELP
+	// Server: 214-Supported commands:
+	// Server: 214-HELO EHLO MAIL RCPT DATA RSET NOOP QUIT VRFY EXPN HELP
+	// Server: 214 End of HELP info
+	var verbs []string
+	for _, ext := range s.Extensions() {
+		if ext.Verb != "" && ext.Handler != nil {
+			verbs = append(verbs, ext.Verb)
+		}
+	}
+
+	s.conn.sendResponse(
+		"214-Supported commands:\r\n",
+		fmt.Sprintf("214-%s\r\n", strings.Join(verbs, " ")),
+		"214 End of HELP info")
+}
+
+func verbXCLIENT(s *Session, args string) {
+	// Client: XCLIENT ADDR=192.168.1.10 NAME=client.example.com PROTO=ESMTP AUTH=user@example.com
+	// The XCLIENT command is another Extended SMTP (ESMTP) command, but it's not standardized in the
+	// official RFCs. It's used by some mail servers, primarily Postfix, to provide client information to
+	// the server before the MAIL FROM command. This is particularly useful in situations where a proxy or
+	// load balancer is involved.
+	conn := s.conn
+	var addr netip.Addr
+	var port uint64
+	for _, tok := range strings.Fields(args) {
+		key, val, found := strings.Cut(tok, "=")
+		if found {
+			if val == "[UNAVAILABLE]" {
+				continue
+			}
+			if key == "ADDR" {
+				// IPv6 addresses are prefixed, i.e. ADDR=IPV6:2001:db8::1
+				if len(val) > 5 && strings.EqualFold(val[:5], "IPV6:") {
+					val = val[5:]
+				}
+				addr, _ = netip.ParseAddr(val)
+			}
+			if key == "PORT" {
+				port, _ = strconv.ParseUint(val, 10, 16)
+			}
+			if key == "HELO" {
+				conn.Helo = val
+				conn.HeloName, _ = envelope.ParseHelo(val)
+			}
+		}
+	}
+	if addr.IsValid() {
+		conn.SetRemote(netip.AddrPortFrom(addr.Unmap(), uint16(port)))
+		conn.log = conn.log.With("client-ip", conn.Remote)
+		if !s.server.connect(conn) {
+			return
+		}
+	}
+	conn.sendResponse(responses.SuccessMailCmd)
+}
+
+func verbPROXY(s *Session, args string) {
+	// Client: PROXY TCP4 remote.host.example.com 192.168.1.10 192.168.1.20 5000 6000
+	// PROXY
+	// - TCP4: Protocol version.
+	// - remote.host.example.com: The hostname of the connecting client.
+	// - 192.168.1.10: The client's IP address.
+	// - 192.168.1.20: The proxy's IP address.
+	// - 5000: The client's source port.
+	// - 6000: The proxy's destination port.
+	conn := s.conn
+	toks := strings.Fields(args)
+	conn.log.Debug("PROXY", "command", args)
+
+	switch len(toks) {
+	case 5, 6:
+		ip, err := netip.ParseAddr(toks[len(toks)-4])
+		if err != nil {
+			conn.log.Debug("PROXY, parse error, invalid source address", "data", args, "err", err)
+			conn.sendResponse(responses.FailSyntaxError)
+			return
+		}
+		port, _ := strconv.ParseUint(toks[len(toks)-2], 10, 16)
+		conn.SetRemote(netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+		conn.log = conn.log.With("client-ip", conn.Remote)
+		if !s.server.connect(conn) {
+			return
+		}
+		conn.sendResponse(s.server.greeting(s))
+	default:
+		conn.log.Debug("PROXY, parse error, expected 5 or 6 parts", "data", args)
+		conn.sendResponse(responses.FailSyntaxError)
+	}
+}
+
+func verbMAIL(s *Session, args string) {
+	// Client: MAIL FROM:<sender@example.com>
+	// This is the SMTP command that specifies the sender's email address.
+	// Used for the Return-Path header
+	conn := s.conn
+	if conn.isInTransaction() {
+		conn.sendResponse(responses.FailNestedMailCmd)
+		conn.errors++
+		return
+	}
+	if conn.tlsStarted && conn.Helo == "" {
+		// the session was reset by STARTTLS, the client has to say EHLO again
+		conn.sendResponse(responses.FailBadSequence)
+		conn.errors++
+		return
+	}
+	content, ok := cutPrefixFold(args, "FROM:")
+	if !ok {
+		conn.log.Debug("MAIL, parse error, expected FROM:", "data", args)
+		conn.sendResponse(responses.FailSyntaxError)
+		conn.errors++
+		return
+	}
+	addr, charser, _ := strings.Cut(content, " ")
+	if charser == CharsetUtf8 {
+		conn.charset = CharsetUtf8
+		conn.Envelope.UTF8 = true
+	}
+	var err error
+	if addr == "<>" {
+		// the null reverse-path of DSNs, which must be accepted (RFC 5321 4.5.5)
+		conn.MailFrom = &mail.Address{}
+	} else {
+		conn.MailFrom, err = mail.ParseAddress(addr)
+	}
+	if err != nil {
+		conn.log.Debug("MAIL, parse error", "data", "["+content+"]", "err", err)
+		conn.sendResponse(responses.RejectedSenderMailCmd)
+		conn.errors++
+		return
+	}
+
+	if res := s.server.mailHooks(conn.Envelope); res != nil {
+		conn.MailFrom = nil
+		conn.rejected(res)
+		return
+	}
+
+	conn.sendResponse(responses.SuccessMailCmd)
+}
+
+func verbRCPT(s *Session, args string) {
+	// Client: RCPT TO:<recipient@example.com>
+	// This is the SMTP command that specifies the recipient's email address.
+	conn := s.conn
+	if len(conn.RcptTo) > s.server.MaxRecipients {
+		conn.sendResponse(responses.ErrorTooManyRecipients)
+		conn.errors++
+		return
+	}
+	content, ok := cutPrefixFold(args, "TO:")
+	if !ok {
+		conn.log.Debug("RCPT, parse error, expected TO:", "data", args)
+		conn.sendResponse(responses.FailSyntaxError)
+		conn.errors++
+		return
+	}
+	to, err := mail.ParseAddress(content)
+	if err != nil {
+		conn.log.Debug("RCPT, parse error", "data", content, "err", err)
+		conn.sendResponse(responses.FailSyntaxError)
+		conn.errors++
+		return
+	}
+
+	if res := s.server.rcptHooks(conn.Envelope, to); res != nil {
+		conn.rejected(res)
+		return
+	}
+
+	conn.RcptTo = append(conn.RcptTo, to)
+	conn.sendResponse(responses.SuccessRcptCmd)
+}
+
+func verbRSET(s *Session, _ string) {
+	// Client: RSET
+	// The client then decides to abort this transaction and sends the RSET command.
+	s.conn.resetTransaction()
+	s.conn.sendResponse(responses.SuccessResetCmd)
+}
+
+func verbVRFY(s *Session, _ string) {
+	// Client: VRFY user@example.com
+	//The SMTP VRFY command is designed to verify the existence of a mailbox or user on a mail serve
+	//Due to these security concerns, most modern SMTP servers have disabled or severely restricted the VRFY command.
+	s.conn.sendResponse(responses.SuccessVerifyCmd)
+}
+
+func verbNOOP(s *Session, _ string) {
+	// Client: NOOP
+	// Its primary purpose is to:
+	// - Check if the server is still alive and responsive.
+	// - Keep the connection alive during periods of inactivity.
+	// - Test the server's response.
+	s.conn.sendResponse(responses.SuccessNoopCmd)
+}
+
+func verbQUIT(s *Session, _ string) {
+	// Client: QUIT
+	// The QUIT command is the standard way for an SMTP client to gracefully close a connection to an SMTP server.
+	s.conn.sendResponse(responses.SuccessQuitCmd)
+	s.conn.kill()
+}
+
+func verbDATA(s *Session, _ string) {
+	// Client: DATA
+	// The DATA command in SMTP is used to initiate the transfer of the email message content,
+	//
+	// DATA is the last command of a pipelined batch, the client must wait for the 354 reply before sending
+	// the message. Anything already sent would otherwise be read as the message, or as commands
+	if s.conn.pipelined() {
+		s.conn.log.Debug("DATA, improper pipelining, client did not wait for the reply")
+		s.conn.rejected(responses.FailPipelining)
+		s.conn.kill()
+		return
+	}
+	if len(s.conn.RcptTo) == 0 {
+		s.conn.sendResponse(responses.FailNoRecipientsDataCmd)
+		return
+	}
+	s.conn.sendResponse(responses.SuccessDataCmd)
+	s.conn.state = ConnData
+}
+
+func verbSTARTTLS(s *Session, _ string) {
+	// Client: STARTTLS
+	// Server: 220 2.0.0 Ready to start TLS
+	// [TLS handshake occurs here]
+	//
+	if s.server.TLSConfig == nil {
+		s.conn.sendResponse(responses.FailCommandNotImplemented)
+		return
+	}
+	// Commands pipelined after STARTTLS would be read as if they were sent over TLS, i.e. command injection
+	if s.conn.pipelined() {
+		s.conn.log.Debug("STARTTLS, improper pipelining, client did not wait for the reply")
+		s.conn.rejected(responses.FailPipelining)
+		s.conn.kill()
+		return
+	}
+	s.conn.sendResponse(responses.SuccessStartTLSCmd)
+	s.conn.state = ConnStartTLS
+}
@@ -0,0 +1,503 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ReplyError is returned when the server replies with an unexpected code. It is a smtpx.Response
+type ReplyError struct {
+	Command string
+	Reply   *responses.Reply
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Command, strings.ReplaceAll(e.Reply.String(), "\r\n", " "))
+}
+
+func (e *ReplyError) StatusCode() int {
+	return e.Reply.StatusCode()
+}
+
+func (e *ReplyError) Class() int {
+	return e.Reply.Class()
+}
+
+func (e *ReplyError) String() string {
+	return e.Reply.String()
+}
+
+// Client is a connection to a SMTP server
+type Client struct {
+	conn net.Conn
+	text *textproto.Conn
+
+	// host is the name of the server, used to verify its certificate
+	host string
+
+	ext  map[string]string
+	tls  bool
+	helo string
+}
+
+// NewClient returns a client on an existing connection, reading the greeting of the server.
+// host is the name of the server, used to verify its certificate on STARTTLS
+func NewClient(conn net.Conn, host string) (*Client, error) {
+	c := &Client{
+		conn: conn,
+		text: textproto.NewConn(conn),
+		host: host,
+	}
+	_, isTLS := conn.(*tls.Conn)
+	c.tls = isTLS
+
+	if _, err := c.read("greeting", 220); err != nil {
+		_ = c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads the reply, returning a *ReplyError if the code is not of the expected class
+func (c *Client) cmd(expect int, format string, args ...any) (*responses.Reply, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+
+	return c.read(commandOf(format, args...), expect)
+}
+
+// read reads a reply, returning a *ReplyError if the code is not the expected, e.g. 2 for any 2xx or 250.
+// 0 accepts any code
+func (c *Client) read(command string, expect int) (*responses.Reply, error) {
+	reply, err := responses.ReadReply(&c.text.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if !expected(reply, expect) {
+		return reply, &ReplyError{Command: command, Reply: reply}
+	}
+	return reply, nil
+}
+
+func expected(reply *responses.Reply, expect int) bool {
+	if expect == 0 {
+		return true
+	}
+	if expect < 10 {
+		return reply.Class() == expect
+	}
+	return reply.StatusCode() == expect
+}
+
+// commandOf returns the verb of a command, used in errors and logs without leaking credentials
+func commandOf(format string, args ...any) string {
+	verb, _, _ := strings.Cut(fmt.Sprintf(format, args...), " ")
+	return strings.ToUpper(verb)
+}
+
+// Hello sends EHLO, and HELO if the server does not support EHLO
+func (c *Client) Hello(name string) error {
+	c.helo = name
+	reply, err := c.cmd(2, "EHLO %s", name)
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) && replyErr.Class() == 5 {
+		c.ext = nil
+		_, err = c.cmd(2, "HELO %s", name)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	c.ext = map[string]string{}
+	for _, line := range reply.Lines()[1:] {
+		keyword, params, _ := strings.Cut(line, " ")
+		c.ext[strings.ToUpper(keyword)] = params
+	}
+	return nil
+}
+
+// Extension reports if the server advertised the EHLO keyword, and its parameters
+func (c *Client) Extension(keyword string) (bool, string) {
+	params, found := c.ext[strings.ToUpper(keyword)]
+	return found, params
+}
+
+// TLS reports if the connection is encrypted
+func (c *Client) TLS() bool {
+	return c.tls
+}
+
+// StartTLS upgrades the connection to TLS and sends EHLO again. A nil config verifies the server
+// certificate against the host given to NewClient
+func (c *Client) StartTLS(config *tls.Config) error {
+	if _, err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = c.host
+	}
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+	c.tls = true
+	return c.Hello(c.helo)
+}
+
+// Auth authenticates with the server, a is e.g. smtp.PlainAuth
+func (c *Client) Auth(a smtp.Auth) error {
+	found, mechs := c.Extension("AUTH")
+	info := &smtp.ServerInfo{Name: c.host, TLS: c.tls, Auth: strings.Fields(mechs)}
+	if !found {
+		return errors.New("client: server does not support AUTH")
+	}
+
+	mech, resp, err := a.Start(info)
+	if err != nil {
+		return err
+	}
+	var reply *responses.Reply
+	if resp == nil {
+		reply, err = c.cmd(0, "AUTH %s", mech)
+	} else {
+		reply, err = c.cmd(0, "AUTH %s %s", mech, encode(resp))
+	}
+	for err == nil {
+		switch reply.StatusCode() {
+		case 235:
+			return nil
+		case 334:
+			var challenge []byte
+			challenge, err = decode(strings.Join(reply.Lines(), ""))
+			if err != nil {
+				break
+			}
+			resp, err = a.Next(challenge, true)
+			if err != nil {
+				break
+			}
+			reply, err = c.cmd(0, "%s", encode(resp))
+		default:
+			err = &ReplyError{Command: "AUTH", Reply: reply}
+		}
+	}
+	// cancel the exchange
+	if reply != nil && reply.StatusCode() == 334 {
+		_, _ = c.cmd(0, "*")
+	}
+	return err
+}
+
+// Send sends the envelope in a transaction, returning the response for each of the recipients.
+// An error is only returned if the connection fails, the responses then hold what is known so far.
+//
+// PIPELINING is used if advertised, and CHUNKING (BDAT) instead of DATA. SIZE, SMTPUTF8 and DSN parameters
+// are added to the commands when advertised
+func (c *Client) Send(e *envelope.Envelope) ([]smtpx.Response, error) {
+	results := make([]smtpx.Response, len(e.RcptTo))
+	all := func(res smtpx.Response) []smtpx.Response {
+		for i := range results {
+			results[i] = res
+		}
+		return results
+	}
+	data := e.Data.Bytes()
+
+	if ok, params := c.Extension("SIZE"); ok {
+		max, _ := strconv.ParseInt(params, 10, 64)
+		if max > 0 && int64(len(data)) > max {
+			return all(responses.New(552).Enhanced(responses.MessageTooBigForSystem).
+				Line(fmt.Sprintf("Message size %d exceeds the limit %d of the server", len(data), max))), nil
+		}
+	}
+	if e.UTF8 {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return all(responses.New(553).Enhanced(".6.7").
+				Line("Server does not support SMTPUTF8")), nil
+		}
+	}
+
+	pipelining, _ := c.Extension("PIPELINING")
+	chunking, _ := c.Extension("CHUNKING")
+
+	cmds := []string{c.mailCmd(e, len(data))}
+	for _, rcpt := range e.RcptTo {
+		cmds = append(cmds, c.rcptCmd(e, rcpt))
+	}
+	if !chunking {
+		cmds = append(cmds, "DATA")
+	}
+
+	// Without pipelining, each command is sent after the reply of the previous
+	if !pipelining {
+		return c.sendSerial(cmds, results, data, chunking)
+	}
+
+	// DATA is the last command of a pipelined batch, the batch is sent at once
+	for _, cmd := range cmds {
+		if _, err := c.text.W.WriteString(cmd + "\r\n"); err != nil {
+			return results, err
+		}
+	}
+	if err := c.text.W.Flush(); err != nil {
+		return results, err
+	}
+	replies := make([]*responses.Reply, len(cmds))
+	for i := range cmds {
+		reply, err := responses.ReadReply(&c.text.Reader)
+		if err != nil {
+			return results, err
+		}
+		replies[i] = reply
+	}
+
+	mail := replies[0]
+	accepted := 0
+	for i := range e.RcptTo {
+		results[i] = replies[i+1]
+		if mail.Class() != 2 {
+			results[i] = mail
+		}
+		if results[i].Class() == 2 {
+			accepted++
+		}
+	}
+
+	if !chunking {
+		dataReply := replies[len(replies)-1]
+		if dataReply.StatusCode() != 354 {
+			if accepted > 0 {
+				return c.fail(results, dataReply)
+			}
+			return results, c.reset()
+		}
+		if accepted == 0 {
+			// The server accepted DATA without recipients, an empty message is sent to end it (RFC 2920)
+			_, err := c.writeData(nil)
+			if err != nil {
+				return results, err
+			}
+			return results, c.reset()
+		}
+		reply, err := c.writeData(data)
+		if err != nil {
+			return results, err
+		}
+		return c.done(results, reply), nil
+	}
+
+	if accepted == 0 {
+		return results, c.reset()
+	}
+	reply, err := c.writeChunk(data)
+	if err != nil {
+		return results, err
+	}
+	return c.done(results, reply), nil
+}
+
+func (c *Client) sendSerial(cmds []string, results []smtpx.Response, data []byte, chunking bool) ([]smtpx.Response, error) {
+	mail, err := c.cmd(2, "%s", cmds[0])
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		for i := range results {
+			results[i] = mail
+		}
+		return results, c.reset()
+	}
+	if err != nil {
+		return results, err
+	}
+
+	accepted := 0
+	for i := range results {
+		reply, err := c.cmd(2, "%s", cmds[i+1])
+		if err != nil && !errors.As(err, &replyErr) {
+			return results, err
+		}
+		results[i] = reply
+		if reply.Class() == 2 {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return results, c.reset()
+	}
+
+	var reply *responses.Reply
+	if chunking {
+		reply, err = c.writeChunk(data)
+	} else {
+		reply, err = c.cmd(354, "DATA")
+		if errors.As(err, &replyErr) {
+			return c.fail(results, reply)
+		}
+		if err == nil {
+			reply, err = c.writeData(data)
+		}
+	}
+	if err != nil {
+		return results, err
+	}
+	return c.done(results, reply), nil
+}
+
+// writeData writes the message after a 354 reply and reads the final reply
+func (c *Client) writeData(data []byte) (*responses.Reply, error) {
+	w := c.text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return responses.ReadReply(&c.text.Reader)
+}
+
+// writeChunk sends the message in a single BDAT chunk (RFC 3030) and reads the reply
+func (c *Client) writeChunk(data []byte) (*responses.Reply, error) {
+	if _, err := fmt.Fprintf(c.text.W, "BDAT %d LAST\r\n", len(data)); err != nil {
+		return nil, err
+	}
+	if _, err := c.text.W.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.text.W.Flush(); err != nil {
+		return nil, err
+	}
+	return responses.ReadReply(&c.text.Reader)
+}
+
+// done sets the final reply of the message for the accepted recipients
+func (c *Client) done(results []smtpx.Response, reply *responses.Reply) []smtpx.Response {
+	for i, res := range results {
+		if res != nil && res.Class() == 2 {
+			results[i] = reply
+		}
+	}
+	return results
+}
+
+// fail sets the reply for the accepted recipients, and resets the transaction
+func (c *Client) fail(results []smtpx.Response, reply *responses.Reply) ([]smtpx.Response, error) {
+	return c.done(results, reply), c.reset()
+}
+
+func (c *Client) mailCmd(e *envelope.Envelope, size int) string {
+	from := ""
+	if e.MailFrom != nil {
+		from = e.MailFrom.Address
+	}
+	cmd := "MAIL FROM:<" + from + ">"
+
+	if ok, _ := c.Extension("SIZE"); ok {
+		cmd += " SIZE=" + strconv.Itoa(size)
+	}
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if e.UTF8 {
+		cmd += " SMTPUTF8"
+	}
+	if ok, _ := c.Extension("DSN"); ok && e.DSN != nil {
+		if e.DSN.Ret != "" {
+			cmd += " RET=" + e.DSN.Ret
+		}
+		if e.DSN.EnvID != "" {
+			cmd += " ENVID=" + xtext(e.DSN.EnvID)
+		}
+	}
+	return cmd
+}
+
+func (c *Client) rcptCmd(e *envelope.Envelope, rcpt *mail.Address) string {
+	cmd := "RCPT TO:<" + rcpt.Address + ">"
+	if ok, _ := c.Extension("DSN"); ok && e.DSN != nil {
+		if notify := e.DSN.NotifyOf(rcpt.Address); len(notify) > 0 {
+			cmd += " NOTIFY=" + strings.Join(notify, ",")
+		}
+		if orcpt := e.DSN.ORcptOf(rcpt.Address); orcpt != "" {
+			cmd += " ORCPT=" + xtext(orcpt)
+		}
+	}
+	return cmd
+}
+
+// Reset aborts the current transaction
+func (c *Client) Reset() error {
+	return c.reset()
+}
+
+func (c *Client) reset() error {
+	_, err := c.cmd(2, "RSET")
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return nil
+	}
+	return err
+}
+
+// Quit sends QUIT and closes the connection
+func (c *Client) Quit() error {
+	_, err := c.cmd(221, "QUIT")
+	if cerr := c.Close(); err == nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the connection without QUIT
+func (c *Client) Close() error {
+	return c.text.Close()
+}
+
+func encode(b []byte) string {
+	if len(b) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// xtext encodes s as xtext (RFC 3461), used by the ENVID and ORCPT parameters
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < 33 || ch > 126 || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
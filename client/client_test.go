@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// script is a fake server, answering each line read with the reply of the first matching prefix
+type script struct {
+	ehlo    string
+	replies map[string]string
+	lines   []string
+	chunk   string
+	done    chan struct{}
+}
+
+func (s *script) serve(conn net.Conn) {
+	defer close(s.done)
+	defer conn.Close()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	w := func(reply string) {
+		_, _ = io.WriteString(conn, reply+"\r\n")
+	}
+	w("220 fake.example.com ESMTP")
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return
+		}
+		s.lines = append(s.lines, line)
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			w(s.ehlo)
+		case "BDAT":
+			var n int
+			_, _ = fmt.Sscanf(line, "BDAT %d", &n)
+			buf := make([]byte, n)
+			_, _ = io.ReadFull(r.R, buf)
+			s.chunk = string(buf)
+			w("250 2.0.0 Queued")
+		case "QUIT":
+			w("221 2.0.0 Bye")
+			return
+		default:
+			reply := "250 2.0.0 OK"
+			for prefix, r := range s.replies {
+				if strings.HasPrefix(line, prefix) {
+					reply = r
+				}
+			}
+			w(reply)
+		}
+	}
+}
+
+func dialScript(t *testing.T, s *script) *Client {
+	s.done = make(chan struct{})
+	server, conn := net.Pipe()
+	go s.serve(server)
+	c, err := NewClient(conn, "fake.example.com")
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.example.com"))
+	return c
+}
+
+func testEnvelope(rcpts ...string) *envelope.Envelope {
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: "from@example.com"}
+	for _, rcpt := range rcpts {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Address: rcpt})
+	}
+	_, _ = e.Data.WriteString("Subject: test\r\n\r\nHello\r\n")
+	return e
+}
+
+func TestClientChunkingAndDSN(t *testing.T) {
+	s := &script{
+		ehlo: "250-fake.example.com\r\n250-CHUNKING\r\n250-DSN\r\n250 SIZE 1000",
+		replies: map[string]string{
+			"RCPT TO:<unknown@example.com>": "550 5.1.1 User unknown",
+		},
+	}
+	c := dialScript(t, s)
+
+	e := testEnvelope("to@example.com", "unknown@example.com")
+	e.DSN = &envelope.DSN{
+		Ret:    envelope.DSNRetHdrs,
+		EnvID:  "id+1=2",
+		Notify: map[string][]string{"to@example.com": {envelope.DSNNotifyFailure, envelope.DSNNotifyDelay}},
+		ORcpt:  map[string]string{"to@example.com": "rfc822;to@example.com"},
+	}
+
+	res, err := c.Send(e)
+	require.NoError(t, err)
+	require.NoError(t, c.Quit())
+	<-s.done
+
+	require.Len(t, res, 2)
+	assert.Equal(t, 250, res[0].StatusCode())
+	assert.Equal(t, 550, res[1].StatusCode())
+	assert.Equal(t, "Subject: test\r\n\r\nHello\r\n", s.chunk)
+
+	assert.Contains(t, s.lines, "MAIL FROM:<from@example.com> SIZE=24 RET=HDRS ENVID=id+2B1+3D2")
+	assert.Contains(t, s.lines, "RCPT TO:<to@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;to@example.com")
+	assert.Contains(t, s.lines, "BDAT 24 LAST")
+}
+
+func TestClientSize(t *testing.T) {
+	s := &script{ehlo: "250-fake.example.com\r\n250 SIZE 10"}
+	c := dialScript(t, s)
+
+	res, err := c.Send(testEnvelope("to@example.com"))
+	require.NoError(t, err)
+	require.NoError(t, c.Quit())
+	<-s.done
+
+	require.Len(t, res, 1)
+	assert.Equal(t, 552, res[0].StatusCode())
+	assert.NotContains(t, s.lines, "DATA")
+}
+
+func TestClientAuth(t *testing.T) {
+	s := &script{
+		ehlo:    "250-fake.example.com\r\n250 AUTH PLAIN LOGIN",
+		replies: map[string]string{"AUTH PLAIN": "235 2.7.0 Authentication successful"},
+	}
+	c := dialScript(t, s)
+
+	// PlainAuth requires TLS, unless the server is localhost
+	c.host = "localhost"
+	require.NoError(t, c.Auth(smtp.PlainAuth("", "user", "secret", "localhost")))
+	require.NoError(t, c.Quit())
+	<-s.done
+	assert.Contains(t, s.lines, "AUTH PLAIN AHVzZXIAc2VjcmV0")
+}
@@ -0,0 +1,368 @@
+// Package client delivers mail to other SMTP servers.
+//
+// A Client speaks SMTP on a single connection, and a Deliverer delivers an envelope to the mail exchangers
+// of its recipient domains, returning a smtpx.Response per recipient.
+//
+// Example usage:
+//
+//	d := client.New(
+//		client.WithHostname("mx.example.com"),
+//		client.WithTLS(client.TLSOpportunistic, nil),
+//	)
+//	for _, res := range d.Deliver(ctx, e) {
+//		fmt.Println(res.Rcpt, res.Host, res.Response)
+//	}
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/utils"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"time"
+)
+
+const (
+	defaultPort    = "25"
+	defaultTimeout = 5 * time.Minute
+)
+
+// TLSPolicy decides if STARTTLS is used
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic uses STARTTLS if the server advertises it, without verifying the certificate
+	// unless a tls.Config is given
+	TLSOpportunistic TLSPolicy = iota
+	// TLSRequired requires STARTTLS and a verified certificate, servers without it are skipped
+	TLSRequired
+	// TLSNone never uses STARTTLS
+	TLSNone
+)
+
+// Dialer dials the mail exchangers, *net.Dialer satisfies it
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type Settings struct {
+	Resolver Resolver
+	Dialer   Dialer
+	Logger   *slog.Logger
+
+	// Hostname is sent in EHLO, defaults to os.Hostname()
+	Hostname string
+	// Port of the mail exchangers, defaults to 25
+	Port string
+
+	TLSPolicy TLSPolicy
+	TLSConfig *tls.Config
+
+	// Auth is used if the server advertises AUTH
+	Auth smtp.Auth
+
+	// Fallbacks are tried, in order, after the mail exchangers of a domain
+	Fallbacks []string
+
+	// Timeout of a session with a mail exchanger, defaults to 5 minutes
+	Timeout time.Duration
+}
+
+type Option func(*Settings)
+
+// WithResolver sets the resolver of MX records, defaults to net.DefaultResolver
+func WithResolver(resolver Resolver) Option {
+	return func(s *Settings) {
+		s.Resolver = resolver
+	}
+}
+
+// WithDialer sets the dialer, defaults to a net.Dialer
+func WithDialer(dialer Dialer) Option {
+	return func(s *Settings) {
+		s.Dialer = dialer
+	}
+}
+
+// WithLogger logs failed connections to mail exchangers
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithHostname sets the name sent in EHLO, defaults to os.Hostname()
+func WithHostname(hostname string) Option {
+	return func(s *Settings) {
+		s.Hostname = hostname
+	}
+}
+
+// WithPort sets the port of the mail exchangers, defaults to 25
+func WithPort(port string) Option {
+	return func(s *Settings) {
+		s.Port = port
+	}
+}
+
+// WithTLS sets the TLS policy and config, defaults to TLSOpportunistic
+func WithTLS(policy TLSPolicy, config *tls.Config) Option {
+	return func(s *Settings) {
+		s.TLSPolicy = policy
+		s.TLSConfig = config
+	}
+}
+
+// WithAuth authenticates with the servers that advertise AUTH
+func WithAuth(auth smtp.Auth) Option {
+	return func(s *Settings) {
+		s.Auth = auth
+	}
+}
+
+// WithFallback adds hosts that are tried after the mail exchangers of a domain
+func WithFallback(hosts ...string) Option {
+	return func(s *Settings) {
+		s.Fallbacks = append(s.Fallbacks, hosts...)
+	}
+}
+
+// WithTimeout sets the timeout of a session with a mail exchanger, defaults to 5 minutes
+func WithTimeout(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Timeout = d
+	}
+}
+
+// Result is the outcome of the delivery to a recipient
+type Result struct {
+	Rcpt *mail.Address
+	// Host is the mail exchanger that gave the response, empty if none could be reached
+	Host     string
+	Response smtpx.Response
+}
+
+type Deliverer struct {
+	settings *Settings
+}
+
+func New(opts ...Option) *Deliverer {
+	settings := &Settings{
+		Port:    defaultPort,
+		Timeout: defaultTimeout,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	if settings.Resolver == nil {
+		settings.Resolver = net.DefaultResolver
+	}
+	if settings.Dialer == nil {
+		settings.Dialer = &net.Dialer{}
+	}
+	if settings.Hostname == "" {
+		settings.Hostname, _ = os.Hostname()
+	}
+	return &Deliverer{settings: settings}
+}
+
+// Deliver delivers the envelope to the mail exchangers of the recipient domains, one domain at a time.
+// The mail exchangers of a domain, and then the fallbacks, are tried in order until one can be reached
+func (d *Deliverer) Deliver(ctx context.Context, e *envelope.Envelope) []Result {
+	var results []Result
+	var domains []string
+	byDomain := map[string][]*mail.Address{}
+	for _, rcpt := range e.RcptTo {
+		domain := utils.DomainOfEmail(rcpt)
+		if _, found := byDomain[domain]; !found {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	for _, domain := range domains {
+		sub := *e
+		sub.RcptTo = byDomain[domain]
+		results = append(results, d.deliverDomain(ctx, &sub, domain)...)
+	}
+	return results
+}
+
+func (d *Deliverer) deliverDomain(ctx context.Context, e *envelope.Envelope, domain string) []Result {
+	hosts, err := LookupMX(ctx, d.settings.Resolver, domain)
+	if errors.Is(err, ErrNullMX) {
+		return all(e, responses.New(556).Enhanced(".1.10").Line("Recipient domain does not accept mail"))
+	}
+	if err != nil {
+		return all(e, responses.New(451).Enhanced(responses.RoutingServerFailure).
+			Line(fmt.Sprintf("MX lookup of %s failed", domain)))
+	}
+	hosts = append(hosts, d.settings.Fallbacks...)
+	return d.deliverHosts(ctx, e, hosts)
+}
+
+// deliverHosts sends the envelope to the first of the hosts that accepts it. The next host is tried if the host
+// cannot be reached, if the connection is lost before a recipient was accepted, or if all recipients got
+// a temporary failure
+func (d *Deliverer) deliverHosts(ctx context.Context, e *envelope.Envelope, hosts []string) []Result {
+	var results []Result
+	var lastErr error
+	for i, host := range hosts {
+		c, err := d.dial(ctx, host)
+		if err != nil {
+			d.log("client, could not connect", "host", host, "err", err)
+			lastErr = err
+			continue
+		}
+
+		replies, err := c.Send(e)
+		if err != nil {
+			d.log("client, connection failed", "host", host, "err", err)
+			_ = c.Close()
+		} else {
+			_ = c.Quit()
+		}
+		results = make([]Result, len(e.RcptTo))
+		for j, res := range replies {
+			results[j] = Result{Rcpt: e.RcptTo[j], Host: host, Response: res}
+			if res == nil {
+				results[j].Response = lostConnection(err)
+			}
+		}
+		if i < len(hosts)-1 && !anyAccepted(results) && (err != nil || allTemporary(results)) {
+			d.log("client, trying next host", "host", host)
+			continue
+		}
+		return results
+	}
+
+	// the replies of a host are kept over hosts that could not be reached
+	if results != nil {
+		return results
+	}
+	var replyErr *ReplyError
+	if errors.As(lastErr, &replyErr) {
+		return all(e, replyErr.Reply)
+	}
+	return all(e, noAnswer(lastErr))
+}
+
+// all returns the same result for all recipients
+func all(e *envelope.Envelope, res smtpx.Response) []Result {
+	results := make([]Result, len(e.RcptTo))
+	for i, rcpt := range e.RcptTo {
+		results[i] = Result{Rcpt: rcpt, Response: res}
+	}
+	return results
+}
+
+func anyAccepted(results []Result) bool {
+	for _, r := range results {
+		if r.Response != nil && r.Response.Class() == responses.ClassSuccess {
+			return true
+		}
+	}
+	return false
+}
+
+func allTemporary(results []Result) bool {
+	for _, r := range results {
+		if r.Response == nil || r.Response.Class() != responses.ClassTransientFailure {
+			return false
+		}
+	}
+	return true
+}
+
+// dial connects to a mail exchanger and sets up the session, i.e. EHLO, STARTTLS and AUTH.
+// The host may include a port, e.g. smtp.example.com:587, otherwise the Port setting is used
+func (d *Deliverer) dial(ctx context.Context, host string) (*Client, error) {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, d.settings.Port
+	}
+	conn, err := d.settings.Dialer.DialContext(ctx, "tcp", net.JoinHostPort(name, port))
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(d.settings.Timeout))
+
+	c, err := NewClient(conn, name)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	err = d.setup(c)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (d *Deliverer) setup(c *Client) error {
+	err := c.Hello(d.settings.Hostname)
+	if err != nil {
+		return err
+	}
+
+	starttls, _ := c.Extension("STARTTLS")
+	switch d.settings.TLSPolicy {
+	case TLSRequired:
+		if !starttls {
+			return errors.New("client: server does not support STARTTLS")
+		}
+		err = c.StartTLS(d.settings.TLSConfig)
+	case TLSOpportunistic:
+		if !starttls {
+			break
+		}
+		config := d.settings.TLSConfig
+		if config == nil {
+			config = &tls.Config{InsecureSkipVerify: true}
+		}
+		err = c.StartTLS(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ok, _ := c.Extension("AUTH"); ok && d.settings.Auth != nil {
+		return c.Auth(d.settings.Auth)
+	}
+	return nil
+}
+
+func (d *Deliverer) log(msg string, args ...any) {
+	if d.settings.Logger != nil {
+		d.settings.Logger.Debug(msg, args...)
+	}
+}
+
+func noAnswer(err error) smtpx.Response {
+	text := "No answer from host"
+	if err != nil {
+		text += ", " + err.Error()
+	}
+	return responses.New(451).Enhanced(responses.NoAnswerFromHost).Line(text)
+}
+
+func lostConnection(err error) smtpx.Response {
+	text := "Connection lost"
+	if err != nil {
+		text += ", " + err.Error()
+	}
+	return responses.New(451).Enhanced(responses.BadConnection).Line(text)
+}
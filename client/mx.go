@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ErrNullMX is returned for domains that publish a null MX, i.e. does not accept mail (RFC 7505)
+var ErrNullMX = errors.New("client: domain does not accept mail, null MX")
+
+// Resolver looks up MX records, net.DefaultResolver satisfies it
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// LookupMX returns the mail exchangers of domain in order of preference.
+//
+// A domain without MX records has an implicit MX, i.e. the domain itself (RFC 5321 5.1), and an address literal,
+// e.g. [192.0.2.1], is returned as is. A null MX returns ErrNullMX
+func LookupMX(ctx context.Context, resolver Resolver, domain string) ([]string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		literal := strings.TrimPrefix(domain[1:len(domain)-1], "IPv6:")
+		addr, err := netip.ParseAddr(literal)
+		if err != nil {
+			return nil, err
+		}
+		return []string{addr.String()}, nil
+	}
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, ErrNullMX
+	}
+
+	slices.SortStableFunc(mxs, func(a, b *net.MX) int {
+		return int(a.Pref) - int(b.Pref)
+	})
+	var hosts []string
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" || slices.Contains(hosts, host) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+type resolver map[string][]*net.MX
+
+func (r resolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	mxs, found := r[name]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if mxs == nil {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return mxs, nil
+}
+
+func TestLookupMX(t *testing.T) {
+	r := resolver{
+		"example.com": {
+			{Host: "mx2.example.com.", Pref: 20},
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "mx3.example.com.", Pref: 20},
+		},
+		"null.example.com":   {{Host: ".", Pref: 0}},
+		"broken.example.com": nil,
+	}
+
+	t.Run("Preference", func(t *testing.T) {
+		hosts, err := LookupMX(context.Background(), r, "example.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mx1.example.com", "mx2.example.com", "mx3.example.com"}, hosts)
+	})
+
+	t.Run("Implicit MX", func(t *testing.T) {
+		hosts, err := LookupMX(context.Background(), r, "nomx.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"nomx.example.com"}, hosts)
+	})
+
+	t.Run("Null MX", func(t *testing.T) {
+		_, err := LookupMX(context.Background(), r, "null.example.com")
+		assert.ErrorIs(t, err, ErrNullMX)
+	})
+
+	t.Run("Temporary error", func(t *testing.T) {
+		_, err := LookupMX(context.Background(), r, "broken.example.com")
+		var dnsErr *net.DNSError
+		assert.True(t, errors.As(err, &dnsErr))
+	})
+
+	t.Run("Address literal", func(t *testing.T) {
+		hosts, err := LookupMX(context.Background(), r, "[IPv6:2001:db8::1]")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2001:db8::1"}, hosts)
+	})
+}
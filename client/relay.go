@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"time"
+)
+
+// Relay sends the envelope in a single transaction to the first of the hosts that accepts it, e.g. the smart hosts
+// of a relay. A host may include a port, e.g. smtp.example.com:587.
+//
+// The next host is tried if the host cannot be reached, if the connection is lost before a recipient was accepted,
+// or if all recipients got a temporary failure
+func (d *Deliverer) Relay(ctx context.Context, e *envelope.Envelope, hosts ...string) []Result {
+	if len(e.RcptTo) == 0 {
+		return nil
+	}
+	return d.deliverHosts(ctx, e, hosts)
+}
+
+// RelayHandler returns a smtpx.Handler that relays the envelopes it receives to the smart hosts, see Relay.
+// The message is only accepted if the upstream server accepts it, and the reply of the upstream server is
+// returned to the client.
+//
+// If only some of the recipients are accepted upstream, the message is accepted since it can not be retried
+// for only the rejected ones. The rejected recipients, including those with a temporary failure, are then
+// bounced to the sender instead, with a DSN relayed to the same hosts, see envelope.Envelope.Bounce
+//
+// Example usage:
+//
+//	d := client.New(
+//		client.WithTLS(client.TLSRequired, nil),
+//		client.WithAuth(smtp.PlainAuth("", "user", "password", "smtp.example.com")),
+//	)
+//	server.Handler = d.RelayHandler("smtp.example.com:587", "smtp2.example.com:587")
+func (d *Deliverer) RelayHandler(hosts ...string) smtpx.Handler {
+	return smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+		results := d.Relay(e.Context(), e, hosts...)
+
+		var accepted, temporary, permanent smtpx.Response
+		for _, res := range results {
+			switch res.Response.Class() {
+			case responses.ClassSuccess:
+				if accepted == nil {
+					accepted = res.Response
+				}
+			case responses.ClassTransientFailure:
+				if temporary == nil {
+					temporary = res.Response
+				}
+			default:
+				if permanent == nil {
+					permanent = res.Response
+				}
+			}
+		}
+
+		switch {
+		case accepted != nil:
+			d.bounce(e, results, hosts)
+			return accepted
+		case temporary != nil:
+			return upstream(temporary)
+		case permanent != nil:
+			return upstream(permanent)
+		}
+		return responses.FailNoRecipientsDataCmd
+	})
+}
+
+// bounce relays a DSN of the recipients that were rejected upstream to the sender of the envelope
+func (d *Deliverer) bounce(e *envelope.Envelope, results []Result, hosts []string) {
+	report := envelope.Report{
+		ReportingMTA: d.settings.Hostname,
+		Arrival:      time.Now(),
+	}
+	for _, res := range results {
+		if res.Response.Class() == responses.ClassSuccess {
+			continue
+		}
+		d.log("client, relay rejected recipient", "rcpt", res.Rcpt.Address, "host", res.Host,
+			"response", res.Response.String())
+		report.Recipients = append(report.Recipients, envelope.RecipientStatus{
+			Recipient:   res.Rcpt.Address,
+			Action:      envelope.DSNActionFailed,
+			Diagnostic:  res.Response.String(),
+			RemoteMTA:   res.Host,
+			LastAttempt: report.Arrival,
+		})
+	}
+	if len(report.Recipients) == 0 {
+		return
+	}
+
+	b, err := e.Bounce(report)
+	if errors.Is(err, envelope.ErrNullSender) || errors.Is(err, envelope.ErrNoNotification) {
+		return
+	}
+	if err != nil {
+		d.log("client, could not create bounce", "err", err)
+		return
+	}
+	for _, res := range d.Relay(e.Context(), b, hosts...) {
+		if res.Response.Class() != responses.ClassSuccess {
+			d.log("client, could not relay bounce", "rcpt", res.Rcpt.Address, "host", res.Host,
+				"response", res.Response.String())
+		}
+	}
+}
+
+// upstream returns a reply of an upstream server to the client. A 421 closes the connection of the upstream
+// server, not that of the client, so it is returned as a 451
+func upstream(res smtpx.Response) smtpx.Response {
+	var reply *responses.Reply
+	switch v := res.(type) {
+	case *responses.Reply:
+		reply = v
+	case *ReplyError:
+		reply = v.Reply
+	}
+	if reply == nil || reply.StatusCode() != 421 {
+		return res
+	}
+	r := responses.New(451, reply.Lines()...)
+	if code, ok := reply.EnhancedCode(); ok {
+		r.Enhanced(code.String())
+	}
+	return r
+}
@@ -1,11 +1,14 @@
 package smtpx
 
 import (
+	"bufio"
 	"crypto/tls"
 	"fmt"
 	"github.com/modfin/smtpx/envelope"
+	"io"
 	"log/slog"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -44,13 +47,27 @@ type connection struct {
 
 	messagesSent int
 
+	// tarpit returns the delay of a reply given the number of errors
+	tarpit func(errors int) time.Duration
+	// override returns the response to send instead of a canned response
+	override func(res Response) Response
+
 	bufErr error
 
-	in *smtpReader
+	in  *smtpReader
+	out *bufio.Writer
 
 	connGuard sync.Mutex
 	conn      net.Conn
 
+	// connected is true once the Connect hooks have run
+	connected bool
+	// tlsStarted is true once the session has been reset by STARTTLS, see resetSession
+	tlsStarted bool
+
+	// recording is the transcript of the session, nil if it is not recorded
+	recording *recording
+
 	log *slog.Logger
 }
 
@@ -64,18 +81,33 @@ func newConnection(conn net.Conn, maxMessageSize int64, connectionId uint64, log
 		Envelope:    env,
 		ConnectedAt: time.Now(),
 		charset:     CharsetDefault,
-		in:          NewSMTPReader(conn, maxMessageSize),
+		out:         bufio.NewWriter(conn),
 		log: logger.With(
 			"connection-id", env.ConnectionId(),
 			// This is change when a multiple emails are sent.
 			// Will stack with regular slog implementation
 			//"envelope-id", env.EnvelopeId(),
 
-			"remote-ip", conn.RemoteAddr()),
+			"remote-ip", env.Remote),
 	}
+	c.in = NewSMTPReader(flushingReader{c: c, r: conn}, maxMessageSize)
 	return c
 }
 
+// flushingReader flushes the buffered replies before blocking on a read from the client. Replies to pipelined
+// commands are thereby sent in one batch, once all commands in the input buffer have been handled (RFC 2920)
+type flushingReader struct {
+	c *connection
+	r io.Reader
+}
+
+func (f flushingReader) Read(p []byte) (int, error) {
+	if err := f.c.flush(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
+
 const commandSuffix = "\r\n"
 
 // Reads from the connection until a \n terminator is encountered,
@@ -88,11 +120,12 @@ func (conn *connection) readCommand() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	conn.recordCommand(cmd)
 	return cmd, nil
 }
 
 // sendResponse adds a response to be written on the next turn
-// the response gets buffered
+// the response gets buffered, and is flushed when there are no more commands to read
 func (c *connection) sendResponse(r ...interface{}) {
 
 	var out string
@@ -103,6 +136,11 @@ func (c *connection) sendResponse(r ...interface{}) {
 		switch v := item.(type) {
 		case error:
 			out += v.Error()
+		case Response:
+			if c.override != nil {
+				v = c.override(v)
+			}
+			out += v.String()
 		case fmt.Stringer:
 			out += v.String()
 		case string:
@@ -110,9 +148,18 @@ func (c *connection) sendResponse(r ...interface{}) {
 		}
 	}
 
+	if c.tarpit != nil {
+		if d := c.tarpit(c.errors); d > 0 {
+			c.log.Debug("tarpit", "delay", d, "errors", c.errors)
+			time.Sleep(d)
+		}
+	}
+
 	c.log.Debug(("Server: " + out))
 
-	_, c.bufErr = c.conn.Write([]byte(out + commandSuffix))
+	wire := toWire(out)
+	c.recordReply(wire)
+	_, c.bufErr = c.out.WriteString(wire)
 
 	if c.bufErr != nil {
 		c.log.Error("could not write to c.bufout", "err", c.bufErr)
@@ -121,23 +168,117 @@ func (c *connection) sendResponse(r ...interface{}) {
 
 }
 
+// toWire terminates every line of a reply with \r\n, bare \r or \n in the text would otherwise break the protocol
+func toWire(reply string) string {
+	reply = strings.TrimRight(reply, "\r\n")
+	lines := strings.FieldsFunc(reply, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+	return strings.Join(lines, commandSuffix) + commandSuffix
+}
+
+// flush writes the buffered responses to the client
+func (c *connection) flush() error {
+	if c.out.Buffered() == 0 {
+		return nil
+	}
+	err := c.out.Flush()
+	c.recordSent()
+	if err != nil {
+		c.bufErr = err
+		c.log.Error("could not flush c.bufout", "err", err)
+	}
+	return err
+}
+
+// pipelined returns true if the client has sent more data that has not been read yet, i.e. pipelined commands
+func (c *connection) pipelined() bool {
+	return c.in.buf.Buffered() > 0
+}
+
 // resetTransaction resets the SMTP transaction, ready for the next email (doesn't disconnect)
 // Transaction ends on:
 // -HELO/EHLO/REST command
 // -End of DATA command
-// TLS handshake
 func (c *connection) resetTransaction() {
-	c.Envelope = envelope.NewEnvelope(c.RemoteAddr, c.ConnectionId())
+	e := envelope.NewEnvelope(c.RemoteAddr, c.ConnectionId())
+	// The session properties outlives the transaction
+	e.Remote = c.Remote
+	e.Peer = c.Peer
+	e.Helo = c.Helo
+	e.HeloName = c.HeloName
+	e.ESMTP = c.ESMTP
+	e.TLS = c.TLS
+	c.Envelope = e
 	c.in.ResetLimit()
 
 	c.log.Debug("transaction reset")
 }
 
+// resetSession discards what the client has told about itself, i.e. the HELO and the transaction, which is
+// required after the TLS handshake since it was told in plain text (RFC 3207 4.2). The client has to send
+// EHLO again before MAIL
+func (c *connection) resetSession() {
+	c.resetTransaction()
+	c.Helo = ""
+	c.HeloName = envelope.HeloName{}
+	c.ESMTP = false
+	c.charset = CharsetDefault
+	c.tlsStarted = true
+}
+
 // isInTransaction returns true if the connection is inside a transaction.
 // A transaction starts after a MAIL command gets issued by the connection.
 // Call resetTransaction to end the transaction
 func (c *connection) isInTransaction() bool {
-	return c.MailFrom != nil && c.MailFrom.Address != ""
+	return c.MailFrom != nil
+}
+
+// rejected sends a rejection from a hook to the client. A 421 response closes the connection
+func (c *connection) rejected(res Response) {
+	c.log.Debug("command rejected", "response", res.String())
+	c.errors++
+	c.sendResponse(res)
+	if closesConnection(res) {
+		c.kill()
+	}
+}
+
+// earlyTalker waits for d and returns true if the client has sent anything in the meantime. If proxy is true, a
+// PROXY line is not counted, since a proxy sends it before the greeting
+func (c *connection) earlyTalker(d time.Duration, proxy bool) (bool, error) {
+	err := c.conn.SetReadDeadline(time.Now().Add(d))
+	if err != nil {
+		return false, err
+	}
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	// the PROXY line is peeked a byte at a time, and left in the buffer to be read as a command
+	for n := 1; ; n++ {
+		b, err := c.in.buf.Peek(n)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !proxy || n > maxProxyLine || !isProxyLine(b) {
+			return true, nil
+		}
+	}
+}
+
+// maxProxyLine is the longest PROXY line, including CRLF, of version 1 of the PROXY protocol
+const maxProxyLine = 107
+
+// isProxyLine returns true if b is the start of a PROXY line, not followed by anything
+func isProxyLine(b []byte) bool {
+	prefix, line := "PROXY ", string(b)
+	if len(line) <= len(prefix) {
+		return strings.HasPrefix(prefix, line)
+	}
+	end := strings.IndexByte(line, '\n')
+	return strings.HasPrefix(line, prefix) && (end < 0 || end == len(line)-1)
 }
 
 // kill flags the connection to close on the next turn
@@ -164,12 +305,18 @@ func (c *connection) setTimeout(t time.Duration) (err error) {
 func (c *connection) closeConn() {
 	defer c.connGuard.Unlock()
 	c.connGuard.Lock()
+	_ = c.flush()
 	_ = c.conn.Close()
 	c.conn = nil
+	c.recordClose()
 }
 
 // UpgradeToTLS upgrades a connection connection to TLS
 func (c *connection) upgradeTLS(tlsConfig *tls.Config) error {
+	// the reply to STARTTLS must be sent before the handshake
+	if err := c.flush(); err != nil {
+		return err
+	}
 	// wrap c.conn in a new TLS Server side connection
 	tlsConn := tls.Server(c.conn, tlsConfig)
 	// Call handshake here to get any handshake error before reading starts
@@ -180,7 +327,9 @@ func (c *connection) upgradeTLS(tlsConfig *tls.Config) error {
 	// convert tlsConn to net.Conn
 	c.conn = net.Conn(tlsConn)
 
-	c.in = NewSMTPReader(c.conn, c.in.Limit())
+	c.out = bufio.NewWriter(c.conn)
+	c.in = NewSMTPReader(flushingReader{c: c, r: c.conn}, c.in.Limit())
 	c.TLS = true
+	c.recordTLS(tlsConn.ConnectionState().Version)
 	return err
 }
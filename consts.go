@@ -1,5 +1,7 @@
 package smtpx
 
+import "time"
+
 const (
 	Name    = "Brevx"
 	Version = "0.0.1"
@@ -27,4 +29,5 @@ const (
 
 	defaultMaxRecipients           = 100 //  RFC5321LimitRecipients
 	defaultMaxUnrecognizedCommands = 5
+	defaultTarpitMaxDelay          = 30 * time.Second
 )
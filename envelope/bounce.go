@@ -0,0 +1,322 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx/utils"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DSN values of the Action field, i.e. what happened to a recipient (RFC 3464 2.3.3)
+const (
+	DSNActionFailed    = "failed"
+	DSNActionDelayed   = "delayed"
+	DSNActionDelivered = "delivered"
+	DSNActionRelayed   = "relayed"
+	DSNActionExpanded  = "expanded"
+)
+
+// MimeMultipartReport is the container of Delivery Status Notifications (RFC 6522)
+const MimeMultipartReport = "multipart/report"
+
+// MimeTextRFC822Headers is used to return only the headers of a message in a DSN
+const MimeTextRFC822Headers = "text/rfc822-headers"
+
+var (
+	// ErrNullSender is returned when bouncing a message without a sender, since a DSN is never sent
+	// in reply to a DSN (RFC 3461 6.2)
+	ErrNullSender = errors.New("envelope: message has a null sender, no DSN is sent")
+	// ErrNoNotification is returned when no recipient asked for a DSN of its Action, e.g. NOTIFY=NEVER
+	ErrNoNotification = errors.New("envelope: no recipient requested a DSN")
+)
+
+// RecipientStatus is the outcome of the delivery to a recipient, reported in a DSN
+type RecipientStatus struct {
+	// Recipient is the address that the delivery was attempted to
+	Recipient string
+	// Action is one of the DSNAction values, e.g. DSNActionFailed
+	Action string
+	// Status is the enhanced status code, e.g. "5.1.1". If empty, it is taken from Diagnostic,
+	// or defaults to 5.0.0 for failures, 4.0.0 for delays and 2.0.0 otherwise
+	Status string
+	// Diagnostic is the reply of the remote server, e.g. "550 5.1.1 User unknown"
+	Diagnostic string
+	// RemoteMTA is the host that gave the Diagnostic
+	RemoteMTA string
+
+	LastAttempt time.Time
+	// WillRetryUntil is when a delayed delivery expires
+	WillRetryUntil time.Time
+}
+
+// Report is a Delivery Status Notification of a message, i.e. a bounce or a delay warning (RFC 3464)
+type Report struct {
+	// ReportingMTA is the name of the host that creates the report
+	ReportingMTA string
+	// From is the sender of the report, defaults to MAILER-DAEMON@ReportingMTA
+	From string
+	// Arrival is when the message was received
+	Arrival time.Time
+	// Date of the report, defaults to now
+	Date time.Time
+	// Text is the human-readable explanation, a default is generated from the recipients if empty
+	Text string
+
+	Recipients []RecipientStatus
+}
+
+// Bounce returns a DSN of the envelope, sent from the null sender to the original sender.
+//
+// Recipients are only included if their NOTIFY parameter asks for their Action. Without a NOTIFY parameter,
+// failures and delays are reported. The original message is returned in full, or only its headers if RET=HDRS.
+// ErrNullSender is returned for envelopes without a sender, and ErrNoNotification if no recipient is reported
+func (e *Envelope) Bounce(r Report) (*Envelope, error) {
+	if e.MailFrom == nil || e.MailFrom.Address == "" {
+		return nil, ErrNullSender
+	}
+
+	var rcpts []RecipientStatus
+	for _, rcpt := range r.Recipients {
+		if notify(e.DSN.NotifyOf(rcpt.Recipient), rcpt.Action) {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil, ErrNoNotification
+	}
+	r.Recipients = rcpts
+
+	data, err := e.report(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewEnvelope(nil, 0)
+	b.MailFrom = &mail.Address{}
+	b.RcptTo = []*mail.Address{{Address: e.MailFrom.Address}}
+	b.UTF8 = e.UTF8
+	b.Helo = r.ReportingMTA
+	_, _ = b.Data.Write(data)
+	return b, nil
+}
+
+// notify returns true if the NOTIFY parameter asks for a DSN of the action
+func notify(params []string, action string) bool {
+	if slices.Contains(params, DSNNotifyNever) {
+		return false
+	}
+	switch action {
+	case DSNActionFailed:
+		return len(params) == 0 || slices.Contains(params, DSNNotifyFailure)
+	case DSNActionDelayed:
+		return len(params) == 0 || slices.Contains(params, DSNNotifyDelay)
+	default:
+		return slices.Contains(params, DSNNotifySuccess)
+	}
+}
+
+// report returns the multipart/report message
+func (e *Envelope) report(r Report) ([]byte, error) {
+	if r.Date.IsZero() {
+		r.Date = time.Now()
+	}
+	if r.From == "" {
+		r.From = "MAILER-DAEMON@" + r.ReportingMTA
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	var b bytes.Buffer
+	header := func(key, value string) {
+		b.WriteString(key + ": " + value + "\r\n")
+	}
+	header("From", (&mail.Address{Name: "Mail Delivery System", Address: r.From}).String())
+	header("To", "<"+e.MailFrom.Address+">")
+	header("Subject", subject(r.Recipients))
+	header("Date", r.Date.Format(time.RFC1123Z))
+	header("Message-ID", "<"+utils.XID()+"@"+r.ReportingMTA+">")
+	header("Auto-Submitted", "auto-replied")
+	header("MIME-Version", "1.0")
+	header("Content-Type", MimeMultipartReport+"; report-type=delivery-status;\r\n\tboundary=\""+w.Boundary()+"\"")
+	b.WriteString("\r\n")
+
+	text := r.Text
+	if text == "" {
+		text = explanation(r)
+	}
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {MimeTextPlain + "; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, _ = part.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n")))
+
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {MimeMessageDeliveryStatus},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, _ = part.Write(e.deliveryStatus(r))
+
+	data := e.Data.Bytes()
+	contentType := MimeMessageEmail
+	if e.DSN != nil && e.DSN.Ret == DSNRetHdrs {
+		contentType = MimeTextRFC822Headers
+		data = headerOf(data)
+	}
+	part, err = w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {contentType},
+		"Content-Description": {"Undelivered message"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, _ = part.Write(data)
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	_, _ = b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
+
+// deliveryStatus returns the message/delivery-status fields, i.e. the per-message fields followed by
+// a group of fields per recipient (RFC 3464 2.2, 2.3)
+func (e *Envelope) deliveryStatus(r Report) []byte {
+	var b bytes.Buffer
+	field := func(key, value string) {
+		if value != "" {
+			b.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC1123Z)
+	}
+
+	if e.DSN != nil {
+		field("Original-Envelope-Id", e.DSN.EnvID)
+	}
+	field("Reporting-MTA", "dns; "+r.ReportingMTA)
+	if e.Helo != "" {
+		field("Received-From-MTA", "dns; "+e.Helo)
+	}
+	field("Arrival-Date", date(r.Arrival))
+
+	for _, rcpt := range r.Recipients {
+		b.WriteString("\r\n")
+		field("Original-Recipient", e.DSN.ORcptOf(rcpt.Recipient))
+		field("Final-Recipient", "rfc822; "+rcpt.Recipient)
+		field("Action", rcpt.Action)
+		field("Status", status(rcpt))
+		if rcpt.RemoteMTA != "" {
+			field("Remote-MTA", "dns; "+rcpt.RemoteMTA)
+		}
+		if rcpt.Diagnostic != "" {
+			field("Diagnostic-Code", "smtp; "+strings.Join(strings.Fields(rcpt.Diagnostic), " "))
+		}
+		field("Last-Attempt-Date", date(rcpt.LastAttempt))
+		if rcpt.Action == DSNActionDelayed {
+			field("Will-Retry-Until", date(rcpt.WillRetryUntil))
+		}
+	}
+	return b.Bytes()
+}
+
+var enhancedCode = regexp.MustCompile(`\b([245]\.\d{1,3}\.\d{1,3})\b`)
+
+// status returns the enhanced status code of the recipient
+func status(rcpt RecipientStatus) string {
+	if rcpt.Status != "" {
+		return rcpt.Status
+	}
+	if m := enhancedCode.FindStringSubmatch(rcpt.Diagnostic); m != nil {
+		return m[1]
+	}
+	switch rcpt.Action {
+	case DSNActionFailed:
+		return "5.0.0"
+	case DSNActionDelayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+func subject(rcpts []RecipientStatus) string {
+	actions := map[string]bool{}
+	for _, rcpt := range rcpts {
+		actions[rcpt.Action] = true
+	}
+	switch {
+	case actions[DSNActionFailed]:
+		return "Undelivered Mail Returned to Sender"
+	case actions[DSNActionDelayed]:
+		return "Delayed Mail (still being retried)"
+	}
+	return "Successful Mail Delivery Report"
+}
+
+// explanation returns the human-readable part of the report
+func explanation(r Report) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("This is the mail system at host %s.\n\n", r.ReportingMTA))
+
+	groups := []struct {
+		action string
+		text   string
+	}{
+		{DSNActionFailed, "Your message could not be delivered to the following recipients:"},
+		{DSNActionDelayed, "Your message could not be delivered yet to the following recipients. Delivery will be retried, " +
+			"you do not need to resend the message:"},
+		{DSNActionDelivered, "Your message was delivered to the following recipients:"},
+		{DSNActionRelayed, "Your message was relayed to the following recipients, which do not send further notifications:"},
+		{DSNActionExpanded, "Your message was delivered to the following recipients, and forwarded to their members:"},
+	}
+	for _, g := range groups {
+		var lines []string
+		for _, rcpt := range r.Recipients {
+			if rcpt.Action != g.action {
+				continue
+			}
+			line := "  <" + rcpt.Recipient + ">"
+			if rcpt.Diagnostic != "" {
+				line += ": " + strings.Join(strings.Fields(rcpt.Diagnostic), " ")
+			}
+			if rcpt.Action == DSNActionDelayed && !rcpt.WillRetryUntil.IsZero() {
+				line += " (retried until " + rcpt.WillRetryUntil.Format(time.RFC1123Z) + ")"
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		b.WriteString(g.text + "\n\n" + strings.Join(lines, "\n") + "\n\n")
+	}
+	return b.String()
+}
+
+// headerOf returns the header section of the message, including the blank line that ends it
+func headerOf(data []byte) []byte {
+	end := len(data)
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(data, []byte(sep)); i >= 0 {
+			end = min(end, i+len(sep))
+		}
+	}
+	return data[:end]
+}
@@ -0,0 +1,177 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bounceEnvelope(dsn *DSN) *Envelope {
+	e := NewEnvelope(nil, 0)
+	e.Helo = "client.example.com"
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+	e.RcptTo = []*mail.Address{{Address: "a@example.org"}, {Address: "b@example.org"}}
+	e.DSN = dsn
+	_, _ = e.Data.WriteString("Subject: Hello\nFrom: sender@example.com\n\nThe body\n")
+	return e
+}
+
+// parts returns the content types and bodies of the parts of the report
+func parts(t *testing.T, b *Envelope) (*mail.Message, []string, []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b.Data.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != MimeMultipartReport || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected content type %s %v", mediaType, params)
+	}
+
+	var types, bodies []string
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	return msg, types, bodies
+}
+
+func TestBounce(t *testing.T) {
+	arrival := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := Report{
+		ReportingMTA: "mx.example.net",
+		Arrival:      arrival,
+		Recipients: []RecipientStatus{
+			{Recipient: "a@example.org", Action: DSNActionFailed, Diagnostic: "550 5.1.1 User\r\n unknown", RemoteMTA: "mx.example.org"},
+			{Recipient: "b@example.org", Action: DSNActionDelayed, WillRetryUntil: arrival.Add(time.Hour)},
+		},
+	}
+
+	t.Run("Failure", func(t *testing.T) {
+		e := bounceEnvelope(&DSN{
+			EnvID: "QQ314159",
+			ORcpt: map[string]string{"a@example.org": "rfc822;alias@example.org"},
+		})
+		b, err := e.Bounce(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.MailFrom == nil || b.MailFrom.Address != "" {
+			t.Errorf("expected null sender, got %v", b.MailFrom)
+		}
+		if len(b.RcptTo) != 1 || b.RcptTo[0].Address != "sender@example.com" {
+			t.Errorf("expected bounce to sender, got %v", b.RcptTo)
+		}
+
+		msg, types, bodies := parts(t, b)
+		if got := msg.Header.Get("Subject"); got != "Undelivered Mail Returned to Sender" {
+			t.Errorf("unexpected subject %q", got)
+		}
+		if got := msg.Header.Get("Auto-Submitted"); got != "auto-replied" {
+			t.Errorf("unexpected Auto-Submitted %q", got)
+		}
+		if len(types) != 3 {
+			t.Fatalf("expected 3 parts, got %v", types)
+		}
+		if types[1] != MimeMessageDeliveryStatus || types[2] != MimeMessageEmail {
+			t.Errorf("unexpected part types %v", types)
+		}
+		if !strings.Contains(bodies[0], "<a@example.org>: 550 5.1.1 User unknown") {
+			t.Errorf("unexpected explanation %q", bodies[0])
+		}
+
+		for _, field := range []string{
+			"Original-Envelope-Id: QQ314159\r\n",
+			"Reporting-MTA: dns; mx.example.net\r\n",
+			"Received-From-MTA: dns; client.example.com\r\n",
+			"Arrival-Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+			"\r\nOriginal-Recipient: rfc822;alias@example.org\r\nFinal-Recipient: rfc822; a@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n",
+			"Remote-MTA: dns; mx.example.org\r\nDiagnostic-Code: smtp; 550 5.1.1 User unknown\r\n",
+			"\r\nFinal-Recipient: rfc822; b@example.org\r\nAction: delayed\r\nStatus: 4.0.0\r\nWill-Retry-Until: Tue, 02 Jan 2024 04:04:05 +0000\r\n",
+		} {
+			if !strings.Contains(bodies[1], field) {
+				t.Errorf("expected %q in delivery status\n%s", field, bodies[1])
+			}
+		}
+		if bodies[2] != e.Data.String() {
+			t.Errorf("expected the full message, got %q", bodies[2])
+		}
+	})
+
+	t.Run("Headers", func(t *testing.T) {
+		b, err := bounceEnvelope(&DSN{Ret: DSNRetHdrs}).Bounce(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, types, bodies := parts(t, b)
+		if types[2] != MimeTextRFC822Headers {
+			t.Errorf("unexpected part type %s", types[2])
+		}
+		if bodies[2] != "Subject: Hello\nFrom: sender@example.com\n\n" {
+			t.Errorf("expected only headers, got %q", bodies[2])
+		}
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		r := report
+		r.Recipients = r.Recipients[1:]
+		b, err := bounceEnvelope(nil).Bounce(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _, bodies := parts(t, b)
+		if got := msg.Header.Get("Subject"); got != "Delayed Mail (still being retried)" {
+			t.Errorf("unexpected subject %q", got)
+		}
+		if !strings.Contains(bodies[0], "will be retried") {
+			t.Errorf("unexpected explanation %q", bodies[0])
+		}
+	})
+
+	t.Run("Notify", func(t *testing.T) {
+		e := bounceEnvelope(&DSN{Notify: map[string][]string{
+			"a@example.org": {DSNNotifyNever},
+			"b@example.org": {DSNNotifyFailure},
+		}})
+		_, err := e.Bounce(report)
+		if !errors.Is(err, ErrNoNotification) {
+			t.Errorf("expected ErrNoNotification, got %v", err)
+		}
+
+		e.DSN.Notify["b@example.org"] = []string{DSNNotifyDelay}
+		b, err := e.Bounce(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, bodies := parts(t, b)
+		if strings.Contains(bodies[1], "a@example.org") {
+			t.Errorf("expected no report of a@example.org\n%s", bodies[1])
+		}
+	})
+
+	t.Run("NullSender", func(t *testing.T) {
+		e := bounceEnvelope(nil)
+		e.MailFrom = &mail.Address{}
+		_, err := e.Bounce(report)
+		if !errors.Is(err, ErrNullSender) {
+			t.Errorf("expected ErrNullSender, got %v", err)
+		}
+	})
+}
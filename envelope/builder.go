@@ -0,0 +1,533 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx/utils"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Builder composes a MIME message, e.g. an auto-reply or a notification, with a text and an HTML alternative,
+// images related to the HTML and attachments. Headers are encoded (RFC 2047), as are the filenames (RFC 2231),
+// and long header lines are folded. The transfer encoding of each part is chosen by its content, i.e. 7bit for
+// short lines of ASCII, quoted-printable for other text and base64 for everything else.
+//
+// Example usage:
+//
+//	e, err := envelope.NewBuilder().
+//		From(&mail.Address{Name: "Support", Address: "support@example.com"}).
+//		To(&mail.Address{Address: "customer@example.com"}).
+//		Subject("Your ticket").
+//		Text("We got your message.").
+//		HTML(`<p>We got your message.</p><img src="cid:logo">`).
+//		Inline("logo", "logo.png", logo).
+//		Attach("ticket.pdf", pdf).
+//		Envelope()
+type Builder struct {
+	headers []field
+	// err is the first invalid header, returned when the message is written
+	err error
+
+	from  *mail.Address
+	rcpts []*mail.Address
+
+	text string
+	html string
+
+	inline      []file
+	attachments []file
+}
+
+type field struct {
+	key   string
+	value string
+}
+
+type file struct {
+	filename  string
+	contentID string
+	data      []byte
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Header sets the header key to value, replacing it if it is set. The value is encoded if it is not ASCII, and
+// should therefore not be an address header, see From, To, Cc and ReplyTo. Line breaks in the value, as in
+// every header written by the Builder, are replaced by spaces so that a value can not add header fields.
+// A key that is not a field name, e.g. one with a line break, makes the message fail with ErrInvalidHeader
+func (b *Builder) Header(key, value string) *Builder {
+	if err := validField(key, ""); err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return b
+	}
+	return b.set(key, encodeWords(key, value))
+}
+
+func (b *Builder) set(key, value string) *Builder {
+	for i := range b.headers {
+		if strings.EqualFold(b.headers[i].key, key) {
+			b.headers[i].value = value
+			return b
+		}
+	}
+	b.headers = append(b.headers, field{key: key, value: value})
+	return b
+}
+
+// From sets the author, which is also the sender of the envelope
+func (b *Builder) From(addr *mail.Address) *Builder {
+	b.from = addr
+	return b.set("From", address("From", addr))
+}
+
+// To adds recipients to the To header, and to the envelope
+func (b *Builder) To(addrs ...*mail.Address) *Builder {
+	return b.addresses("To", addrs)
+}
+
+// Cc adds recipients to the Cc header, and to the envelope
+func (b *Builder) Cc(addrs ...*mail.Address) *Builder {
+	return b.addresses("Cc", addrs)
+}
+
+// Bcc adds recipients to the envelope only
+func (b *Builder) Bcc(addrs ...*mail.Address) *Builder {
+	b.rcpts = append(b.rcpts, addrs...)
+	return b
+}
+
+func (b *Builder) ReplyTo(addrs ...*mail.Address) *Builder {
+	return b.set("Reply-To", addressList("Reply-To", addrs))
+}
+
+func (b *Builder) addresses(key string, addrs []*mail.Address) *Builder {
+	b.rcpts = append(b.rcpts, addrs...)
+	for _, f := range b.headers {
+		if strings.EqualFold(f.key, key) {
+			return b.set(key, f.value+", "+addressList(key, addrs))
+		}
+	}
+	return b.set(key, addressList(key, addrs))
+}
+
+func addressList(key string, addrs []*mail.Address) string {
+	var list []string
+	for _, addr := range addrs {
+		list = append(list, address(key, addr))
+	}
+	return strings.Join(list, ", ")
+}
+
+// address formats addr for the header key, with the name encoded if it is not ASCII
+func address(key string, addr *mail.Address) string {
+	addr = &mail.Address{Name: lineBreaks.Replace(addr.Name), Address: addr.Address}
+	if addr.Name == "" || isASCII(addr.Name) {
+		return addr.String()
+	}
+	return encodeWords(key, addr.Name) + " <" + addr.Address + ">"
+}
+
+// encodeWords encodes value as Q encoded-words if it is not ASCII (RFC 2047). The words are short enough to be
+// folded into lines of 78 characters, also the first one which follows the name of the header key
+func encodeWords(key string, value string) string {
+	if isASCII(value) {
+		return value
+	}
+	const prefix, suffix = "=?utf-8?q?", "?="
+	var words []string
+	var word strings.Builder
+	limit := min(75, 78-len(key)-2)
+	for _, r := range value {
+		enc := qEncode(r)
+		if word.Len() > 0 && len(prefix)+word.Len()+len(enc)+len(suffix) > limit {
+			words = append(words, prefix+word.String()+suffix)
+			word.Reset()
+			limit = 75
+		}
+		word.WriteString(enc)
+	}
+	words = append(words, prefix+word.String()+suffix)
+	return strings.Join(words, " ")
+}
+
+// qEncode returns r as it is encoded in a Q encoded-word, which may be in a phrase (RFC 2047 4.2, 5)
+func qEncode(r rune) string {
+	switch {
+	case r == ' ':
+		return "_"
+	case r < utf8.RuneSelf && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!*+-/", r)):
+		return string(r)
+	}
+	var b strings.Builder
+	for _, c := range []byte(string(r)) {
+		fmt.Fprintf(&b, "=%02X", c)
+	}
+	return b.String()
+}
+
+func (b *Builder) Subject(subject string) *Builder {
+	return b.Header("Subject", subject)
+}
+
+// Date sets the Date header, which defaults to when the message is written
+func (b *Builder) Date(t time.Time) *Builder {
+	return b.set("Date", t.Format(time.RFC1123Z))
+}
+
+// MessageID sets the Message-ID header, which defaults to a unique id at the domain of From
+func (b *Builder) MessageID(id string) *Builder {
+	return b.set("Message-ID", "<"+strings.Trim(id, "<>")+">")
+}
+
+// Text sets the plain text body
+func (b *Builder) Text(text string) *Builder {
+	b.text = text
+	return b
+}
+
+// HTML sets the HTML body, which is an alternative to the text body if both are set
+func (b *Builder) HTML(html string) *Builder {
+	b.html = html
+	return b
+}
+
+// Inline adds a file related to the HTML body, e.g. an image, which the HTML refers to as cid:<contentID>.
+// The content type is given by the extension of filename
+func (b *Builder) Inline(contentID, filename string, data []byte) *Builder {
+	b.inline = append(b.inline, file{filename: filename, contentID: strings.Trim(contentID, "<>"), data: data})
+	return b
+}
+
+// Attach adds an attachment, the content type is given by the extension of filename
+func (b *Builder) Attach(filename string, data []byte) *Builder {
+	b.attachments = append(b.attachments, file{filename: filename, data: data})
+	return b
+}
+
+// WriteTo writes the message, with CRLF line endings, ending with a line break. ErrInvalidHeader is returned if
+// a header given to Header is invalid
+func (b *Builder) WriteTo(w io.Writer) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	headers := slices.Clone(b.headers)
+	has := func(key string) bool {
+		return slices.ContainsFunc(headers, func(f field) bool { return strings.EqualFold(f.key, key) })
+	}
+	if !has("Date") {
+		headers = append(headers, field{"Date", time.Now().Format(time.RFC1123Z)})
+	}
+	if !has("Message-ID") {
+		domain := utils.DomainOfEmail(b.from)
+		if domain == "" {
+			domain = "localhost"
+		}
+		headers = append(headers, field{"Message-ID", "<" + utils.XID() + "@" + domain + ">"})
+	}
+	headers = append(headers, field{"MIME-Version", "1.0"})
+
+	var buf bytes.Buffer
+	for _, f := range headers {
+		writeField(&buf, f.key, f.value)
+	}
+	b.body().write(&buf)
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+	return buf.WriteTo(w)
+}
+
+// Data returns the message as Data
+func (b *Builder) Data() (*Data, error) {
+	data := &Data{}
+	_, err := b.WriteTo(data)
+	return data, err
+}
+
+// Envelope returns the message in an envelope from the From address to all recipients, ready to be sent
+func (b *Builder) Envelope() (*Envelope, error) {
+	if b.from == nil {
+		return nil, errors.New("envelope: the message has no From address")
+	}
+	if len(b.rcpts) == 0 {
+		return nil, errors.New("envelope: the message has no recipients")
+	}
+	e := NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: b.from.Address}
+	e.UTF8 = !isASCII(b.from.Address)
+	for _, rcpt := range b.rcpts {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Address: rcpt.Address})
+		e.UTF8 = e.UTF8 || !isASCII(rcpt.Address)
+	}
+	_, err := b.WriteTo(e.Data)
+	return e, err
+}
+
+// body returns the structure of the message, i.e.
+//
+//	multipart/mixed
+//	  multipart/alternative
+//	    text/plain
+//	    multipart/related
+//	      text/html
+//	      inline files
+//	  attachments
+//
+// where the multiparts are left out when they would have a single part
+func (b *Builder) body() *entity {
+	body := textEntity(MimeTextPlain, b.text)
+	if b.html != "" {
+		html := textEntity(MimeTextHtml, b.html)
+		if len(b.inline) > 0 {
+			parts := []*entity{html}
+			for _, f := range b.inline {
+				parts = append(parts, fileEntity("inline", f))
+			}
+			html = multipartEntity(MimeMultipartRelated, map[string]string{"type": MimeTextHtml}, parts...)
+		}
+		if b.text == "" {
+			body = html
+		} else {
+			body = multipartEntity(MimeMultipartAlternative, nil, body, html)
+		}
+	}
+	if len(b.attachments) > 0 {
+		parts := []*entity{body}
+		for _, f := range b.attachments {
+			parts = append(parts, fileEntity("attachment", f))
+		}
+		body = multipartEntity(MimeMultipartMixed, nil, parts...)
+	}
+	return body
+}
+
+// entity is a MIME part to be written, its header and either its encoded body or its parts
+type entity struct {
+	header   []field
+	body     []byte
+	boundary string
+	parts    []*entity
+}
+
+func textEntity(mediaType string, text string) *entity {
+	encoding, body := encode(true, []byte(text))
+	return &entity{
+		header: []field{
+			{"Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"})},
+			{"Content-Transfer-Encoding", encoding},
+		},
+		body: body,
+	}
+}
+
+func fileEntity(disposition string, f file) *entity {
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(f.filename)))
+	if mediaType == "" {
+		mediaType = MimeApplicationOctet
+	}
+	contentType := formatMediaType(mediaType, map[string]string{"name": f.filename})
+	if strings.HasPrefix(mediaType, "text/") {
+		contentType = formatMediaType(mediaType, map[string]string{"name": f.filename, "charset": "utf-8"})
+	}
+
+	encoding, body := encode(strings.HasPrefix(mediaType, "text/"), f.data)
+	e := &entity{
+		header: []field{
+			{"Content-Type", contentType},
+			{"Content-Transfer-Encoding", encoding},
+			{"Content-Disposition", formatMediaType(disposition, map[string]string{"filename": f.filename})},
+		},
+		body: body,
+	}
+	if f.contentID != "" {
+		e.header = append(e.header, field{"Content-ID", "<" + f.contentID + ">"})
+	}
+	return e
+}
+
+func multipartEntity(mediaType string, params map[string]string, parts ...*entity) *entity {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	p := map[string]string{"boundary": boundary}
+	for k, v := range params {
+		p[k] = v
+	}
+	return &entity{
+		header:   []field{{"Content-Type", mime.FormatMediaType(mediaType, p)}},
+		boundary: boundary,
+		parts:    parts,
+	}
+}
+
+func (e *entity) write(buf *bytes.Buffer) {
+	for _, f := range e.header {
+		writeField(buf, f.key, f.value)
+	}
+	buf.WriteString("\r\n")
+	if e.boundary == "" {
+		buf.Write(e.body)
+		return
+	}
+	for _, part := range e.parts {
+		buf.WriteString("--" + e.boundary + "\r\n")
+		part.write(buf)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + e.boundary + "--\r\n")
+}
+
+// maxParam is the longest parameter that is not split into continuations, so that it fits on a folded line
+const maxParam = 76
+
+// formatMediaType is like mime.FormatMediaType, but splits parameters that are too long for a line into
+// continuations (RFC 2231 3), e.g. filename*0*= and filename*1*=, since a header line is only folded at whitespace
+func formatMediaType(mediaType string, params map[string]string) string {
+	short := map[string]string{}
+	var long []string
+	for k, v := range params {
+		// the parameter as formatted alone, without the media type and "; " before it
+		if len(mime.FormatMediaType(mediaType, map[string]string{k: v}))-len(mediaType)-2 > maxParam {
+			long = append(long, k)
+			continue
+		}
+		short[k] = v
+	}
+	formatted := mime.FormatMediaType(mediaType, short)
+	slices.Sort(long)
+	for _, k := range long {
+		formatted += "; " + continuations(k, params[k])
+	}
+	return formatted
+}
+
+// continuations returns the parameter key=value split into continuations, quoted if value is printable ASCII
+// and percent encoded as utf-8 otherwise. The value is not split within a quoted pair or a %XX escape
+func continuations(key, value string) string {
+	size := maxParam - len(key) - len("*00*=\"\";")
+	printable := !strings.ContainsFunc(value, func(r rune) bool { return r < ' ' || r > '~' })
+
+	var pieces []string
+	piece := ""
+	if !printable {
+		piece = "utf-8''"
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		escaped := string(c)
+		switch {
+		case printable && (c == '"' || c == '\\'):
+			escaped = `\` + escaped
+		case !printable && !isAttrChar(c):
+			escaped = fmt.Sprintf("%%%02X", c)
+		}
+		if len(piece)+len(escaped) > size {
+			pieces = append(pieces, piece)
+			piece = ""
+		}
+		piece += escaped
+	}
+	pieces = append(pieces, piece)
+
+	for i := range pieces {
+		if printable {
+			pieces[i] = fmt.Sprintf(`%s*%d="%s"`, key, i, pieces[i])
+		} else {
+			pieces[i] = fmt.Sprintf("%s*%d*=%s", key, i, pieces[i])
+		}
+	}
+	return strings.Join(pieces, "; ")
+}
+
+// isAttrChar returns true for the characters that are not percent encoded in a parameter value (RFC 2231 7)
+func isAttrChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// lineBreaks replaces the line breaks in a header value, which would otherwise end the field
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// writeField writes a header field, folded at whitespace if it is longer than 78 characters (RFC 5322 2.2.3).
+// Line breaks in value are replaced by spaces
+func writeField(buf *bytes.Buffer, key, value string) {
+	line := key + ": " + lineBreaks.Replace(value)
+	// the line is not folded at the space after the colon
+	start := len(key) + 2
+	for len(line) > 78 {
+		i := strings.LastIndexByte(line[:79], ' ')
+		if i < start {
+			// a word longer than a line, which is folded at the next space
+			i = strings.IndexByte(line[79:], ' ')
+			if i < 0 {
+				break
+			}
+			i += 79
+		}
+		buf.WriteString(line[:i] + "\r\n")
+		// the line continues with the whitespace it was folded at
+		line, start = line[i:], 1
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+// encode returns the transfer encoding of data and data encoded with it, and the line endings of text
+// converted to CRLF. Data encoded as quoted-printable or base64 ends with a line break
+func encode(text bool, data []byte) (string, []byte) {
+	if text {
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		if isASCII(string(data)) && maxLineLength(data) <= 998 {
+			return "7bit", bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+		}
+		if utf8.Valid(data) {
+			var buf bytes.Buffer
+			w := quotedprintable.NewWriter(&buf)
+			_, _ = w.Write(data)
+			_ = w.Close()
+			if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+				// a soft line break, so that the message can end with a line break without adding one to the text
+				buf.WriteString("=\r\n")
+			}
+			return "quoted-printable", buf.Bytes()
+		}
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return "base64", buf.Bytes()
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf || (s[i] < ' ' && s[i] != '\t' && s[i] != '\n' && s[i] != '\r') {
+			return false
+		}
+	}
+	return true
+}
+
+func maxLineLength(data []byte) int {
+	var longest int
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		longest = max(longest, len(line))
+	}
+	return longest
+}
@@ -0,0 +1,212 @@
+package envelope
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuilder(t *testing.T) {
+	png := bytes.Repeat([]byte{0x89, 'P', 'N', 'G', 0, 1, 2, 3}, 20)
+
+	build := func() *Builder {
+		return NewBuilder().
+			From(&mail.Address{Name: "Åsa Support", Address: "support@example.com"}).
+			To(&mail.Address{Address: "customer@example.com"}).
+			Cc(&mail.Address{Name: "Team", Address: "team@example.com"}).
+			Bcc(&mail.Address{Address: "archive@example.com"}).
+			Subject("Ärende mottaget, vi återkommer så snart som möjligt med ett svar på din fråga").
+			Date(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)).
+			MessageID("123@example.com").
+			Text("Hej!\nVi har tagit emot ditt ärende.\n").
+			HTML(`<p>Hej!</p><img src="cid:logo">`).
+			Inline("logo", "logo.png", png).
+			Attach("rapport 2024 – sammanfattning.pdf", []byte("%PDF-1.4 data")).
+			Attach("notes.txt", []byte("line 1\nline 2\n"))
+	}
+
+	t.Run("Structure", func(t *testing.T) {
+		data, err := build().Data()
+		require.NoError(t, err)
+
+		parts, bodies, err := walk(t, NewWalker(data.Reader()), true)
+		require.NoError(t, err)
+		var types []string
+		var depths []int
+		for _, p := range parts {
+			types = append(types, p.MediaType)
+			depths = append(depths, p.Depth)
+		}
+		assert.Equal(t, []string{"multipart/mixed", "multipart/alternative", "text/plain", "multipart/related", "text/html", "image/png", "application/pdf", "text/plain"}, types)
+		assert.Equal(t, []int{0, 1, 2, 2, 3, 3, 1, 1}, depths)
+
+		assert.Equal(t, "quoted-printable", parts[2].Encoding())
+		assert.Equal(t, "Hej!\r\nVi har tagit emot ditt ärende.\r\n", bodies[2])
+		assert.Equal(t, "7bit", parts[4].Encoding())
+		assert.Equal(t, `<p>Hej!</p><img src="cid:logo">`, bodies[4])
+		assert.Equal(t, "base64", parts[5].Encoding())
+		assert.Equal(t, "<logo>", parts[5].Header.Get("Content-ID"))
+		assert.Equal(t, string(png), bodies[5])
+		assert.Equal(t, "%PDF-1.4 data", bodies[6])
+		assert.Equal(t, "line 1\r\nline 2\r\n", bodies[7])
+	})
+
+	t.Run("Headers", func(t *testing.T) {
+		data, err := build().Data()
+		require.NoError(t, err)
+
+		for _, line := range strings.Split(data.String(), "\r\n") {
+			assert.LessOrEqual(t, len(line), 78, line)
+			assert.True(t, isASCII(line), line)
+		}
+
+		m, err := NewMail(data.Bytes(), false)
+		require.NoError(t, err)
+		h, err := m.Headers()
+		require.NoError(t, err)
+		assert.Equal(t, "Ärende mottaget, vi återkommer så snart som möjligt med ett svar på din fråga", h.Get("Subject"))
+		assert.Equal(t, "Tue, 02 Jan 2024 03:04:05 +0000", h.Get("Date"))
+		assert.Equal(t, "<123@example.com>", h.Get("Message-Id"))
+		assert.Equal(t, "1.0", h.Get("Mime-Version"))
+		assert.Empty(t, h.Get("Bcc"))
+		assert.Len(t, h.Values("Message-Id"), 1)
+
+		from, err := h.From()
+		require.NoError(t, err)
+		assert.Equal(t, "Åsa Support", from.Name)
+		cc, err := mail.ParseAddressList(h.Get("Cc"))
+		require.NoError(t, err)
+		assert.Equal(t, "team@example.com", cc[0].Address)
+
+		body, err := m.Body()
+		require.NoError(t, err)
+		attachment, err := body.Children[1].AsAttachment()
+		require.NoError(t, err)
+		name, err := attachment.Filename()
+		require.NoError(t, err)
+		assert.Equal(t, "rapport 2024 – sammanfattning.pdf", name)
+	})
+
+	t.Run("Plain", func(t *testing.T) {
+		var b bytes.Buffer
+		_, err := NewBuilder().From(&mail.Address{Address: "a@example.com"}).Text("Hello").WriteTo(&b)
+		require.NoError(t, err)
+		assert.Contains(t, b.String(), "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 7bit\r\n\r\nHello")
+		assert.Regexp(t, `\r\nMessage-ID: <[0-9a-v]+@example.com>\r\n`, b.String())
+		assert.Equal(t, 1, strings.Count(b.String(), "Message-ID"))
+		assert.Contains(t, b.String(), "\r\nDate: ")
+	})
+
+	t.Run("LongLine", func(t *testing.T) {
+		// lines longer than SMTP allows are quoted-printable encoded
+		data, err := NewBuilder().Text(strings.Repeat("a", 2000)).Data()
+		require.NoError(t, err)
+		parts, bodies, err := walk(t, NewWalker(data.Reader()), true)
+		require.NoError(t, err)
+		assert.Equal(t, "quoted-printable", parts[0].Encoding())
+		assert.Equal(t, strings.Repeat("a", 2000), bodies[0])
+	})
+
+	t.Run("Envelope", func(t *testing.T) {
+		e, err := build().Envelope()
+		require.NoError(t, err)
+		assert.Equal(t, "support@example.com", e.MailFrom.Address)
+		var rcpts []string
+		for _, r := range e.RcptTo {
+			rcpts = append(rcpts, r.Address)
+		}
+		assert.Equal(t, []string{"customer@example.com", "team@example.com", "archive@example.com"}, rcpts)
+		assert.False(t, e.UTF8)
+		assert.NotContains(t, e.Data.String(), "archive@example.com")
+
+		_, err = NewBuilder().Text("Hello").Envelope()
+		assert.Error(t, err)
+	})
+
+	t.Run("Injection", func(t *testing.T) {
+		// line breaks in a header value can not add fields
+		data, err := NewBuilder().
+			From(&mail.Address{Name: "Eve\r\nBcc: victim@example.com", Address: "eve@example.com"}).
+			To(&mail.Address{Name: "Åsa\nBcc: victim@example.com", Address: "a@example.com"}).
+			Subject("Re: hi\r\nBcc: victim@example.com").
+			Header("X-Note", "a\rb\nc").
+			Text("Hello").
+			Data()
+		require.NoError(t, err)
+
+		m, err := NewMail(data.Bytes(), false)
+		require.NoError(t, err)
+		h, err := m.Headers()
+		require.NoError(t, err)
+		assert.Empty(t, h.Get("Bcc"))
+		assert.Equal(t, "Re: hi Bcc: victim@example.com", h.Get("Subject"))
+		assert.Equal(t, "a b c", h.Get("X-Note"))
+		from, err := h.From()
+		require.NoError(t, err)
+		assert.Equal(t, "eve@example.com", from.Address)
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		for _, key := range []string{"X-Note\r\nBcc", "X-Note\nBcc", "X Note", "X-Note:", ""} {
+			_, err := NewBuilder().Header(key, "a").Text("Hello").Data()
+			assert.ErrorIs(t, err, ErrInvalidHeader, key)
+		}
+	})
+
+	t.Run("LongFilename", func(t *testing.T) {
+		// a long filename is split into continuations, since a header line is only folded at whitespace
+		for _, name := range []string{
+			strings.Repeat("å", 300) + ".txt",
+			strings.Repeat("a", 300) + ".txt",
+			strings.Repeat(`a"\`, 100) + ".txt",
+		} {
+			data, err := NewBuilder().Text("Hello").Attach(name, []byte("Hi")).Data()
+			require.NoError(t, err)
+			for _, line := range strings.Split(data.String(), "\r\n") {
+				assert.LessOrEqual(t, len(line), 78, line)
+			}
+
+			m, err := NewMail(data.Bytes(), false)
+			require.NoError(t, err)
+			body, err := m.Body()
+			require.NoError(t, err)
+			require.Len(t, body.Children, 2)
+			_, params, err := mime.ParseMediaType(body.Children[1].Headers.Get("Content-Disposition"))
+			require.NoError(t, err)
+			assert.Equal(t, name, params["filename"])
+			_, params, err = mime.ParseMediaType(body.Children[1].Headers.Get("Content-Type"))
+			require.NoError(t, err)
+			assert.Equal(t, name, params["name"])
+			assert.Equal(t, "utf-8", params["charset"])
+		}
+	})
+
+	t.Run("LineBreak", func(t *testing.T) {
+		// the message ends with a line break, also if the body does not
+		data, err := NewBuilder().Text("Hello").Data()
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(data.String(), "\r\n\r\nHello\r\n"), data.String())
+
+		data, err = NewBuilder().Text("Hello").Attach("a.bin", []byte{0, 1}).Data()
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(data.String(), "--\r\n"), data.String())
+	})
+
+	t.Run("Fold", func(t *testing.T) {
+		var b bytes.Buffer
+		writeField(&b, "X-Long", strings.Repeat("word ", 30)+strings.Repeat("x", 100)+" end")
+		lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+		for _, line := range lines[1:] {
+			assert.True(t, strings.HasPrefix(line, " "), line)
+		}
+		assert.Equal(t, " "+strings.Repeat("x", 100), lines[len(lines)-2])
+		unfolded := strings.ReplaceAll(b.String(), "\r\n ", " ")
+		assert.Equal(t, "X-Long: "+strings.Repeat("word ", 30)+strings.Repeat("x", 100)+" end\r\n", unfolded)
+	})
+}
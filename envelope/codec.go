@@ -0,0 +1,148 @@
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"net"
+	"net/mail"
+	"net/netip"
+)
+
+// envelopeCodec is the serialized form of an Envelope, shared by JSON and CBOR. The keys are stable, new fields
+// are only added, and are omitted when empty so that older readers ignore them
+type envelopeCodec struct {
+	ID           string `json:"id"`
+	ConnectionID uint64 `json:"connection_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	Remote string `json:"remote,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+	Helo   string `json:"helo,omitempty"`
+	TLS    bool   `json:"tls,omitempty"`
+	UTF8   bool   `json:"utf8,omitempty"`
+	ESMTP  bool   `json:"esmtp,omitempty"`
+
+	MailFrom *addressCodec  `json:"mail_from,omitempty"`
+	RcptTo   []addressCodec `json:"rcpt_to"`
+	DSN      *DSN           `json:"dsn,omitempty"`
+
+	Data []byte `json:"data"`
+}
+
+type addressCodec struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+func (e *Envelope) codec() envelopeCodec {
+	c := envelopeCodec{
+		ID:           e.EnvelopeId(),
+		ConnectionID: e.ConnectionId(),
+		Helo:         e.Helo,
+		TLS:          e.TLS,
+		UTF8:         e.UTF8,
+		ESMTP:        e.ESMTP,
+		RcptTo:       []addressCodec{},
+		DSN:          e.DSN,
+	}
+	if err := e.GetError(); err != nil {
+		c.Error = err.Error()
+	}
+	if remote := e.ClientAddr(); remote.IsValid() {
+		c.Remote = remote.String()
+	}
+	if e.Peer.IsValid() {
+		c.Peer = e.Peer.String()
+	}
+	if e.MailFrom != nil {
+		c.MailFrom = &addressCodec{Name: e.MailFrom.Name, Address: e.MailFrom.Address}
+	}
+	for _, rcpt := range e.RcptTo {
+		c.RcptTo = append(c.RcptTo, addressCodec{Name: rcpt.Name, Address: rcpt.Address})
+	}
+	if e.Data != nil {
+		c.Data = e.Data.Bytes()
+	}
+	return c
+}
+
+func (e *Envelope) fromCodec(c envelopeCodec) error {
+	var remote, peer netip.AddrPort
+	var err error
+	if c.Remote != "" {
+		if remote, err = netip.ParseAddrPort(c.Remote); err != nil {
+			return err
+		}
+	}
+	if c.Peer != "" {
+		if peer, err = netip.ParseAddrPort(c.Peer); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), "connection-id", c.ConnectionID)
+	ctx = context.WithValue(ctx, "envelope-id", c.ID)
+	if c.Error != "" {
+		ctx = context.WithValue(ctx, "err", errors.New(c.Error))
+	}
+
+	*e = Envelope{
+		ctx:    ctx,
+		Remote: remote,
+		Peer:   peer,
+		Helo:   c.Helo,
+		TLS:    c.TLS,
+		UTF8:   c.UTF8,
+		ESMTP:  c.ESMTP,
+		DSN:    c.DSN,
+		Data:   &Data{},
+	}
+	if remote.IsValid() {
+		e.RemoteAddr = net.TCPAddrFromAddrPort(remote)
+	}
+	if c.Helo != "" {
+		e.HeloName, _ = ParseHelo(c.Helo)
+	}
+	if c.MailFrom != nil {
+		e.MailFrom = &mail.Address{Name: c.MailFrom.Name, Address: c.MailFrom.Address}
+	}
+	for _, rcpt := range c.RcptTo {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Name: rcpt.Name, Address: rcpt.Address})
+	}
+	_, _ = e.Data.Write(c.Data)
+	return nil
+}
+
+// MarshalJSON encodes the envelope with its session metadata, i.e. the ids of the envelope and the connection,
+// any error set, the addresses of the client and peer, HELO, TLS, UTF8 and ESMTP, along with the addresses,
+// the DSN parameters and the data. The data is base64 encoded, since it is not necessarily valid UTF-8
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.codec())
+}
+
+// UnmarshalJSON decodes an envelope encoded by MarshalJSON. HeloName is parsed from Helo, and RemoteAddr is
+// derived from Remote
+func (e *Envelope) UnmarshalJSON(b []byte) error {
+	var c envelopeCodec
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	return e.fromCodec(c)
+}
+
+// MarshalCBOR encodes the envelope like MarshalJSON, but in the compact binary form of RFC 8949 where the data
+// is stored as is
+func (e *Envelope) MarshalCBOR() ([]byte, error) {
+	return cbor.Marshal(e.codec())
+}
+
+// UnmarshalCBOR decodes an envelope encoded by MarshalCBOR
+func (e *Envelope) UnmarshalCBOR(b []byte) error {
+	var c envelopeCodec
+	if err := cbor.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	return e.fromCodec(c)
+}
@@ -0,0 +1,161 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"net"
+	"net/mail"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testEnvelope() *Envelope {
+	e := NewEnvelope(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321}, 7)
+	e.SetRemote(netip.MustParseAddrPort("198.51.100.1:1234"))
+	e.Helo = "Client.Example.com"
+	e.HeloName, _ = ParseHelo(e.Helo)
+	e.TLS = true
+	e.ESMTP = true
+	e.MailFrom = &mail.Address{Name: "Sender", Address: "sender@example.com"}
+	e.RcptTo = []*mail.Address{{Address: "a@example.com"}, {Address: "b@example.com"}}
+	e.DSN = &DSN{Ret: DSNRetHdrs, EnvID: "abc", Notify: map[string][]string{"a@example.com": {DSNNotifyFailure}}}
+	e.SetError(errors.New("a error"))
+	_, _ = e.Data.WriteString("Subject: Hello\r\n\r\n\xff binary body\r\n")
+	_, _ = e.Data.PrependString("Received: from client\r\n")
+	return e
+}
+
+func assertEnvelope(t *testing.T, want, got *Envelope) {
+	t.Helper()
+	if got.EnvelopeId() != want.EnvelopeId() || got.ConnectionId() != want.ConnectionId() {
+		t.Errorf("ids: got %s %d, want %s %d", got.EnvelopeId(), got.ConnectionId(), want.EnvelopeId(), want.ConnectionId())
+	}
+	if got.GetError() == nil || got.GetError().Error() != want.GetError().Error() {
+		t.Errorf("error: got %v, want %v", got.GetError(), want.GetError())
+	}
+	if got.Remote != want.Remote || got.Peer != want.Peer || got.RemoteAddr.String() != "198.51.100.1:1234" {
+		t.Errorf("remote: got %v %v %v", got.Remote, got.Peer, got.RemoteAddr)
+	}
+	if got.Helo != want.Helo || got.HeloName != want.HeloName {
+		t.Errorf("helo: got %q %+v, want %q %+v", got.Helo, got.HeloName, want.Helo, want.HeloName)
+	}
+	if got.TLS != want.TLS || got.ESMTP != want.ESMTP || got.UTF8 != want.UTF8 {
+		t.Errorf("session: got %+v", got)
+	}
+	if !reflect.DeepEqual(got.MailFrom, want.MailFrom) || !reflect.DeepEqual(got.RcptTo, want.RcptTo) {
+		t.Errorf("addresses: got %v %v", got.MailFrom, got.RcptTo)
+	}
+	if !reflect.DeepEqual(got.DSN, want.DSN) {
+		t.Errorf("dsn: got %+v, want %+v", got.DSN, want.DSN)
+	}
+	if !bytes.Equal(got.Data.Bytes(), want.Data.Bytes()) {
+		t.Errorf("data: got %q, want %q", got.Data.String(), want.Data.String())
+	}
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	e := testEnvelope()
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"id":"`, `"connection_id":7`, `"error":"a error"`, `"remote":"198.51.100.1:1234"`,
+		`"peer":"192.0.2.1:4321"`, `"mail_from":{"name":"Sender","address":"sender@example.com"}`, `"dsn":{"ret":"HDRS"`} {
+		if !strings.Contains(string(b), key) {
+			t.Errorf("expected %s in %s", key, b)
+		}
+	}
+
+	var got Envelope
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	assertEnvelope(t, e, &got)
+
+	t.Run("NullSender", func(t *testing.T) {
+		e := NewEnvelope(nil, 0)
+		e.MailFrom = &mail.Address{}
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Envelope
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.MailFrom == nil || got.MailFrom.Address != "" || got.RemoteAddr != nil || got.Remote.IsValid() {
+			t.Errorf("got %+v", got)
+		}
+	})
+}
+
+func TestEnvelopeCBOR(t *testing.T) {
+	e := testEnvelope()
+	b, err := cbor.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, _ := json.Marshal(e)
+	if len(b) >= len(j) {
+		t.Errorf("expected CBOR to be smaller than JSON, %d >= %d", len(b), len(j))
+	}
+
+	var got Envelope
+	if err := cbor.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	assertEnvelope(t, e, &got)
+}
+
+func TestMailJSON(t *testing.T) {
+	m, err := NewMail([]byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n"+
+		"--b\r\nContent-Type: text/plain\r\n\r\nHello\r\n--b--\r\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := m.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []any{m, body} {
+		j, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := cbor.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fromJSON := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := json.Unmarshal(j, fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		fromCBOR := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := cbor.Unmarshal(c, fromCBOR); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, fromJSON) || !reflect.DeepEqual(v, fromCBOR) {
+			t.Errorf("round trip of %T: got %+v and %+v, want %+v", v, fromJSON, fromCBOR, v)
+		}
+	}
+
+	j, _ := json.Marshal(body)
+	// the keys are the field names, so that Mail and Content stored by earlier versions can be read
+	if !strings.Contains(string(j), `"Children":[{"Headers":{"Content-Type":["text/plain"]},"Body":"SGVsbG8=","Children":null}]`) {
+		t.Errorf("unexpected keys in %s", j)
+	}
+
+	var stored Mail
+	if err := json.Unmarshal([]byte(`{"UTF8":true,"RawHeaders":"U3ViamVjdDogSGk=","RawBody":"SGVsbG8="}`), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.UTF8 || string(stored.RawHeaders) != "Subject: Hi" || string(stored.RawBody) != "Hello" {
+		t.Errorf("unexpected stored mail %+v", stored)
+	}
+}
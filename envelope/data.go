@@ -5,8 +5,13 @@ import (
 	"io"
 )
 
+// Data is a message, which is written as it is received and can then be edited. Prepend adds to the start of
+// it, e.g. trace fields, and the header fields can be read, set, removed and rewritten, which keeps the bytes of
+// the fields that are not edited
 type Data struct {
 	bufs []*bytes.Buffer
+	// header is the header split into fields once it is read or edited, bufs is then the rest of the message
+	header *header
 }
 
 func (d *Data) head() *bytes.Buffer {
@@ -23,6 +28,9 @@ func (d *Data) tail() *bytes.Buffer {
 
 func (d *Data) Len() int {
 	length := 0
+	if d.header != nil {
+		length = d.header.len()
+	}
 	for _, b := range d.bufs {
 		length += b.Len()
 	}
@@ -32,6 +40,9 @@ func (d *Data) Len() int {
 func (d *Data) Bytes() []byte {
 	result := make([]byte, d.Len())
 	off := 0
+	if d.header != nil {
+		off = copy(result, d.header.bytes())
+	}
 	for _, b := range d.bufs {
 		copy(result[off:off+b.Len()], b.Bytes())
 		off += b.Len()
@@ -52,10 +63,19 @@ func (d *Data) Write(p []byte) (n int, err error) {
 }
 
 func (d *Data) Prepend(p []byte) (n int, err error) {
+	if d.header != nil {
+		return d.prependField(p)
+	}
 	return d.head().Write(p)
 }
 func (d *Data) PrependString(s string) (n int, err error) {
-	return d.head().WriteString(s)
+	return d.Prepend([]byte(s))
+}
+
+// prependField adds the fields in p to the top of the header once it is split into fields
+func (d *Data) prependField(p []byte) (int, error) {
+	d.header.fields = append(splitFields(p), d.header.fields...)
+	return len(p), nil
 }
 
 func (d *Data) ReadFrom(r io.Reader) (n int64, err error) {
@@ -65,6 +85,9 @@ func (d *Data) ReadFrom(r io.Reader) (n int64, err error) {
 
 func (d *Data) Reader() io.Reader {
 	var readers []io.Reader
+	if d.header != nil {
+		readers = append(readers, bytes.NewReader(d.header.bytes()))
+	}
 	for _, b := range d.bufs {
 		readers = append(readers, bytes.NewReader(b.Bytes()))
 	}
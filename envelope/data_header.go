@@ -0,0 +1,292 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// ErrInvalidHeader is returned when adding a field whose name is not a valid field name, or whose value has a
+// line break, which would let the value add fields of its own
+var ErrInvalidHeader = errors.New("envelope: invalid header field")
+
+// header is the header of Data split into its fields, which is done on the first call that reads or edits it.
+// The fields keep the bytes they were received with, e.g. so that DKIM signatures still verify, unless they
+// are edited. Data.bufs is then the rest of the message, i.e. the empty line and the body
+type header struct {
+	fields []*headerField
+	// nl is the line ending of the message, which new fields are written with
+	nl string
+	// separate is true if the message has no header, so that an empty line is needed between fields that are
+	// added and the body
+	separate bool
+}
+
+type headerField struct {
+	key string
+	// raw is the field as it was written, including folded lines and the line ending
+	raw []byte
+}
+
+// value returns the unfolded value of the field
+func (f *headerField) value() string {
+	_, value, _ := bytes.Cut(f.raw, []byte(":"))
+	value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+	value = bytes.ReplaceAll(value, []byte("\n"), nil)
+	return strings.TrimSpace(string(value))
+}
+
+func (h *header) newField(key, value string) (*headerField, error) {
+	if err := validField(key, value); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	writeField(&buf, key, value)
+	raw := buf.Bytes()
+	if h.nl == "\n" {
+		raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	}
+	return &headerField{key: key, raw: raw}, nil
+}
+
+// validField returns ErrInvalidHeader if key is not a field name, i.e. printable ASCII without a colon
+// (RFC 5322 3.6.8), or if value has a line break
+func validField(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("%w, empty name", ErrInvalidHeader)
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] >= 0x7f || key[i] == ':' {
+			return fmt.Errorf("%w, name %q", ErrInvalidHeader, key)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%w, line break in the value of %s", ErrInvalidHeader, key)
+	}
+	return nil
+}
+
+func (h *header) len() int {
+	return len(h.bytes())
+}
+
+func (h *header) bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range h.fields {
+		buf.Write(f.raw)
+	}
+	if h.separate && len(h.fields) > 0 {
+		buf.WriteString(h.nl)
+	}
+	return buf.Bytes()
+}
+
+// keyOf returns the name of the field in line, or false if it is not a field
+func keyOf(line []byte) (string, bool) {
+	key, _, found := bytes.Cut(line, []byte(":"))
+	key = bytes.TrimRight(key, " \t")
+	if !found || len(key) == 0 || bytes.ContainsAny(key, " \t\r\n") {
+		return "", false
+	}
+	return string(key), true
+}
+
+// parseHeader splits the header of the message from the rest of it, without copying the rest
+func (d *Data) parseHeader() *header {
+	if d.header != nil {
+		return d.header
+	}
+	h := &header{nl: "\r\n"}
+
+	r := bufio.NewReader(d.Reader())
+	var n int
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(h.fields) == 0 && len(line) > 0 && line[0] != '\r' && line[0] != '\n' {
+			_, isField := keyOf(line)
+			h.separate = err != nil || !isField
+		}
+		if err != nil {
+			// a line that is not terminated is not a field, nor is the empty line that ends the header
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(h.fields) == 0 {
+				break
+			}
+			f := h.fields[len(h.fields)-1]
+			f.raw = append(f.raw, line...)
+			n += len(line)
+			continue
+		}
+		key, ok := keyOf(line)
+		if !ok {
+			break
+		}
+		h.fields = append(h.fields, &headerField{key: key, raw: line})
+		n += len(line)
+	}
+	if len(h.fields) > 0 && !bytes.HasSuffix(h.fields[0].raw, []byte("\r\n")) {
+		h.nl = "\n"
+	}
+
+	// the header is removed from the buffers
+	for n > 0 && len(d.bufs) > 0 {
+		b := d.bufs[0]
+		if b.Len() > n {
+			b.Next(n)
+			break
+		}
+		n -= b.Len()
+		d.bufs = d.bufs[1:]
+	}
+	d.header = h
+	return h
+}
+
+// Header returns the value of the first field key in the header, unfolded, or "" if there is none. The value is
+// as it is in the message, i.e. encoded-words are not decoded
+func (d *Data) Header(key string) string {
+	values := d.HeaderValues(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// HeaderValues returns the values of all fields key in the header, in order
+func (d *Data) HeaderValues(key string) []string {
+	var values []string
+	for _, f := range d.parseHeader().fields {
+		if strings.EqualFold(f.key, key) {
+			values = append(values, f.value())
+		}
+	}
+	return values
+}
+
+// SetHeader replaces the first field key in the header with value and removes the others, or adds the field
+// at the end of the header if there is none. ErrInvalidHeader is returned, and the header left as it is, if key
+// is not a field name or value has a line break, which applies to all methods adding fields
+func (d *Data) SetHeader(key, value string) error {
+	h := d.parseHeader()
+	field, err := h.newField(key, value)
+	if err != nil {
+		return err
+	}
+	for i, f := range h.fields {
+		if strings.EqualFold(f.key, key) {
+			h.fields[i] = field
+			h.fields = removeFields(h.fields, func(f *headerField) bool {
+				return f != field && strings.EqualFold(f.key, key)
+			})
+			return nil
+		}
+	}
+	h.fields = append(h.fields, field)
+	return nil
+}
+
+// AddHeader adds a field at the end of the header
+func (d *Data) AddHeader(key, value string) error {
+	h := d.parseHeader()
+	field, err := h.newField(key, value)
+	if err != nil {
+		return err
+	}
+	h.fields = append(h.fields, field)
+	return nil
+}
+
+// InsertHeaderAfter inserts a field after the first field after in the header, e.g. after the Received field
+// added by this server. The field is added at the top of the header if there is no field after
+func (d *Data) InsertHeaderAfter(after, key, value string) error {
+	h := d.parseHeader()
+	field, err := h.newField(key, value)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for j, f := range h.fields {
+		if strings.EqualFold(f.key, after) {
+			i = j + 1
+			break
+		}
+	}
+	h.fields = append(h.fields[:i], append([]*headerField{field}, h.fields[i:]...)...)
+	return nil
+}
+
+// RemoveHeader removes all fields key from the header, e.g. Bcc, and returns how many were removed
+func (d *Data) RemoveHeader(key string) int {
+	return d.RemoveHeaderFunc(key, func(string) bool { return true })
+}
+
+// RemoveHeaderFunc removes the fields key for which remove returns true given their value, e.g. the
+// Authentication-Results claiming to be from this server, and returns how many were removed
+func (d *Data) RemoveHeaderFunc(key string, remove func(value string) bool) int {
+	h := d.parseHeader()
+	n := len(h.fields)
+	h.fields = removeFields(h.fields, func(f *headerField) bool {
+		return strings.EqualFold(f.key, key) && remove(f.value())
+	})
+	return n - len(h.fields)
+}
+
+// RewriteHeader replaces the value of each field key with the value returned by rewrite, e.g. to prefix the
+// Subject, and returns how many fields were changed. The fields that are not changed keep their bytes. A value
+// with a line break is not written, the fields after it are still rewritten and ErrInvalidHeader is returned
+func (d *Data) RewriteHeader(key string, rewrite func(value string) string) (int, error) {
+	h := d.parseHeader()
+	var n int
+	var errs []error
+	for i, f := range h.fields {
+		if !strings.EqualFold(f.key, key) {
+			continue
+		}
+		value := f.value()
+		if v := rewrite(value); v != value {
+			field, err := h.newField(f.key, v)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			h.fields[i] = field
+			n++
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+func removeFields(fields []*headerField, remove func(f *headerField) bool) []*headerField {
+	kept := fields[:0]
+	for _, f := range fields {
+		if !remove(f) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// splitFields splits p into header fields, each with its folded lines. Lines that are not fields are kept with
+// the field before them
+func splitFields(p []byte) []*headerField {
+	var fields []*headerField
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		key, ok := keyOf(line)
+		if !ok && len(fields) > 0 {
+			f := fields[len(fields)-1]
+			f.raw = append(f.raw, line...)
+			continue
+		}
+		fields = append(fields, &headerField{key: key, raw: bytes.Clone(line)})
+	}
+	return fields
+}
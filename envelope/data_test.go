@@ -2,6 +2,8 @@ package envelope
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"strings"
 	"testing"
 )
@@ -98,3 +100,143 @@ func TestDataStructure(t *testing.T) {
 		}
 	})
 }
+
+func TestDataHeader(t *testing.T) {
+	const message = "Received: from a.example.com\r\n" +
+		"\tby mx.example.com; Tue, 2 Jan 2024 03:04:05 +0000\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com;\r\n" +
+		"  h=From:Subject; b=abc\r\n" +
+		"Subject: Hello\r\n" +
+		"Bcc: secret@example.com\r\n" +
+		"\r\n" +
+		"Subject: not a header\r\n"
+
+	newData := func() *Data {
+		d := &Data{}
+		// the message is split over buffers, as when a trace field has been prepended
+		d.WriteString(message[30:])
+		d.PrependString(message[:30])
+		return d
+	}
+
+	t.Run("Read", func(t *testing.T) {
+		d := newData()
+		if got := d.Header("received"); got != "from a.example.com\tby mx.example.com; Tue, 2 Jan 2024 03:04:05 +0000" {
+			t.Errorf("Expected the unfolded Received, got '%s'", got)
+		}
+		if got := d.Header("Subject"); got != "Hello" {
+			t.Errorf("Expected 'Hello', got '%s'", got)
+		}
+		if got := d.Header("X-Missing"); got != "" {
+			t.Errorf("Expected no value, got '%s'", got)
+		}
+		// reading the header does not change the message
+		if d.String() != message || d.Len() != len(message) {
+			t.Errorf("Expected the message to be unchanged, got '%s'", d.String())
+		}
+	})
+
+	t.Run("Edit", func(t *testing.T) {
+		d := newData()
+		if n := d.RemoveHeader("bcc"); n != 1 {
+			t.Errorf("Expected 1 Bcc removed, got %d", n)
+		}
+		if n, err := d.RewriteHeader("Subject", func(v string) string { return "[EXTERNAL] " + v }); n != 1 || err != nil {
+			t.Errorf("Expected 1 Subject rewritten, got %d, %v", n, err)
+		}
+		n := d.RemoveHeaderFunc("Authentication-Results", func(v string) bool {
+			return strings.HasPrefix(v, "mx.example.com;")
+		})
+		if n != 1 {
+			t.Errorf("Expected 1 Authentication-Results removed, got %d", n)
+		}
+		d.InsertHeaderAfter("Received", "Authentication-Results", "mx.example.com; dkim=pass")
+		d.PrependString("Return-Path: <sender@example.com>\r\n")
+		d.WriteString("more body\r\n")
+
+		expected := "Return-Path: <sender@example.com>\r\n" +
+			"Received: from a.example.com\r\n" +
+			"\tby mx.example.com; Tue, 2 Jan 2024 03:04:05 +0000\r\n" +
+			"Authentication-Results: mx.example.com; dkim=pass\r\n" +
+			"DKIM-Signature: v=1; a=rsa-sha256; d=example.com;\r\n" +
+			"  h=From:Subject; b=abc\r\n" +
+			"Subject: [EXTERNAL] Hello\r\n" +
+			"\r\n" +
+			"Subject: not a header\r\n" +
+			"more body\r\n"
+		if d.String() != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, d.String())
+		}
+		if d.Len() != len(expected) {
+			t.Errorf("Expected length %d, got %d", len(expected), d.Len())
+		}
+		read, _ := io.ReadAll(d.Reader())
+		if string(read) != expected {
+			t.Errorf("Expected Reader to read '%s', got '%s'", expected, read)
+		}
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		d := &Data{}
+		d.WriteString("To: a@example.com\nX-Spam: yes\nX-Spam: maybe\n\nbody\n")
+		d.SetHeader("X-Spam", "no")
+		d.SetHeader("Subject", "New")
+		d.AddHeader("X-Trace", "1")
+		// new fields have the line endings of the message
+		expected := "To: a@example.com\nX-Spam: no\nSubject: New\nX-Trace: 1\n\nbody\n"
+		if d.String() != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, d.String())
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		// a line break in a value can not add fields, nor can a key that is not a field name
+		d := newData()
+		invalid := []error{
+			d.SetHeader("Subject", "Hi\r\nBcc: victim@example.com"),
+			d.AddHeader("X-Note", "a\nb"),
+			d.InsertHeaderAfter("Received", "X-Note", "a\rb"),
+			d.AddHeader("Bcc: victim@example.com\r\nX-Note", "a"),
+			d.AddHeader("X Note", "a"),
+			d.AddHeader("", "a"),
+		}
+		for i, err := range invalid {
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Errorf("Expected ErrInvalidHeader for %d, got %v", i, err)
+			}
+		}
+		n, err := d.RewriteHeader("Subject", func(v string) string { return v + "\r\nBcc: victim@example.com" })
+		if n != 0 || !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("Expected no Subject rewritten and ErrInvalidHeader, got %d, %v", n, err)
+		}
+		if d.String() != message {
+			t.Errorf("Expected the message to be unchanged, got '%s'", d.String())
+		}
+	})
+
+	t.Run("PrependFields", func(t *testing.T) {
+		// a prepend of several fields is split into them
+		d := newData()
+		d.Header("Subject")
+		d.PrependString("X-A: 1\r\nX-B: 2\r\n\tfolded\r\n")
+		if n := d.RemoveHeader("X-B"); n != 1 {
+			t.Errorf("Expected 1 X-B removed, got %d", n)
+		}
+		if d.Header("X-A") != "1" {
+			t.Errorf("Expected X-A to be kept, got '%s'", d.Header("X-A"))
+		}
+		if d.String() != "X-A: 1\r\n"+message {
+			t.Errorf("Expected only X-A prepended, got '%s'", d.String())
+		}
+	})
+
+	t.Run("NoHeader", func(t *testing.T) {
+		d := &Data{}
+		d.WriteString("just a body\r\n")
+		d.SetHeader("Subject", "Hi")
+		if d.String() != "Subject: Hi\r\n\r\njust a body\r\n" {
+			t.Errorf("Expected the field before the body, got '%s'", d.String())
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package envelope
+
+// DSN values of the RET parameter
+const (
+	DSNRetFull = "FULL"
+	DSNRetHdrs = "HDRS"
+)
+
+// DSN values of the NOTIFY parameter
+const (
+	DSNNotifyNever   = "NEVER"
+	DSNNotifySuccess = "SUCCESS"
+	DSNNotifyFailure = "FAILURE"
+	DSNNotifyDelay   = "DELAY"
+)
+
+// DSN holds the Delivery Status Notification parameters of a transaction (RFC 3461)
+type DSN struct {
+	// Ret is DSNRetFull or DSNRetHdrs, i.e. if the full message or only the headers are returned in a DSN
+	Ret string `json:"ret,omitempty"`
+	// EnvID is the envelope identifier given by the sender
+	EnvID string `json:"env_id,omitempty"`
+
+	// Notify is the NOTIFY parameter per recipient address, e.g. []string{DSNNotifyFailure, DSNNotifyDelay}
+	Notify map[string][]string `json:"notify,omitempty"`
+	// ORcpt is the ORCPT parameter per recipient address, e.g. "rfc822;user@example.com"
+	ORcpt map[string]string `json:"orcpt,omitempty"`
+}
+
+// NotifyOf returns the NOTIFY parameter of the recipient
+func (d *DSN) NotifyOf(rcpt string) []string {
+	if d == nil {
+		return nil
+	}
+	return d.Notify[rcpt]
+}
+
+// ORcptOf returns the ORCPT parameter of the recipient
+func (d *DSN) ORcptOf(rcpt string) string {
+	if d == nil {
+		return ""
+	}
+	return d.ORcpt[rcpt]
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/modfin/smtpx/utils"
 	"net"
 	"net/mail"
+	"net/netip"
 	"net/textproto"
 )
 
@@ -16,9 +17,19 @@ type Envelope struct {
 	// Remote IP address
 	RemoteAddr net.Addr
 
+	// Remote is the address and port of the client. When the connection is proxied and the PROXY or XCLIENT
+	// command is used, it is the address of the original client
+	Remote netip.AddrPort
+
+	// Peer is the address and port of the transport peer, i.e. the proxy when PROXY or XCLIENT is used
+	Peer netip.AddrPort
+
 	// Message sent in EHLO command
 	Helo string
 
+	// HeloName is the parsed HELO/EHLO argument
+	HeloName HeloName
+
 	// TLS is true if the email was received using a TLS connection
 	TLS bool
 
@@ -34,6 +45,9 @@ type Envelope struct {
 	// Recipients
 	RcptTo []*mail.Address
 
+	// DSN holds the delivery status notification parameters, nil if none were given
+	DSN *DSN
+
 	// Data stores the header and message body
 	Data *Data
 }
@@ -73,13 +87,31 @@ func NewEnvelope(remoteAddr net.Addr, connectionId uint64) *Envelope {
 	ctx := context.WithValue(context.Background(), "connection-id", connectionId)
 	ctx = context.WithValue(ctx, "envelope-id", utils.XID())
 
+	remote := utils.AddrPortOf(remoteAddr)
 	return &Envelope{
 		ctx:        ctx,
 		RemoteAddr: remoteAddr,
+		Remote:     remote,
+		Peer:       remote,
 		Data:       &Data{},
 	}
 }
 
+// ClientAddr returns the address and port of the client, i.e. Remote. If Remote is not set,
+// it is derived from RemoteAddr
+func (e *Envelope) ClientAddr() netip.AddrPort {
+	if e.Remote.IsValid() {
+		return e.Remote
+	}
+	return utils.AddrPortOf(e.RemoteAddr)
+}
+
+// SetRemote sets the address of the client, e.g. when it is given by a proxy. Peer is left untouched
+func (e *Envelope) SetRemote(remote netip.AddrPort) {
+	e.Remote = remote
+	e.RemoteAddr = net.TCPAddrFromAddrPort(remote)
+}
+
 // PrependHeader adds a header to Data in the envelope, operates on the Data buffer
 func (e *Envelope) PrependHeader(key, value string) error {
 	_, err := e.Data.PrependString(fmt.Sprintf("%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(key), value))
@@ -90,3 +122,8 @@ func (e *Envelope) PrependHeader(key, value string) error {
 func (e *Envelope) Mail() (*Mail, error) {
 	return NewMail(e.Data.Bytes(), e.UTF8)
 }
+
+// Walker returns a Walker over the parts of the mail inside the envelope, which does not copy the mail as Mail does
+func (e *Envelope) Walker(options ...WalkOption) *Walker {
+	return NewWalker(e.Data.Reader(), options...)
+}
@@ -0,0 +1,141 @@
+package envelope
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// HeloType is the form of the argument given in HELO/EHLO
+type HeloType int
+
+const (
+	// HeloUnknown the argument could not be parsed
+	HeloUnknown HeloType = iota
+	// HeloDomain the argument is a domain name, e.g. mail.example.com
+	HeloDomain
+	// HeloIPv4 the argument is an IPv4 address literal, e.g. [192.0.2.1]
+	HeloIPv4
+	// HeloIPv6 the argument is an IPv6 address literal, e.g. [IPv6:2001:db8::1]
+	HeloIPv6
+)
+
+func (t HeloType) String() string {
+	switch t {
+	case HeloDomain:
+		return "domain"
+	case HeloIPv4:
+		return "ipv4"
+	case HeloIPv6:
+		return "ipv6"
+	}
+	return "unknown"
+}
+
+// HeloName is the parsed argument of HELO/EHLO
+//
+//	ehlo           = "EHLO" SP ( Domain / address-literal ) CRLF
+//	helo           = "HELO" SP Domain CRLF
+//	address-literal  = "[" ( IPv4-address-literal / IPv6-address-literal ) "]"
+type HeloName struct {
+	// Raw is the argument as sent by the client
+	Raw  string
+	Type HeloType
+
+	// Domain is the lower-cased domain, without any trailing dot, when Type is HeloDomain
+	Domain string
+	// FQDN is true if Domain has more than one label, e.g. mail.example.com but not localhost
+	FQDN bool
+
+	// Addr is the address of an address literal
+	Addr netip.Addr
+}
+
+// IsLiteral returns true if the argument is an address literal
+func (h HeloName) IsLiteral() bool {
+	return h.Type == HeloIPv4 || h.Type == HeloIPv6
+}
+
+func (h HeloName) String() string {
+	return h.Raw
+}
+
+var (
+	ErrHeloEmpty   = errors.New("empty helo argument")
+	ErrHeloLiteral = errors.New("invalid address literal")
+	ErrHeloDomain  = errors.New("invalid domain")
+	// ErrHeloBareAddress is returned for an address that is not enclosed in brackets, Addr is set
+	ErrHeloBareAddress = errors.New("address literal must be enclosed in brackets")
+)
+
+// ParseHelo parses the argument of HELO/EHLO. It returns a HeloName with the Raw value and
+// Type HeloUnknown if the argument is not a valid domain or address literal
+func ParseHelo(arg string) (HeloName, error) {
+	arg = strings.TrimSpace(arg)
+	h := HeloName{Raw: arg}
+	if arg == "" {
+		return h, ErrHeloEmpty
+	}
+
+	if strings.HasPrefix(arg, "[") {
+		if !strings.HasSuffix(arg, "]") {
+			return h, ErrHeloLiteral
+		}
+		lit := arg[1 : len(arg)-1]
+		if len(lit) > 5 && strings.EqualFold(lit[:5], "IPv6:") {
+			addr, err := netip.ParseAddr(lit[5:])
+			if err != nil || !addr.Is6() || addr.Zone() != "" {
+				return h, ErrHeloLiteral
+			}
+			h.Type = HeloIPv6
+			h.Addr = addr
+			return h, nil
+		}
+		addr, err := netip.ParseAddr(lit)
+		if err != nil || !addr.Is4() {
+			return h, ErrHeloLiteral
+		}
+		h.Type = HeloIPv4
+		h.Addr = addr
+		return h, nil
+	}
+
+	if addr, err := netip.ParseAddr(arg); err == nil {
+		h.Addr = addr
+		return h, ErrHeloBareAddress
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(arg, "."))
+	if !validDomain(domain) {
+		return h, ErrHeloDomain
+	}
+	h.Type = HeloDomain
+	h.Domain = domain
+	h.FQDN = strings.Contains(domain, ".")
+	return h, nil
+}
+
+// validDomain checks the syntax of a domain according to RFC 5321, i.e. letters, digits and hyphens in labels
+// of at most 63 characters. Labels may not start or end with a hyphen. Underscores are allowed since they are
+// common in the wild
+func validDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package envelope
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestParseHelo(t *testing.T) {
+	tests := []struct {
+		arg    string
+		typ    HeloType
+		domain string
+		fqdn   bool
+		addr   string
+		err    error
+	}{
+		{arg: "mail.example.com", typ: HeloDomain, domain: "mail.example.com", fqdn: true},
+		{arg: "Mail.Example.COM.", typ: HeloDomain, domain: "mail.example.com", fqdn: true},
+		{arg: "localhost", typ: HeloDomain, domain: "localhost"},
+		{arg: "[192.0.2.1]", typ: HeloIPv4, addr: "192.0.2.1"},
+		{arg: "[IPv6:2001:0db8:85a3:0000:0000:8a2e:0370:7334]", typ: HeloIPv6, addr: "2001:db8:85a3::8a2e:370:7334"},
+		{arg: "[ipv6:::1]", typ: HeloIPv6, addr: "::1"},
+		{arg: "192.0.2.1", typ: HeloUnknown, addr: "192.0.2.1", err: ErrHeloBareAddress},
+		{arg: "[2001:db8::1]", err: ErrHeloLiteral},
+		{arg: "[IPv6:192.0.2.1]", err: ErrHeloLiteral},
+		{arg: "[192.0.2.1", err: ErrHeloLiteral},
+		{arg: "-bad.example.com", err: ErrHeloDomain},
+		{arg: "bad..example.com", err: ErrHeloDomain},
+		{arg: "b@d.example.com", err: ErrHeloDomain},
+		{arg: "  ", err: ErrHeloEmpty},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			h, err := ParseHelo(tt.arg)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected err %v, got %v", tt.err, err)
+			}
+			if h.Type != tt.typ {
+				t.Errorf("expected type %s, got %s", tt.typ, h.Type)
+			}
+			if h.Domain != tt.domain {
+				t.Errorf("expected domain %q, got %q", tt.domain, h.Domain)
+			}
+			if h.FQDN != tt.fqdn {
+				t.Errorf("expected fqdn %v, got %v", tt.fqdn, h.FQDN)
+			}
+			if tt.addr != "" && h.Addr != netip.MustParseAddr(tt.addr) {
+				t.Errorf("expected addr %s, got %s", tt.addr, h.Addr)
+			}
+		})
+	}
+}
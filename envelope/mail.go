@@ -51,6 +51,7 @@ func NewMail(data []byte, utf8 bool) (*Mail, error) {
 	return &Mail{RawHeaders: header, RawBody: body, UTF8: utf8}, nil
 }
 
+// Mail is a message split into its header and body. JSON and CBOR use the field names as keys
 type Mail struct {
 	UTF8 bool
 
@@ -164,6 +165,7 @@ func (e *Mail) Headers(options ...DecodingOption) (Headers, error) {
 	return Headers{h}, err
 }
 
+// Body returns the MIME structure of the mail, with every part read into memory
 func (e *Mail) Body() (*Content, error) {
 	h, err := e.Headers()
 	if err != nil {
@@ -188,7 +190,7 @@ func (e *Mail) Body() (*Content, error) {
 	return parseContent(head, bytes.NewReader(e.RawBody))
 }
 
-// Body returns the email body
+// parseContent reads the part with headers and body, and the parts of it if it is a multipart
 func parseContent(headers textproto.MIMEHeader, body io.Reader) (*Content, error) {
 
 	mediaType, params, err := mime.ParseMediaType(headers.Get("Content-Type"))
@@ -235,6 +237,7 @@ func parseContent(headers textproto.MIMEHeader, body io.Reader) (*Content, error
 
 }
 
+// Content is a MIME part, with the parts of a multipart in Children. JSON and CBOR use the field names as keys
 type Content struct {
 	Headers  textproto.MIMEHeader
 	Body     []byte
@@ -286,18 +289,25 @@ func (c *Content) Decode() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse Content-Type: %w", err)
 	}
-	charset := strings.ToLower(params["charset"])
-
-	if charset == "" {
-		charset = "utf-8"
+	r, err := decoder(bytes.NewReader(c.Body), enc, params["charset"])
+	if err != nil {
+		return nil, err
 	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", enc, err)
+	}
+	return data, nil
+}
 
-	var toUTF8 func(r io.Reader) io.Reader
-	toUTF8 = func(r io.Reader) io.Reader {
+// decoder returns a reader of body that decodes the transfer encoding and converts the charset to utf-8
+func decoder(body io.Reader, encoding string, charset string) (io.Reader, error) {
+	toUTF8 := func(r io.Reader) io.Reader {
 		return r
 	}
 
-	if charset != "utf-8" {
+	charset = strings.ToLower(charset)
+	if charset != "" && charset != "utf-8" {
 
 		m, ok := charsetEncodings[charset]
 		if !ok {
@@ -310,29 +320,16 @@ func (c *Content) Decode() ([]byte, error) {
 		}
 	}
 
-	switch enc {
-
+	switch strings.ToLower(encoding) {
 	case "quoted-printable":
-
-		data, err := io.ReadAll(toUTF8(quotedprintable.NewReader(bytes.NewReader(c.Body))))
-		return data, err
+		return toUTF8(quotedprintable.NewReader(body)), nil
 	case "base64":
-
-		data, err := base64.StdEncoding.DecodeString(string(c.Body))
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode base64: %w", err)
-		}
-
-		data, err = io.ReadAll(toUTF8(bytes.NewReader(data)))
-
-		return data, err
+		return toUTF8(base64.NewDecoder(base64.StdEncoding, body)), nil
 	case "7bit", "8bit", "binary":
-		data, err := io.ReadAll(toUTF8(bytes.NewReader(c.Body)))
-		return data, err
+		return toUTF8(body), nil
 	default:
-		return nil, fmt.Errorf("unknown encoding: %s", enc)
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
 	}
-
 }
 
 func (c *Content) Walk(fn func(*Content, int) error) error {
@@ -116,6 +116,28 @@ PDF content here
 		assert.Equal(t, "attachment; filename=\"test.pdf\"", content.Children[1].Headers.Get("Content-Disposition"))
 		assert.Equal(t, "PDF content here", string(content.Children[1].Body))
 	})
+
+	t.Run("Quoted-Printable Part", func(t *testing.T) {
+		rawEmail := []byte("Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+			"\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Hej p=C3=A5 dig=\r\n!\r\n" +
+			"--b--\r\n")
+
+		mail, err := NewMail(rawEmail, false)
+		require.NoError(t, err)
+
+		content, err := mail.Body()
+		require.NoError(t, err)
+		require.Len(t, content.Children, 1)
+
+		// the part is decoded, as by multipart.Reader.NextPart
+		assert.Equal(t, "Hej på dig!", string(content.Children[0].Body))
+		assert.Empty(t, content.Children[0].Headers.Get("Content-Transfer-Encoding"))
+	})
 }
 
 func TestContentIsAttachment(t *testing.T) {
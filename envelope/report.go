@@ -0,0 +1,349 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// MimeMessageGlobalDeliveryStatus is the internationalized message/delivery-status (RFC 6533)
+const MimeMessageGlobalDeliveryStatus = "message/global-delivery-status"
+
+// BounceKind is the heuristic classification of a failed delivery
+type BounceKind string
+
+const (
+	// BounceHard is a permanent failure, e.g. the mailbox does not exist
+	BounceHard BounceKind = "hard"
+	// BounceSoft is a temporary failure, e.g. a delay or a timeout
+	BounceSoft BounceKind = "soft"
+	// BounceMailboxFull is a failure due to the mailbox being over quota, permanent or not
+	BounceMailboxFull BounceKind = "mailbox_full"
+	// BounceBlocked is a rejection by policy, e.g. spam filtering or a block list
+	BounceBlocked BounceKind = "blocked"
+	// BounceUnknown is a failure that could not be classified
+	BounceUnknown BounceKind = "unknown"
+)
+
+// ErrNotBounce is returned by DeliveryReport for mail that is neither a DSN nor looks like a bounce
+var ErrNotBounce = errors.New("envelope: mail is not a delivery report")
+
+// DeliveryReport is a parsed Delivery Status Notification, or a bounce that does not follow RFC 3464
+type DeliveryReport struct {
+	// EnvID is the Original-Envelope-Id, i.e. the ENVID given when the message was sent
+	EnvID        string
+	ReportingMTA string
+	// MessageID is the Message-ID of the original message, if it was returned
+	MessageID string
+
+	Recipients []ReportRecipient
+
+	// Heuristic is true if the report was not a message/delivery-status, but guessed from the text of the bounce
+	Heuristic bool
+}
+
+// ReportRecipient is the outcome of the delivery to a recipient in a DeliveryReport
+type ReportRecipient struct {
+	// Recipient is the Final-Recipient address
+	Recipient string
+	// OriginalRecipient is the Original-Recipient address, i.e. the ORCPT given when the message was sent
+	OriginalRecipient string
+	// Action is one of the DSNAction values, e.g. DSNActionFailed
+	Action string
+	// Status is the enhanced status code, e.g. "5.1.1"
+	Status string
+	// Diagnostic is the reply of the remote server, e.g. "550 5.1.1 User unknown"
+	Diagnostic string
+	RemoteMTA  string
+
+	Kind BounceKind
+}
+
+// Failed returns true if the delivery to the recipient failed permanently
+func (r ReportRecipient) Failed() bool {
+	return r.Action == DSNActionFailed
+}
+
+// Kind returns the classification of the first failed recipient, or the first delayed one.
+// An empty string is returned if no delivery failed
+func (r *DeliveryReport) Kind() BounceKind {
+	for _, action := range []string{DSNActionFailed, DSNActionDelayed} {
+		for _, rcpt := range r.Recipients {
+			if rcpt.Action == action {
+				return rcpt.Kind
+			}
+		}
+	}
+	return ""
+}
+
+// DeliveryReport returns the delivery report of a bounce. The message/delivery-status part of a DSN is parsed,
+// and for other bounces the recipients and the reason are guessed from the text.
+// ErrNotBounce is returned if the mail does not look like a bounce
+func (e *Mail) DeliveryReport() (*DeliveryReport, error) {
+	headers, err := e.Headers()
+	if err != nil {
+		return nil, err
+	}
+	// bounces that are not MIME are plain text
+	body := &Content{Headers: textproto.MIMEHeader{"Content-Type": {MimeTextPlain}}, Body: e.RawBody}
+	if headers.Get("Content-Type") != "" {
+		body, err = e.Body()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var report *DeliveryReport
+	var messageID string
+	var texts [][]byte
+	err = body.Walk(func(c *Content, _ int) error {
+		mediaType, _, _ := mime.ParseMediaType(c.Headers.Get("Content-Type"))
+		switch strings.ToLower(mediaType) {
+		case MimeMessageDeliveryStatus, MimeMessageGlobalDeliveryStatus:
+			if report != nil {
+				return nil
+			}
+			data, err := c.Decode()
+			if err != nil {
+				return err
+			}
+			report, err = ParseDeliveryStatus(data)
+			return err
+		case MimeMessageEmail, MimeTextRFC822Headers, "message/global", "message/global-headers":
+			if messageID == "" {
+				data, _ := c.Decode()
+				messageID = messageIDOf(data)
+			}
+		case MimeTextPlain:
+			data, err := c.Decode()
+			if err == nil {
+				texts = append(texts, data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if report == nil {
+		if !looksLikeBounce(headers) {
+			return nil, ErrNotBounce
+		}
+		report = guessReport(bytes.Join(texts, []byte("\n")))
+	}
+	report.MessageID = messageID
+	if report.MessageID == "" {
+		for _, text := range texts {
+			if m := messageIDLine.FindSubmatch(text); m != nil {
+				report.MessageID = string(m[1])
+				break
+			}
+		}
+	}
+	return report, nil
+}
+
+// ParseDeliveryStatus parses the body of a message/delivery-status part, i.e. the per-message fields followed by
+// a group of fields per recipient (RFC 3464 2.2, 2.3)
+func ParseDeliveryStatus(data []byte) (*DeliveryReport, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+
+	var groups []textproto.MIMEHeader
+	for {
+		h, err := r.ReadMIMEHeader()
+		if len(h) > 0 {
+			groups = append(groups, h)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(groups) < 2 {
+		return nil, errors.New("envelope: delivery status without recipient fields")
+	}
+
+	report := &DeliveryReport{
+		EnvID:        groups[0].Get("Original-Envelope-Id"),
+		ReportingMTA: typedValue(groups[0].Get("Reporting-MTA")),
+	}
+	for _, g := range groups[1:] {
+		rcpt := ReportRecipient{
+			Recipient:         typedValue(g.Get("Final-Recipient")),
+			OriginalRecipient: typedValue(g.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(g.Get("Action"))),
+			Status:            strings.TrimSpace(g.Get("Status")),
+			Diagnostic:        typedValue(g.Get("Diagnostic-Code")),
+			RemoteMTA:         typedValue(g.Get("Remote-MTA")),
+		}
+		// comments are allowed after the status code, e.g. 5.1.1 (bad destination mailbox address)
+		rcpt.Status, _, _ = strings.Cut(rcpt.Status, " ")
+		rcpt.Kind = ClassifyBounce(rcpt.Action, rcpt.Status, rcpt.Diagnostic)
+		report.Recipients = append(report.Recipients, rcpt)
+	}
+	return report, nil
+}
+
+// typedValue returns the value of a field of the form type; value, e.g. "rfc822; user@example.com"
+func typedValue(v string) string {
+	if _, value, found := strings.Cut(v, ";"); found {
+		v = value
+	}
+	return strings.Join(strings.Fields(v), " ")
+}
+
+var (
+	enhancedStatus = regexp.MustCompile(`\b([45])\.(\d{1,3})\.(\d{1,3})\b`)
+
+	mailboxFull = regexp.MustCompile(`(?i)mailbox (is )?full|over ?quota|quota exceeded|exceeded (the )?(storage|quota)|` +
+		`insufficient (system )?storage|mailbox size limit`)
+	blocked = regexp.MustCompile(`(?i)block(ed|list)|blacklist|spam|policy|reputation|\blisted\b|spf|dmarc|dkim|` +
+		`not authori[sz]ed|access denied|rejected for`)
+	hard = regexp.MustCompile(`(?i)user unknown|unknown user|no such (user|mailbox|recipient)|does not exist|doesn't exist|` +
+		`invalid (recipient|address|mailbox)|recipient (address )?rejected|mailbox (unavailable|not found|disabled)|` +
+		`account (has been )?disabled|address rejected|no mailbox|host (or domain name )?not found|domain not found`)
+	soft = regexp.MustCompile(`(?i)try again|temporar|deferred|delayed|timed? ?out|greylist|graylist|` +
+		`will (be )?retr|still trying|too many connections|rate limit`)
+)
+
+// ClassifyBounce classifies a failed delivery by its action, enhanced status code and diagnostic text,
+// e.g. ClassifyBounce("failed", "5.2.2", "552 Mailbox full") is BounceMailboxFull.
+// An empty string is returned for successful deliveries
+func ClassifyBounce(action, status, diagnostic string) BounceKind {
+	switch action {
+	case DSNActionDelivered, DSNActionRelayed, DSNActionExpanded:
+		return ""
+	}
+
+	if status == "" {
+		if m := enhancedStatus.FindString(diagnostic); m != "" {
+			status = m
+		}
+	}
+	class, subject, detail := "", "", ""
+	if m := enhancedStatus.FindStringSubmatch(status); m != nil {
+		class, subject, detail = m[1], m[2], m[3]
+	}
+
+	switch {
+	case subject == "2" && detail == "2", mailboxFull.MatchString(diagnostic):
+		return BounceMailboxFull
+	case action == DSNActionDelayed:
+		return BounceSoft
+	case subject == "7", blocked.MatchString(diagnostic):
+		return BounceBlocked
+	case class == "4", soft.MatchString(diagnostic):
+		return BounceSoft
+	case class == "5", hard.MatchString(diagnostic):
+		return BounceHard
+	}
+	if code := basicCode.FindString(diagnostic); code != "" {
+		if code[0] == '4' {
+			return BounceSoft
+		}
+		return BounceHard
+	}
+	return BounceUnknown
+}
+
+var (
+	bounceSubject = regexp.MustCompile(`(?i)undeliver|undelivered|delivery (status|failure|has failed|notification)|` +
+		`returned mail|failure notice|mail delivery failed|could not be delivered|delivery delayed`)
+	bounceSender = regexp.MustCompile(`(?i)mailer-daemon|postmaster|mail delivery (system|subsystem)`)
+
+	basicCode     = regexp.MustCompile(`\b[45][0-5][0-9]\b`)
+	messageIDLine = regexp.MustCompile(`(?im)^Message-ID:\s*(<[^>\s]+>)`)
+	bouncedRcpt   = regexp.MustCompile(`<?([^\s<>"@:;,()]+@[^\s<>"@:;,()]+\.[A-Za-z0-9-]+)>?(?:[:;,.)]|\s|$)`)
+)
+
+// looksLikeBounce returns true if the headers are those of a bounce
+func looksLikeBounce(h Headers) bool {
+	if mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil &&
+		strings.ToLower(mediaType) == MimeMultipartReport && strings.EqualFold(params["report-type"], "delivery-status") {
+		return true
+	}
+	return bounceSubject.MatchString(h.Get("Subject")) || bounceSender.MatchString(h.Get("From"))
+}
+
+// guessReport returns a report of a bounce that does not follow RFC 3464, from the text of the bounce.
+// Recipients are the addresses in the text before the returned message, the diagnostic is the rest of their
+// paragraph
+func guessReport(text []byte) *DeliveryReport {
+	report := &DeliveryReport{Heuristic: true}
+
+	lines := strings.Split(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n")
+	action := DSNActionFailed
+	if soft.MatchString(string(text)) && !enhancedStatus.MatchString(string(text)) && !basicCode.MatchString(string(text)) {
+		action = DSNActionDelayed
+	}
+
+	seen := map[string]bool{}
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if isOriginalMessage(trimmed) {
+			break
+		}
+		for _, m := range bouncedRcpt.FindAllStringSubmatch(trimmed, -1) {
+			addr := strings.ToLower(m[1])
+			if seen[addr] || bounceSender.MatchString(addr) {
+				continue
+			}
+			seen[addr] = true
+
+			parts := []string{strings.TrimSpace(strings.Replace(trimmed, m[0], "", 1))}
+			for j := i + 1; j < len(lines) && j < i+6; j++ {
+				next := strings.TrimSpace(lines[j])
+				if next == "" || isOriginalMessage(next) || bouncedRcpt.MatchString(next) {
+					break
+				}
+				parts = append(parts, next)
+			}
+			diagnostic := strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+			status := enhancedStatus.FindString(diagnostic)
+			report.Recipients = append(report.Recipients, ReportRecipient{
+				Recipient:  addr,
+				Action:     action,
+				Status:     status,
+				Diagnostic: diagnostic,
+				Kind:       ClassifyBounce(action, status, diagnostic),
+			})
+		}
+	}
+
+	if len(report.Recipients) == 0 {
+		diagnostic := strings.Join(strings.Fields(string(text)), " ")
+		report.Recipients = append(report.Recipients, ReportRecipient{
+			Action: action,
+			Status: enhancedStatus.FindString(diagnostic),
+			Kind:   ClassifyBounce(action, "", diagnostic),
+		})
+	}
+	return report
+}
+
+// isOriginalMessage returns true for the lines that usually start the returned message in a bounce
+func isOriginalMessage(line string) bool {
+	l := strings.ToLower(line)
+	return strings.HasPrefix(l, "---") && (strings.Contains(l, "original message") || strings.Contains(l, "returned message") ||
+		strings.Contains(l, "headers")) || strings.HasPrefix(l, "message-id:") || strings.HasPrefix(l, "received:")
+}
+
+// messageIDOf returns the Message-ID of a returned message, or its headers
+func messageIDOf(data []byte) string {
+	data = append(bytes.TrimRight(data, "\r\n"), "\n\n"...)
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	return msg.Header.Get("Message-ID")
+}
@@ -0,0 +1,139 @@
+package envelope
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeliveryReport(t *testing.T) {
+	t.Run("DSN", func(t *testing.T) {
+		e := bounceEnvelope(&DSN{
+			EnvID: "QQ314159",
+			Ret:   DSNRetHdrs,
+			ORcpt: map[string]string{"a@example.org": "rfc822;alias@example.org"},
+		})
+		e.Data = &Data{}
+		_, _ = e.Data.WriteString("Subject: Hello\nMessage-ID: <1234@example.com>\n\nThe body\n")
+		b, err := e.Bounce(Report{
+			ReportingMTA: "mx.example.net",
+			Recipients: []RecipientStatus{
+				{Recipient: "a@example.org", Action: DSNActionFailed, Diagnostic: "550 5.1.1 User unknown", RemoteMTA: "mx.example.org"},
+				{Recipient: "b@example.org", Action: DSNActionDelayed, Diagnostic: "452 4.2.2 Mailbox full"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := NewMail(b.Data.Bytes(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := m.DeliveryReport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Heuristic {
+			t.Error("expected a parsed report")
+		}
+		if report.EnvID != "QQ314159" || report.ReportingMTA != "mx.example.net" || report.MessageID != "<1234@example.com>" {
+			t.Errorf("unexpected report %+v", report)
+		}
+		if len(report.Recipients) != 2 {
+			t.Fatalf("expected 2 recipients, got %+v", report.Recipients)
+		}
+		expected := ReportRecipient{
+			Recipient:         "a@example.org",
+			OriginalRecipient: "alias@example.org",
+			Action:            DSNActionFailed,
+			Status:            "5.1.1",
+			Diagnostic:        "550 5.1.1 User unknown",
+			RemoteMTA:         "mx.example.org",
+			Kind:              BounceHard,
+		}
+		if report.Recipients[0] != expected {
+			t.Errorf("expected %+v, got %+v", expected, report.Recipients[0])
+		}
+		if report.Recipients[1].Kind != BounceMailboxFull {
+			t.Errorf("expected mailbox full, got %s", report.Recipients[1].Kind)
+		}
+		if report.Kind() != BounceHard {
+			t.Errorf("expected the kind of the failed recipient, got %s", report.Kind())
+		}
+	})
+
+	t.Run("Heuristic", func(t *testing.T) {
+		data := "From: MAILER-DAEMON@mx.example.net\n" +
+			"To: sender@example.com\n" +
+			"Subject: failure notice\n" +
+			"\n" +
+			"Hi. This is the qmail-send program at mx.example.net.\n" +
+			"I'm afraid I wasn't able to deliver your message to the following addresses.\n" +
+			"This is a permanent error; I've given up. Sorry it didn't work out.\n" +
+			"\n" +
+			"<someone@example.org>:\n" +
+			"192.0.2.1 does not like recipient.\n" +
+			"Remote host said: 550 Requested action not taken: mailbox unavailable\n" +
+			"\n" +
+			"--- Below this line is a copy of the message.\n" +
+			"\n" +
+			"Message-ID: <5678@example.com>\n" +
+			"To: someone@example.org\n"
+		m, err := NewMail([]byte(data), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := m.DeliveryReport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Heuristic {
+			t.Error("expected a heuristic report")
+		}
+		if report.MessageID != "<5678@example.com>" {
+			t.Errorf("unexpected message id %q", report.MessageID)
+		}
+		if len(report.Recipients) != 1 {
+			t.Fatalf("expected 1 recipient, got %+v", report.Recipients)
+		}
+		rcpt := report.Recipients[0]
+		if rcpt.Recipient != "someone@example.org" || rcpt.Action != DSNActionFailed || rcpt.Kind != BounceHard {
+			t.Errorf("unexpected recipient %+v", rcpt)
+		}
+	})
+
+	t.Run("NotBounce", func(t *testing.T) {
+		m, err := NewMail([]byte("From: friend@example.com\nSubject: Lunch?\n\nSee you at noon\n"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.DeliveryReport()
+		if !errors.Is(err, ErrNotBounce) {
+			t.Errorf("expected ErrNotBounce, got %v", err)
+		}
+	})
+}
+
+func TestClassifyBounce(t *testing.T) {
+	tests := []struct {
+		action, status, diagnostic string
+		expected                   BounceKind
+	}{
+		{DSNActionFailed, "5.1.1", "550 5.1.1 <a@example.org>: Recipient address rejected", BounceHard},
+		{DSNActionFailed, "", "550 No such user here", BounceHard},
+		{DSNActionFailed, "5.2.2", "552 5.2.2 Over quota", BounceMailboxFull},
+		{DSNActionFailed, "", "552 Requested mail action aborted: exceeded storage allocation", BounceMailboxFull},
+		{DSNActionFailed, "5.7.1", "554 5.7.1 Service unavailable; Client host blocked using zen.spamhaus.org", BounceBlocked},
+		{DSNActionFailed, "", "550 Message rejected as spam", BounceBlocked},
+		{DSNActionFailed, "4.4.1", "Connection timed out", BounceSoft},
+		{DSNActionDelayed, "", "", BounceSoft},
+		{DSNActionFailed, "", "421 Too many connections", BounceSoft},
+		{DSNActionFailed, "", "Something went wrong", BounceUnknown},
+		{DSNActionDelivered, "2.0.0", "250 OK", ""},
+	}
+	for _, test := range tests {
+		if kind := ClassifyBounce(test.action, test.status, test.diagnostic); kind != test.expected {
+			t.Errorf("%s %s %q: expected %q, got %q", test.action, test.status, test.diagnostic, test.expected, kind)
+		}
+	}
+}
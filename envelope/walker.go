@@ -0,0 +1,220 @@
+package envelope
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+var ErrMaxDepth = errors.New("envelope: MIME parts are nested too deep")
+var ErrMaxParts = errors.New("envelope: too many MIME parts")
+
+type walkConfig struct {
+	maxDepth int
+	maxParts int
+}
+
+type WalkOption func(*walkConfig)
+
+// WithMaxDepth sets how deep multiparts may be nested, where the message itself is at depth 0. Defaults to 20,
+// and n <= 0 is no limit. Walker.Next returns ErrMaxDepth when a part is nested deeper
+func WithMaxDepth(n int) WalkOption {
+	return func(cfg *walkConfig) {
+		cfg.maxDepth = n
+	}
+}
+
+// WithMaxParts sets how many parts a message may have, including the message itself and the multiparts.
+// Defaults to 1000, and n <= 0 is no limit. Walker.Next returns ErrMaxParts on the part after the last one allowed
+func WithMaxParts(n int) WalkOption {
+	return func(cfg *walkConfig) {
+		cfg.maxParts = n
+	}
+}
+
+// Part is a MIME part yielded by a Walker. Reading from it reads its body as it was sent, i.e. still transfer
+// encoded, use Decode to read it decoded. The body of a multipart is its parts, which are yielded by the Walker,
+// and reads as empty.
+//
+// The body can only be read until Walker.Next is called again, which skips what is left of it
+type Part struct {
+	Header textproto.MIMEHeader
+
+	// Depth is how deep the part is nested, 0 for the message itself and 1 for its parts
+	Depth int
+	// Index is the order of the part in the message, 0 for the message itself
+	Index int
+
+	// MediaType is the lower case media type of Content-Type, which defaults to text/plain, or message/rfc822
+	// in a multipart/digest (RFC 2046)
+	MediaType string
+	Params    map[string]string
+
+	body io.Reader
+}
+
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.MediaType, "multipart/")
+}
+
+// Read reads the body of the part as it was sent
+func (p *Part) Read(b []byte) (int, error) {
+	if p.body == nil {
+		return 0, io.EOF
+	}
+	return p.body.Read(b)
+}
+
+func (p *Part) Encoding() string {
+	enc := p.Header.Get("Content-Transfer-Encoding")
+	if enc == "" {
+		enc = "7bit"
+	}
+	return enc
+}
+
+// Decode returns a reader of the body that decodes its transfer encoding, base64 or quoted-printable, and
+// converts its charset to utf-8, as Content.Decode does
+func (p *Part) Decode() (io.Reader, error) {
+	return decoder(p, p.Encoding(), p.Params["charset"])
+}
+
+// Walker iterates over the parts of a MIME message as they are read, depth first, without keeping the message
+// or its bodies in memory. It is used to handle large messages, or messages from a client that is not trusted,
+// where Mail.Body would read every part into memory.
+//
+// Example usage:
+//
+//	w := envelope.NewWalker(e.Data.Reader(), envelope.WithMaxParts(100))
+//	for {
+//		part, err := w.Next()
+//		if errors.Is(err, io.EOF) {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		if part.MediaType == "application/pdf" {
+//			r, err := part.Decode()
+//			...
+//		}
+//	}
+//
+// A message/rfc822 part is not walked into, but can be walked with a new Walker reading from the part.
+type Walker struct {
+	cfg walkConfig
+
+	// root is the message itself, yielded by the first call to Next
+	root *Part
+	// readers are the multiparts that are being read, the innermost last
+	readers []*multipartReader
+	parts   int
+	err     error
+}
+
+type multipartReader struct {
+	*multipart.Reader
+	digest bool
+}
+
+// NewWalker returns a Walker over the message read from r, i.e. its header, an empty line and its body
+func NewWalker(r io.Reader, options ...WalkOption) *Walker {
+	br := bufio.NewReader(r)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if errors.Is(err, io.EOF) {
+		// a message with only headers
+		err = nil
+	}
+	w := newWalker(header, br, options...)
+	if err != nil {
+		w.err = fmt.Errorf("failed to read header: %w", err)
+	}
+	return w
+}
+
+func newWalker(header textproto.MIMEHeader, body io.Reader, options ...WalkOption) *Walker {
+	w := &Walker{
+		cfg: walkConfig{
+			maxDepth: 20,
+			maxParts: 1000,
+		},
+		root: &Part{Header: header, body: body},
+	}
+	for _, option := range options {
+		option(&w.cfg)
+	}
+	return w
+}
+
+// Next returns the next part of the message, or io.EOF when there are no more parts. The part returned first
+// is the message itself. Once Next has returned an error, it returns the same error on every call
+func (w *Walker) Next() (*Part, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	if w.root != nil {
+		p := w.root
+		w.root = nil
+		return w.enter(p, false)
+	}
+	for len(w.readers) > 0 {
+		r := w.readers[len(w.readers)-1]
+		raw, err := r.NextRawPart()
+		if errors.Is(err, io.EOF) {
+			w.readers = w.readers[:len(w.readers)-1]
+			continue
+		}
+		if err != nil {
+			return nil, w.fail(fmt.Errorf("failed to get part: %w", err))
+		}
+		return w.enter(&Part{Header: raw.Header, Depth: len(w.readers), body: raw}, r.digest)
+	}
+	return nil, io.EOF
+}
+
+// enter checks the limits for p, and starts reading its parts if it is a multipart
+func (w *Walker) enter(p *Part, digest bool) (*Part, error) {
+	p.Index = w.parts
+	w.parts++
+	if w.cfg.maxParts > 0 && w.parts > w.cfg.maxParts {
+		return nil, w.fail(ErrMaxParts)
+	}
+	if w.cfg.maxDepth > 0 && p.Depth > w.cfg.maxDepth {
+		return nil, w.fail(ErrMaxDepth)
+	}
+
+	p.MediaType, p.Params = MimeTextPlain, map[string]string{}
+	if digest {
+		p.MediaType = MimeMessageEmail
+	}
+	if ct := p.Header.Get("Content-Type"); ct != "" {
+		mediaType, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, w.fail(fmt.Errorf("failed to parse Content-Type: %w", err))
+		}
+		p.MediaType, p.Params = strings.ToLower(mediaType), params
+	}
+
+	if p.IsMultipart() {
+		boundary := p.Params["boundary"]
+		if boundary == "" {
+			return nil, w.fail(errors.New("no boundary in Content-Type params"))
+		}
+		w.readers = append(w.readers, &multipartReader{
+			Reader: multipart.NewReader(p.body, boundary),
+			digest: p.MediaType == "multipart/digest",
+		})
+		p.body = nil
+	}
+	return p, nil
+}
+
+func (w *Walker) fail(err error) error {
+	w.err = err
+	return err
+}
@@ -0,0 +1,175 @@
+package envelope
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const nestedMessage = `From: sender@example.com
+To: recipient@example.com
+Subject: Nested
+Content-Type: multipart/mixed; boundary="outer"
+
+preamble
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Caf=E9
+--inner
+Content-Type: text/html
+
+<p>Café</p>
+--inner--
+--outer
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="test.pdf"
+Content-Transfer-Encoding: base64
+
+UERGIGNvbnRl
+bnQgaGVyZQ==
+--outer
+Content-Type: multipart/digest; boundary="digest"
+
+--digest
+
+Subject: Forwarded
+
+Hello
+--digest--
+--outer--
+epilogue`
+
+// walk returns the parts of the message, and the error that stopped the walk
+func walk(t *testing.T, w *Walker, read bool) ([]*Part, []string, error) {
+	t.Helper()
+	var parts []*Part
+	var bodies []string
+	for {
+		p, err := w.Next()
+		if errors.Is(err, io.EOF) {
+			return parts, bodies, nil
+		}
+		if err != nil {
+			return parts, bodies, err
+		}
+		parts = append(parts, p)
+		if read {
+			r, err := p.Decode()
+			require.NoError(t, err)
+			body, err := io.ReadAll(r)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+		}
+	}
+}
+
+func TestWalker(t *testing.T) {
+	t.Run("Parts", func(t *testing.T) {
+		parts, bodies, err := walk(t, NewWalker(strings.NewReader(nestedMessage)), true)
+		require.NoError(t, err)
+		require.Len(t, parts, 7)
+
+		var types []string
+		var depths []int
+		for i, p := range parts {
+			assert.Equal(t, i, p.Index)
+			types = append(types, p.MediaType)
+			depths = append(depths, p.Depth)
+		}
+		assert.Equal(t, []string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "application/pdf", "multipart/digest", "message/rfc822"}, types)
+		assert.Equal(t, []int{0, 1, 2, 2, 1, 1, 2}, depths)
+		assert.Equal(t, "sender@example.com", parts[0].Header.Get("From"))
+
+		assert.Equal(t, "", bodies[0])
+		assert.Equal(t, "Café", bodies[2])
+		assert.Equal(t, "<p>Café</p>", bodies[3])
+		assert.Equal(t, "PDF content here", bodies[4])
+		assert.Equal(t, "Subject: Forwarded\n\nHello", bodies[6])
+	})
+
+	t.Run("Raw", func(t *testing.T) {
+		w := NewWalker(strings.NewReader(nestedMessage))
+		for i := 0; i < 4; i++ {
+			_, err := w.Next()
+			require.NoError(t, err)
+		}
+		p, err := w.Next()
+		require.NoError(t, err)
+		require.Equal(t, "application/pdf", p.MediaType)
+		raw, err := io.ReadAll(p)
+		require.NoError(t, err)
+		assert.Equal(t, "UERGIGNvbnRl\nbnQgaGVyZQ==", string(raw))
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		// the bodies that are not read are skipped
+		parts, _, err := walk(t, NewWalker(strings.NewReader(nestedMessage)), false)
+		require.NoError(t, err)
+		assert.Len(t, parts, 7)
+	})
+
+	t.Run("Plain", func(t *testing.T) {
+		parts, bodies, err := walk(t, NewWalker(strings.NewReader("Subject: Hi\r\n\r\nHello\r\n")), true)
+		require.NoError(t, err)
+		require.Len(t, parts, 1)
+		assert.Equal(t, MimeTextPlain, parts[0].MediaType)
+		assert.Equal(t, "Hello\r\n", bodies[0])
+	})
+
+	t.Run("MaxParts", func(t *testing.T) {
+		parts, _, err := walk(t, NewWalker(strings.NewReader(nestedMessage), WithMaxParts(4)), false)
+		assert.ErrorIs(t, err, ErrMaxParts)
+		assert.Len(t, parts, 4)
+
+		_, err = NewWalker(strings.NewReader(nestedMessage), WithMaxParts(0)).Next()
+		assert.NoError(t, err)
+	})
+
+	t.Run("MaxDepth", func(t *testing.T) {
+		parts, _, err := walk(t, NewWalker(strings.NewReader(nestedMessage), WithMaxDepth(1)), false)
+		assert.ErrorIs(t, err, ErrMaxDepth)
+		assert.Len(t, parts, 2)
+
+		// the error is returned on every call after it
+		w := NewWalker(strings.NewReader(nestedMessage), WithMaxDepth(1))
+		_, _, _ = walk(t, w, false)
+		_, err = w.Next()
+		assert.ErrorIs(t, err, ErrMaxDepth)
+	})
+
+	t.Run("Deep", func(t *testing.T) {
+		// the default limit stops a message nested 50 multiparts deep
+		var deep strings.Builder
+		deep.WriteString("Content-Type: multipart/mixed; boundary=b\r\n\r\n")
+		for i := 0; i < 50; i++ {
+			deep.WriteString("--b" + strings.Repeat("x", i) + "\r\nContent-Type: multipart/mixed; boundary=b" + strings.Repeat("x", i+1) + "\r\n\r\n")
+		}
+		_, _, err := walk(t, NewWalker(strings.NewReader(deep.String())), false)
+		assert.ErrorIs(t, err, ErrMaxDepth)
+	})
+
+	t.Run("Envelope", func(t *testing.T) {
+		e := NewEnvelope(nil, 1)
+		_, _ = e.Data.WriteString(nestedMessage)
+		parts, _, err := walk(t, e.Walker(), false)
+		require.NoError(t, err)
+		assert.Len(t, parts, 7)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, _, err := walk(t, NewWalker(strings.NewReader("Content-Type: multipart/mixed\r\n\r\nHello")), false)
+		assert.EqualError(t, err, "no boundary in Content-Type params")
+
+		_, _, err = walk(t, NewWalker(strings.NewReader("Content-Type: text/plain; =\r\n\r\nHello")), false)
+		assert.Error(t, err)
+	})
+}
@@ -9,7 +9,9 @@ require (
 
 require (
 	blitiri.com.ar/go/spf v1.5.1 // indirect
-	golang.org/x/net v0.37.0 // indirect
+	github.com/fxamacker/cbor/v2 v2.9.4 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 )
 
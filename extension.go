@@ -0,0 +1,230 @@
+package smtpx
+
+import (
+	"github.com/modfin/smtpx/envelope"
+	"log/slog"
+	"strings"
+)
+
+// Phase is the part of the SMTP session a client is in. Phases are bit flags and can be combined,
+// e.g. PhaseHelo | PhaseMail, to restrict where a verb is allowed
+type Phase int
+
+const (
+	// PhaseConnect the client has connected, but not yet sent HELO/EHLO
+	PhaseConnect Phase = 1 << iota
+	// PhaseHelo the client has sent HELO/EHLO and is not in a transaction
+	PhaseHelo
+	// PhaseMail the client has started a transaction with MAIL FROM, but has no recipients
+	PhaseMail
+	// PhaseRcpt the client has at least one recipient
+	PhaseRcpt
+
+	// PhaseAny allows the verb in any phase
+	PhaseAny = PhaseConnect | PhaseHelo | PhaseMail | PhaseRcpt
+)
+
+// Extension is a SMTP verb and/or an EHLO keyword handled by the server, e.g. ETRN or vendor specific verbs.
+// The built-in verbs, such as MAIL and RCPT, are extensions as well and can be replaced by registering
+// an extension with the same Verb.
+//
+// Example usage:
+//
+//	server.Register(smtpx.Extension{
+//		Verb:    "ETRN",
+//		Keyword: "ETRN",
+//		Phases:  smtpx.PhaseHelo,
+//		Handler: func(s *smtpx.Session, args string) {
+//			queue.Flush(args)
+//			s.Reply(smtpx.NewResponse(250, "Queuing started"))
+//		},
+//	})
+type Extension struct {
+	// Verb is the command, matched case-insensitively against the first word of the command line.
+	// Empty for extensions that are only advertised, e.g. PIPELINING
+	Verb string
+
+	// Keyword is advertised in the EHLO reply, e.g. "SIZE". Empty if the extension is not advertised
+	Keyword string
+	// Params returns the parameters of the keyword, e.g. the maximum message size of SIZE. Optional
+	Params func(s *Session) string
+
+	// Phases where the verb is allowed, a verb used outside them is rejected with a 503. 0 means PhaseAny
+	Phases Phase
+
+	// Enabled reports if the extension is available to the session, both the verb and the keyword. nil means always
+	Enabled func(s *Session) bool
+
+	// Handler is called with the rest of the command line, i.e. "FROM:<a@example.com>" for "MAIL FROM:<a@example.com>".
+	// It must reply to the client, e.g. with Session.Reply
+	Handler func(s *Session, args string)
+}
+
+func (e Extension) enabled(s *Session) bool {
+	return e.Enabled == nil || e.Enabled(s)
+}
+
+func (e Extension) allowed(p Phase) bool {
+	return e.Phases == 0 || e.Phases&p != 0
+}
+
+// ehlo returns the EHLO line of the extension, or an empty string if it is not advertised
+func (e Extension) ehlo(s *Session) string {
+	if e.Keyword == "" {
+		return ""
+	}
+	if e.Params == nil {
+		return e.Keyword
+	}
+	params := e.Params(s)
+	if params == "" {
+		return e.Keyword
+	}
+	return e.Keyword + " " + params
+}
+
+// Register adds extensions to the server. An extension with the same Verb, or Keyword if it has no verb,
+// as an already registered, or built-in, extension replaces it. An extension advertising a Keyword also
+// replaces an extension that only advertises the same keyword, e.g. the built-in STARTTLS keyword.
+//
+// Register must be called before the server is started, the extensions are read when ListenAndServe or Serve
+// is called and extensions registered after that are not used
+func (s *Server) Register(ext ...Extension) {
+	s.Extensions = append(s.Extensions, ext...)
+}
+
+// registry is the extensions of a server, in the order they are advertised
+type registry struct {
+	extensions []Extension
+	verbs      map[string]int
+}
+
+func newRegistry(exts ...[]Extension) *registry {
+	var all []Extension
+	verbs := map[string]int{}
+	keywords := map[string]int{}
+	replaced := map[int]bool{}
+	for _, list := range exts {
+		for _, ext := range list {
+			ext.Verb = strings.ToUpper(ext.Verb)
+			ext.Keyword = strings.ToUpper(ext.Keyword)
+
+			i, found := verbs[ext.Verb]
+			if ext.Verb == "" {
+				i, found = keywords[ext.Keyword]
+			}
+			if !found {
+				i = len(all)
+				all = append(all, Extension{})
+			}
+			all[i] = ext
+			if ext.Verb != "" {
+				verbs[ext.Verb] = i
+			}
+			if ext.Keyword != "" {
+				// a keyword is only advertised once, by the last extension with it
+				if j, found := keywords[ext.Keyword]; found && j != i && all[j].Verb == "" {
+					replaced[j] = true
+				}
+				keywords[ext.Keyword] = i
+			}
+		}
+	}
+
+	r := &registry{verbs: map[string]int{}}
+	for i, ext := range all {
+		if replaced[i] {
+			continue
+		}
+		if ext.Verb != "" {
+			r.verbs[ext.Verb] = len(r.extensions)
+		}
+		r.extensions = append(r.extensions, ext)
+	}
+	return r
+}
+
+// lookup returns the extension handling verb
+func (r *registry) lookup(verb string) (Extension, bool) {
+	i, found := r.verbs[strings.ToUpper(verb)]
+	if !found || r.extensions[i].Handler == nil {
+		return Extension{}, false
+	}
+	return r.extensions[i], true
+}
+
+// splitCommand splits a command line into its verb and arguments
+func splitCommand(line string) (verb string, args string) {
+	verb, args, _ = strings.Cut(strings.TrimSpace(line), " ")
+	return strings.ToUpper(verb), strings.TrimSpace(args)
+}
+
+// Session is a client connection, as seen by an Extension
+type Session struct {
+	server *Server
+	conn   *connection
+}
+
+// Server returns the server the client is connected to
+func (s *Session) Server() *Server {
+	return s.server
+}
+
+// Envelope returns the current transaction of the session
+func (s *Session) Envelope() *envelope.Envelope {
+	return s.conn.Envelope
+}
+
+// Logger returns the logger of the connection
+func (s *Session) Logger() *slog.Logger {
+	return s.conn.log
+}
+
+// Phase returns the phase of the session
+func (s *Session) Phase() Phase {
+	switch {
+	case len(s.conn.RcptTo) > 0:
+		return PhaseRcpt
+	case s.conn.isInTransaction():
+		return PhaseMail
+	case s.conn.Helo != "":
+		return PhaseHelo
+	}
+	return PhaseConnect
+}
+
+// Errors returns the number of errors the client has made, which the tarpit is based on
+func (s *Session) Errors() int {
+	return s.conn.errors
+}
+
+// Reply sends a reply to the client, items may be a Response, an error or a string
+func (s *Session) Reply(items ...any) {
+	s.conn.sendResponse(items...)
+}
+
+// Reject sends res to the client and counts it as an error. A 421 response also closes the connection
+func (s *Session) Reject(res Response) {
+	s.conn.rejected(res)
+}
+
+// Reset resets the transaction, keeping the session properties such as HELO and TLS
+func (s *Session) Reset() {
+	s.conn.resetTransaction()
+}
+
+// Close closes the connection once the current command has been handled
+func (s *Session) Close() {
+	s.conn.kill()
+}
+
+// Extensions returns the extensions enabled for the session, in the order they are advertised
+func (s *Session) Extensions() []Extension {
+	var exts []Extension
+	for _, ext := range s.server.registry.extensions {
+		if ext.enabled(s) {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
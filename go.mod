@@ -5,6 +5,7 @@ go 1.24
 require (
 	blitiri.com.ar/go/spf v1.5.1
 	github.com/emersion/go-msgauth v0.6.8
+	github.com/fxamacker/cbor/v2 v2.9.4
 	github.com/stretchr/testify v1.10.0
 	golang.org/x/crypto v0.36.0
 	golang.org/x/net v0.38.0
@@ -14,5 +15,6 @@ require (
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,113 @@
+package smtpx
+
+import (
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"net/mail"
+)
+
+// Hooks are called by the Server during the SMTP session, i.e. before the DATA command and the Middlewares are run.
+// They let a subsystem, such as a rate limiter, reject a client early in the session. All fields are optional.
+//
+// Returning nil, or a 2xx Response, lets the session continue. Any other Response is sent to the client
+// instead of the regular reply and the command is rejected. A 421 Response will also close the connection.
+type Hooks struct {
+	// Connect is called once when a client has connected, before the greeting is sent. If ProxyOn is set, it is
+	// instead called when PROXY gives the address of the client, or before the first other command. If XClientOn
+	// is set, it is called when XCLIENT gives the address, or before the first MAIL, since a proxy may send EHLO
+	// before XCLIENT. A rejection will close the connection
+	Connect func(e *envelope.Envelope) Response
+
+	// Helo is called when the client has sent HELO/EHLO, e.Helo is set
+	Helo func(e *envelope.Envelope) Response
+
+	// Mail is called when the client has sent MAIL FROM, e.MailFrom is set
+	Mail func(e *envelope.Envelope) Response
+
+	// Rcpt is called for each RCPT TO, before rcpt is added to e.RcptTo
+	Rcpt func(e *envelope.Envelope, rcpt *mail.Address) Response
+}
+
+// Hook adds hooks to the server, they will be called in the order they are added
+func (s *Server) Hook(hooks ...Hooks) {
+	s.Hooks = append(s.Hooks, hooks...)
+}
+
+// runHooks calls fn for each of the server hooks and returns the first Response that is not a success
+func (s *Server) runHooks(fn func(h Hooks) Response) Response {
+	for _, h := range s.Hooks {
+		res := fn(h)
+		if res != nil && res.Class() != responses.ClassSuccess {
+			return res
+		}
+	}
+	return nil
+}
+
+// connect runs the Connect hooks for the connection, once, and returns false if they rejected it
+func (s *Server) connect(conn *connection) bool {
+	if conn.connected {
+		return true
+	}
+	conn.connected = true
+	if res := s.connectHooks(conn.Envelope); res != nil {
+		conn.log.Debug("connection rejected", "response", res.String())
+		conn.sendResponse(res)
+		conn.kill()
+		return false
+	}
+	return true
+}
+
+// connectsBefore returns true if the Connect hooks should run before verb is handled
+func (s *Server) connectsBefore(verb string) bool {
+	switch {
+	case verb == "PROXY" || verb == "XCLIENT":
+		return false
+	case s.XClientOn:
+		// a proxy, e.g. Postfix or nginx, sends EHLO before XCLIENT
+		return verb == "MAIL"
+	}
+	return true
+}
+
+func (s *Server) connectHooks(e *envelope.Envelope) Response {
+	return s.runHooks(func(h Hooks) Response {
+		if h.Connect == nil {
+			return nil
+		}
+		return h.Connect(e)
+	})
+}
+
+func (s *Server) heloHooks(e *envelope.Envelope) Response {
+	return s.runHooks(func(h Hooks) Response {
+		if h.Helo == nil {
+			return nil
+		}
+		return h.Helo(e)
+	})
+}
+
+func (s *Server) mailHooks(e *envelope.Envelope) Response {
+	return s.runHooks(func(h Hooks) Response {
+		if h.Mail == nil {
+			return nil
+		}
+		return h.Mail(e)
+	})
+}
+
+func (s *Server) rcptHooks(e *envelope.Envelope, rcpt *mail.Address) Response {
+	return s.runHooks(func(h Hooks) Response {
+		if h.Rcpt == nil {
+			return nil
+		}
+		return h.Rcpt(e, rcpt)
+	})
+}
+
+// closesConnection returns true if the response means that the server is closing the transmission channel
+func closesConnection(res Response) bool {
+	return res.StatusCode() == 421
+}
@@ -0,0 +1,156 @@
+// Package delivery holds what the local delivery agents, i.e. the maildir and mbox packages, have in common:
+// rejecting recipients without a mailbox in RCPT, writing a copy of the message with Return-Path and Delivered-To
+// headers for each recipient, and reporting the recipients that could not be delivered to.
+package delivery
+
+import (
+	"errors"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/middleware"
+	"github.com/modfin/smtpx/responses"
+	"log/slog"
+	"net/mail"
+	"time"
+)
+
+// Agent delivers a copy of the message to the mailbox of each recipient
+type Agent struct {
+	// Name prefixes the log messages, e.g. "maildir"
+	Name   string
+	Logger *slog.Logger
+
+	// Unknown is the error of Resolve and Deliver for recipients without a mailbox
+	Unknown error
+	// Resolve returns Unknown if the recipient has no mailbox
+	Resolve func(rcpt *mail.Address) error
+	// Deliver writes a copy of the message to the mailbox of the recipient, see Copy
+	Deliver func(e *envelope.Envelope, rcpt *mail.Address) error
+
+	// ReportingMTA is the name of this host used in bounces
+	ReportingMTA string
+	// Bounce sends a DSN to the sender, e.g. by queueing it in a spool. Without it, the recipients that failed
+	// while others were delivered to are only logged
+	Bounce func(dsn *envelope.Envelope) error
+}
+
+// Hooks rejects recipients without a mailbox in RCPT
+func (a *Agent) Hooks() smtpx.Hooks {
+	return smtpx.Hooks{
+		Rcpt: func(e *envelope.Envelope, rcpt *mail.Address) smtpx.Response {
+			err := a.Resolve(rcpt)
+			if errors.Is(err, a.Unknown) {
+				return noSuchUser()
+			}
+			if err != nil {
+				a.log(a.Name+", could not resolve mailbox", "rcpt", rcpt.Address, "err", err)
+				return responses.New(451).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+					Line("Could not look up mailbox, try again later")
+			}
+			return nil
+		},
+	}
+}
+
+// Handler returns a smtpx.Handler that delivers a copy of the message to the mailbox of each recipient.
+//
+// Recipients without a mailbox are skipped, and should be rejected in RCPT by Hooks. If no copy was written,
+// a 550 is returned if no recipient has a mailbox, and a 451 otherwise, e.g. on disk errors, so that the
+// client retries. Once a copy was written the message is accepted, since a retry would duplicate it, and the
+// recipients that failed are bounced to the sender instead
+func (a *Agent) Handler() smtpx.Handler {
+	return smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+		report := envelope.Report{
+			ReportingMTA: a.ReportingMTA,
+			Arrival:      time.Now(),
+		}
+		delivered, temporary := 0, false
+		for _, rcpt := range e.RcptTo {
+			err := a.Deliver(e, rcpt)
+			var res smtpx.Response
+			switch {
+			case err == nil:
+				delivered++
+				continue
+			case errors.Is(err, a.Unknown):
+				a.log(a.Name+", unknown mailbox", "rcpt", rcpt.Address)
+				res = noSuchUser()
+			default:
+				a.log(a.Name+", delivery failed", "rcpt", rcpt.Address, "err", err)
+				res = tryLater()
+				temporary = true
+			}
+			report.Recipients = append(report.Recipients, envelope.RecipientStatus{
+				Recipient:   rcpt.Address,
+				Action:      envelope.DSNActionFailed,
+				Diagnostic:  res.String(),
+				LastAttempt: report.Arrival,
+			})
+		}
+
+		switch {
+		case delivered > 0:
+			a.bounce(e, report)
+			return nil
+		case temporary:
+			return tryLater()
+		}
+		return noSuchUser()
+	})
+}
+
+// bounce sends a DSN of the recipients in the report to the sender of the envelope
+func (a *Agent) bounce(e *envelope.Envelope, report envelope.Report) {
+	if len(report.Recipients) == 0 {
+		return
+	}
+	if a.Bounce == nil {
+		a.log(a.Name+", could not bounce, no bounce configured", "recipients", len(report.Recipients))
+		return
+	}
+	b, err := e.Bounce(report)
+	if errors.Is(err, envelope.ErrNullSender) || errors.Is(err, envelope.ErrNoNotification) {
+		return
+	}
+	if err == nil {
+		err = a.Bounce(b)
+	}
+	if err != nil {
+		a.log(a.Name+", could not bounce", "err", err)
+	}
+}
+
+// Copy calls write with a copy of the envelope for the single recipient rcpt, with Return-Path and Delivered-To
+// headers added to the message, and returns the error of write
+func Copy(e *envelope.Envelope, rcpt *mail.Address, write func(e *envelope.Envelope) error) error {
+	copied := *e
+	copied.RcptTo = []*mail.Address{rcpt}
+	copied.Data = &envelope.Data{}
+	_, _ = copied.Data.Write(e.Data.Bytes())
+	if copied.MailFrom == nil {
+		copied.MailFrom = &mail.Address{}
+	}
+
+	var err error
+	handler := func(e *envelope.Envelope) smtpx.Response {
+		err = write(e)
+		return nil
+	}
+	middleware.AddDeliveredHeaders()(middleware.AddReturnPath(handler))(&copied)
+	return err
+}
+
+func noSuchUser() smtpx.Response {
+	return responses.New(550).Enhanced(responses.BadDestinationMailboxAddress).Line("No such user here")
+}
+
+func tryLater() smtpx.Response {
+	return responses.New(451).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+		Line("Could not deliver message, try again later")
+}
+
+func (a *Agent) log(msg string, args ...any) {
+	if a.Logger != nil {
+		a.Logger.Debug(msg, args...)
+	}
+}
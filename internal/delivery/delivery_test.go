@@ -0,0 +1,107 @@
+package delivery
+
+import (
+	"errors"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/mail"
+	"testing"
+)
+
+var errUnknown = errors.New("unknown mailbox")
+
+func newEnvelope(to ...string) *envelope.Envelope {
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+	for _, rcpt := range to {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Address: rcpt})
+	}
+	_, _ = e.Data.WriteString("Subject: Hello\r\n\r\nThe body\r\n")
+	return e
+}
+
+func TestAgent(t *testing.T) {
+	var written []string
+	var bounces []*envelope.Envelope
+	agent := &Agent{
+		Unknown: errUnknown,
+		Resolve: func(rcpt *mail.Address) error {
+			if rcpt.Address == "unknown@example.com" {
+				return errUnknown
+			}
+			return nil
+		},
+		Deliver: func(e *envelope.Envelope, rcpt *mail.Address) error {
+			switch rcpt.Address {
+			case "unknown@example.com":
+				return errUnknown
+			case "full@example.com":
+				return errors.New("disk full")
+			}
+			return Copy(e, rcpt, func(e *envelope.Envelope) error {
+				written = append(written, string(e.Data.Bytes()))
+				return nil
+			})
+		},
+		ReportingMTA: "mx.example.com",
+		Bounce: func(dsn *envelope.Envelope) error {
+			bounces = append(bounces, dsn)
+			return nil
+		},
+	}
+	reset := func() {
+		written, bounces = nil, nil
+	}
+
+	t.Run("Hooks", func(t *testing.T) {
+		res := agent.Hooks().Rcpt(nil, &mail.Address{Address: "unknown@example.com"})
+		require.NotNil(t, res)
+		assert.Equal(t, 550, res.StatusCode())
+		assert.Nil(t, agent.Hooks().Rcpt(nil, &mail.Address{Address: "alice@example.com"}))
+	})
+
+	t.Run("Delivered", func(t *testing.T) {
+		reset()
+		assert.Nil(t, agent.Handler().Data(newEnvelope("alice@example.com")))
+		require.Len(t, written, 1)
+		assert.Equal(t, "Return-Path: <sender@example.com>\r\nDelivered-To: alice@example.com\r\n"+
+			"Subject: Hello\r\n\r\nThe body\r\n", written[0])
+		assert.Empty(t, bounces)
+	})
+
+	t.Run("Partial", func(t *testing.T) {
+		// a retry would write the message again for alice, so it is accepted and the others are bounced
+		reset()
+		assert.Nil(t, agent.Handler().Data(newEnvelope("alice@example.com", "full@example.com", "unknown@example.com")))
+		assert.Len(t, written, 1)
+		require.Len(t, bounces, 1)
+		assert.Equal(t, "sender@example.com", bounces[0].RcptTo[0].Address)
+
+		m, err := bounces[0].Mail()
+		require.NoError(t, err)
+		report, err := m.DeliveryReport()
+		require.NoError(t, err)
+		require.Len(t, report.Recipients, 2)
+		assert.Equal(t, "full@example.com", report.Recipients[0].Recipient)
+		assert.Equal(t, envelope.DSNActionFailed, report.Recipients[0].Action)
+		assert.Equal(t, "unknown@example.com", report.Recipients[1].Recipient)
+		assert.Contains(t, report.Recipients[1].Diagnostic, "No such user here")
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		reset()
+		res := agent.Handler().Data(newEnvelope("full@example.com", "unknown@example.com"))
+		require.NotNil(t, res)
+		assert.Equal(t, 451, res.StatusCode())
+		assert.Empty(t, bounces)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		reset()
+		res := agent.Handler().Data(newEnvelope("unknown@example.com"))
+		require.NotNil(t, res)
+		assert.Equal(t, 550, res.StatusCode())
+		assert.Empty(t, bounces)
+	})
+}
@@ -0,0 +1,271 @@
+// Package maildir delivers mail into Maildir directories.
+//
+// Each recipient is mapped to a Mailbox by a Resolver, i.e. the root of a Maildir and an optional Maildir++
+// folder. A message is written to tmp/, synced, and then renamed into new/ so that readers never see a partial
+// message. Return-Path and Delivered-To headers are added to each copy using the middlewares of this module.
+//
+// Example usage:
+//
+//	md := maildir.New(maildir.Virtual("/var/mail"))
+//	server.Hook(md.Hooks())
+//	server.Handler = md.Handler()
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/internal/delivery"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnknownMailbox is returned by a Resolver for recipients without a mailbox
+var ErrUnknownMailbox = errors.New("maildir: unknown mailbox")
+
+// Mailbox is where the mail of a recipient is delivered
+type Mailbox struct {
+	// Root is the directory of the Maildir, i.e. the one holding tmp, new and cur
+	Root string
+	// Folder is an optional Maildir++ folder, e.g. "Lists.Go" is delivered to Root/.Lists.Go
+	Folder string
+}
+
+// Dir returns the directory that the mail is delivered to
+func (m Mailbox) Dir() string {
+	if m.Folder == "" {
+		return m.Root
+	}
+	return filepath.Join(m.Root, "."+m.Folder)
+}
+
+// Resolver maps a recipient to its mailbox, returning ErrUnknownMailbox if it has none
+type Resolver func(rcpt *mail.Address) (Mailbox, error)
+
+// Virtual returns a resolver that maps user@example.com to base/example.com/user. A sub-address,
+// e.g. user+lists@example.com, is delivered to the Maildir++ folder "lists" of the user.
+// Only recipients with an existing Maildir are resolved, others are ErrUnknownMailbox
+func Virtual(base string) Resolver {
+	return func(rcpt *mail.Address) (Mailbox, error) {
+		local, domain, found := strings.Cut(strings.ToLower(rcpt.Address), "@")
+		if !found {
+			return Mailbox{}, ErrUnknownMailbox
+		}
+		local, detail, _ := strings.Cut(local, "+")
+		if !validName(local) || !validName(domain) || (detail != "" && !validName(detail)) {
+			return Mailbox{}, ErrUnknownMailbox
+		}
+
+		root := filepath.Join(base, domain, local)
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return Mailbox{}, ErrUnknownMailbox
+		}
+		return Mailbox{Root: root, Folder: detail}, nil
+	}
+}
+
+// validName returns true for names that are safe as a path element
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00") &&
+		!strings.HasPrefix(name, ".")
+}
+
+type Settings struct {
+	Logger *slog.Logger
+
+	// Hostname is used in the unique file names, defaults to os.Hostname()
+	Hostname string
+	// Perm is the permission of created directories, files are created without the execute bits
+	Perm os.FileMode
+
+	// ReportingMTA and Bounce send a DSN of the recipients that failed while others were delivered to
+	ReportingMTA string
+	Bounce       func(dsn *envelope.Envelope) error
+}
+
+type Option func(*Settings)
+
+// WithLogger logs deliveries and errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithHostname sets the name used in the unique file names, defaults to os.Hostname()
+func WithHostname(hostname string) Option {
+	return func(s *Settings) {
+		s.Hostname = hostname
+	}
+}
+
+// WithPerm sets the permission of created directories, defaults to 0700
+func WithPerm(perm os.FileMode) Option {
+	return func(s *Settings) {
+		s.Perm = perm
+	}
+}
+
+// WithBounce sends a DSN with bounce, e.g. by queueing it in a spool, for the recipients that could not be
+// delivered to while others were. reportingMTA is the name of this host used in the DSN
+func WithBounce(reportingMTA string, bounce func(dsn *envelope.Envelope) error) Option {
+	return func(s *Settings) {
+		s.ReportingMTA = reportingMTA
+		s.Bounce = bounce
+	}
+}
+
+type Maildir struct {
+	resolver Resolver
+	settings *Settings
+	agent    *delivery.Agent
+}
+
+func New(resolver Resolver, opts ...Option) *Maildir {
+	settings := &Settings{
+		Perm: 0o700,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	if settings.Hostname == "" {
+		settings.Hostname, _ = os.Hostname()
+	}
+	m := &Maildir{resolver: resolver, settings: settings}
+	m.agent = &delivery.Agent{
+		Name:    "maildir",
+		Logger:  settings.Logger,
+		Unknown: ErrUnknownMailbox,
+		Resolve: func(rcpt *mail.Address) error {
+			_, err := resolver(rcpt)
+			return err
+		},
+		Deliver: func(e *envelope.Envelope, rcpt *mail.Address) error {
+			_, err := m.Deliver(e, rcpt)
+			return err
+		},
+		ReportingMTA: settings.ReportingMTA,
+		Bounce:       settings.Bounce,
+	}
+	return m
+}
+
+// Hooks rejects recipients without a mailbox in RCPT
+func (m *Maildir) Hooks() smtpx.Hooks {
+	return m.agent.Hooks()
+}
+
+// Handler returns a smtpx.Handler that delivers a copy of the message to the mailbox of each recipient.
+//
+// Recipients without a mailbox are skipped, and should be rejected in RCPT by Hooks. A 451 is returned if no
+// copy could be written, e.g. on disk errors. Once a copy was written the message is accepted, and the
+// recipients that failed are bounced to the sender, see WithBounce
+func (m *Maildir) Handler() smtpx.Handler {
+	return m.agent.Handler()
+}
+
+// Deliver writes a copy of the message to the mailbox of the recipient, with Return-Path and Delivered-To
+// headers, returning the path of the file in new/
+func (m *Maildir) Deliver(e *envelope.Envelope, rcpt *mail.Address) (string, error) {
+	mailbox, err := m.resolver(rcpt)
+	if err != nil {
+		return "", err
+	}
+
+	var path string
+	err = delivery.Copy(e, rcpt, func(e *envelope.Envelope) error {
+		path, err = m.write(mailbox, e.Data.Bytes())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	m.log("maildir, delivered", "rcpt", rcpt.Address, "path", path)
+	return path, nil
+}
+
+// write writes the message to tmp/ and renames it into new/, creating the Maildir if needed
+func (m *Maildir) write(mailbox Mailbox, data []byte) (string, error) {
+	dir := mailbox.Dir()
+	err := m.create(mailbox)
+	if err != nil {
+		return "", err
+	}
+
+	// Maildir messages are stored with unix line endings
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+
+	name := m.uniqueName()
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, m.settings.Perm&0o666)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	// the Maildir++ size lets readers compute quotas without stat
+	path := filepath.Join(dir, "new", fmt.Sprintf("%s,S=%d", name, len(data)))
+	err = os.Rename(tmp, path)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// create creates tmp, new and cur of the mailbox, and marks Maildir++ folders with a maildirfolder file
+func (m *Maildir) create(mailbox Mailbox) error {
+	if mailbox.Folder != "" && !validName(mailbox.Folder) {
+		return fmt.Errorf("maildir: invalid folder %q", mailbox.Folder)
+	}
+	dir := mailbox.Dir()
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), m.settings.Perm); err != nil {
+			return err
+		}
+	}
+	if mailbox.Folder == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "maildirfolder"), os.O_WRONLY|os.O_CREATE, m.settings.Perm&0o666)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+var deliveries atomic.Uint64
+
+// uniqueName returns a file name that is unique on this host, e.g. 1700000000.M123456P42Q7.host.example.com
+// (https://cr.yp.to/proto/maildir.html)
+func (m *Maildir) uniqueName() string {
+	now := time.Now()
+	host := strings.NewReplacer("/", `\057`, ":", `\072`).Replace(m.settings.Hostname)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), deliveries.Add(1), host)
+}
+
+func (m *Maildir) log(msg string, args ...any) {
+	if m.settings.Logger != nil {
+		m.settings.Logger.Debug(msg, args...)
+	}
+}
@@ -0,0 +1,137 @@
+package maildir
+
+import (
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newEnvelope(to ...string) *envelope.Envelope {
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+	for _, rcpt := range to {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Address: rcpt})
+	}
+	_, _ = e.Data.WriteString("Subject: Hello\r\n\r\nThe body\r\n")
+	return e
+}
+
+// messages returns the contents of the files in new/ of dir
+func messages(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	var contents []string
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, "new", entry.Name()))
+		require.NoError(t, err)
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestMaildir(t *testing.T) {
+	base := t.TempDir()
+	for _, user := range []string{"alice", "bob"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(base, "example.com", user), 0o700))
+	}
+	md := New(Virtual(base), WithHostname("mx/1:25"))
+
+	t.Run("Deliver", func(t *testing.T) {
+		res := md.Handler().Data(newEnvelope("alice@example.com", "bob@example.com"))
+		assert.Nil(t, res)
+
+		for _, user := range []string{"alice", "bob"} {
+			dir := filepath.Join(base, "example.com", user)
+			contents := messages(t, dir)
+			require.Len(t, contents, 1)
+			assert.Equal(t, "Return-Path: <sender@example.com>\n"+
+				"Delivered-To: "+user+"@example.com\n"+
+				"Subject: Hello\n\nThe body\n", contents[0])
+
+			for _, sub := range []string{"tmp", "cur"} {
+				entries, err := os.ReadDir(filepath.Join(dir, sub))
+				require.NoError(t, err)
+				assert.Empty(t, entries)
+			}
+		}
+	})
+
+	t.Run("UniqueName", func(t *testing.T) {
+		path, err := md.Deliver(newEnvelope(), &mail.Address{Address: "alice@example.com"})
+		require.NoError(t, err)
+		name := filepath.Base(path)
+		assert.Contains(t, name, `.mx\0571\07225,S=`, "the hostname is escaped, and the size is added")
+
+		other, err := md.Deliver(newEnvelope(), &mail.Address{Address: "alice@example.com"})
+		require.NoError(t, err)
+		assert.NotEqual(t, path, other)
+	})
+
+	t.Run("Folder", func(t *testing.T) {
+		res := md.Handler().Data(newEnvelope("alice+lists.go@example.com"))
+		assert.Nil(t, res)
+
+		dir := filepath.Join(base, "example.com", "alice", ".lists.go")
+		assert.Len(t, messages(t, dir), 1)
+		_, err := os.Stat(filepath.Join(dir, "maildirfolder"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("UnknownMailbox", func(t *testing.T) {
+		hooks := md.Hooks()
+		for _, rcpt := range []string{"carol@example.com", "../alice@example.com", "alice@example.org", "alice+..@example.com"} {
+			res := hooks.Rcpt(nil, &mail.Address{Address: rcpt})
+			require.NotNil(t, res, rcpt)
+			assert.Equal(t, 550, res.StatusCode(), rcpt)
+		}
+		assert.Nil(t, hooks.Rcpt(nil, &mail.Address{Address: "alice@example.com"}))
+
+		res := md.Handler().Data(newEnvelope("carol@example.com"))
+		require.NotNil(t, res)
+		assert.Equal(t, 550, res.StatusCode())
+	})
+
+	t.Run("DiskError", func(t *testing.T) {
+		broken := New(func(rcpt *mail.Address) (Mailbox, error) {
+			// a file where the Maildir should be
+			root := filepath.Join(base, "file")
+			return Mailbox{Root: root}, os.WriteFile(root, nil, 0o600)
+		})
+		res := broken.Handler().Data(newEnvelope("alice@example.com"))
+		require.NotNil(t, res)
+		assert.Equal(t, 451, res.StatusCode())
+	})
+
+	t.Run("PartialFailure", func(t *testing.T) {
+		file := filepath.Join(base, "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o600))
+		var bounces []*envelope.Envelope
+		partial := New(func(rcpt *mail.Address) (Mailbox, error) {
+			if rcpt.Address == "bob@example.com" {
+				return Mailbox{Root: file}, nil
+			}
+			return Virtual(base)(rcpt)
+		}, WithBounce("mx.example.com", func(dsn *envelope.Envelope) error {
+			bounces = append(bounces, dsn)
+			return nil
+		}))
+
+		alice := filepath.Join(base, "example.com", "alice")
+		before := len(messages(t, alice))
+		res := partial.Handler().Data(newEnvelope("alice@example.com", "bob@example.com"))
+		assert.Nil(t, res, "a retry would deliver the message to alice again")
+		assert.Len(t, messages(t, alice), before+1)
+
+		require.Len(t, bounces, 1)
+		m, err := bounces[0].Mail()
+		require.NoError(t, err)
+		report, err := m.DeliveryReport()
+		require.NoError(t, err)
+		require.Len(t, report.Recipients, 1)
+		assert.Equal(t, "bob@example.com", report.Recipients[0].Recipient)
+	})
+}
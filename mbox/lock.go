@@ -0,0 +1,64 @@
+package mbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrLockTimeout is returned when the lock of a mbox file could not be taken in time
+var ErrLockTimeout = errors.New("mbox: timeout waiting for lock")
+
+// staleLock is the age of a dotlock that is considered left by a crashed process
+const staleLock = 5 * time.Minute
+
+const lockRetry = 100 * time.Millisecond
+
+// lock locks the mbox file with a dotlock, i.e. path.lock, and then with fcntl where supported.
+// The returned function releases both locks
+func lock(f *os.File, path string, timeout time.Duration) (func(), error) {
+	deadline := time.Now().Add(timeout)
+	unlockDot, err := dotlock(path, deadline)
+	if err != nil {
+		return nil, err
+	}
+	unlockFcntl, err := fcntlLock(f, deadline)
+	if err != nil {
+		unlockDot()
+		return nil, err
+	}
+	return func() {
+		unlockFcntl()
+		unlockDot()
+	}, nil
+}
+
+// dotlock creates path.lock exclusively, waiting for it to be removed by others. A directory that does not allow
+// us to create the lock file, e.g. a /var/mail without group write, only relies on fcntl
+func dotlock(path string, deadline time.Time) (func(), error) {
+	name := path + ".lock"
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			_ = f.Close()
+			return func() { _ = os.Remove(name) }, nil
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return func() {}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > staleLock {
+			_ = os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(lockRetry)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package mbox
+
+import (
+	"os"
+	"time"
+)
+
+// fcntlLock is not supported on this platform, only the dotlock is used
+func fcntlLock(_ *os.File, _ time.Time) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package mbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fcntlLock takes a write lock on the whole file with fcntl, waiting until the deadline
+func fcntlLock(f *os.File, deadline time.Time) (func(), error) {
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+		if err == nil {
+			return func() {
+				lk.Type = syscall.F_UNLCK
+				_ = syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+			}, nil
+		}
+		if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.EACCES) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(lockRetry)
+	}
+}
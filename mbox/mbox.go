@@ -0,0 +1,261 @@
+// Package mbox appends mail to mbox files, and reads them back.
+//
+// Two variants are supported. In mboxrd, lines of the message that match ^>*From  are quoted with one more >,
+// which is reversed when read. In mboxcl2 the lines are left as is, and a Content-Length header tells the length
+// of the body. Files are locked with both fcntl and a dotlock while appended to, like most MDAs and mail readers.
+//
+// Example usage:
+//
+//	mb := mbox.New(mbox.Virtual("/var/mail"), mbox.WithFormat(mbox.Mboxrd))
+//	server.Hook(mb.Hooks())
+//	server.Handler = mb.Handler()
+package mbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/internal/delivery"
+	"log/slog"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Format is the mbox variant
+type Format int
+
+const (
+	// Mboxrd quotes lines matching ^>*From  with a >, and unquotes them when read
+	Mboxrd Format = iota
+	// Mboxcl2 leaves lines as is, and adds a Content-Length header with the length of the body
+	Mboxcl2
+)
+
+const defaultLockTimeout = 30 * time.Second
+
+// fromTime is the asctime format of the From  line
+const fromTime = "Mon Jan _2 15:04:05 2006"
+
+// ErrUnknownMailbox is returned by a Resolver for recipients without a mailbox
+var ErrUnknownMailbox = errors.New("mbox: unknown mailbox")
+
+// Resolver maps a recipient to the path of its mbox file, returning ErrUnknownMailbox if it has none
+type Resolver func(rcpt *mail.Address) (string, error)
+
+// Virtual returns a resolver that maps user@example.com to the file base/example.com/user.
+// Only recipients with an existing file are resolved, others are ErrUnknownMailbox
+func Virtual(base string) Resolver {
+	return func(rcpt *mail.Address) (string, error) {
+		local, domain, found := strings.Cut(strings.ToLower(rcpt.Address), "@")
+		if !found || !validName(local) || !validName(domain) {
+			return "", ErrUnknownMailbox
+		}
+		path := filepath.Join(base, domain, local)
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			return "", ErrUnknownMailbox
+		}
+		return path, nil
+	}
+}
+
+// validName returns true for names that are safe as a path element
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\\x00") && !strings.HasPrefix(name, ".")
+}
+
+type Settings struct {
+	Logger *slog.Logger
+	Format Format
+
+	// LockTimeout is how long to wait for the lock of a mbox file
+	LockTimeout time.Duration
+	// Perm of created mbox files
+	Perm os.FileMode
+
+	// ReportingMTA and Bounce send a DSN of the recipients that failed while others were delivered to
+	ReportingMTA string
+	Bounce       func(dsn *envelope.Envelope) error
+}
+
+type Option func(*Settings)
+
+// WithLogger logs deliveries and errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithFormat sets the mbox variant, defaults to Mboxrd
+func WithFormat(format Format) Option {
+	return func(s *Settings) {
+		s.Format = format
+	}
+}
+
+// WithLockTimeout sets how long to wait for the lock of a mbox file, defaults to 30 seconds
+func WithLockTimeout(d time.Duration) Option {
+	return func(s *Settings) {
+		s.LockTimeout = d
+	}
+}
+
+// WithPerm sets the permission of created mbox files, defaults to 0600
+func WithPerm(perm os.FileMode) Option {
+	return func(s *Settings) {
+		s.Perm = perm
+	}
+}
+
+// WithBounce sends a DSN with bounce, e.g. by queueing it in a spool, for the recipients that could not be
+// delivered to while others were. reportingMTA is the name of this host used in the DSN
+func WithBounce(reportingMTA string, bounce func(dsn *envelope.Envelope) error) Option {
+	return func(s *Settings) {
+		s.ReportingMTA = reportingMTA
+		s.Bounce = bounce
+	}
+}
+
+type Mbox struct {
+	resolver Resolver
+	settings *Settings
+	agent    *delivery.Agent
+}
+
+func New(resolver Resolver, opts ...Option) *Mbox {
+	settings := &Settings{
+		Format:      Mboxrd,
+		LockTimeout: defaultLockTimeout,
+		Perm:        0o600,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	m := &Mbox{resolver: resolver, settings: settings}
+	m.agent = &delivery.Agent{
+		Name:    "mbox",
+		Logger:  settings.Logger,
+		Unknown: ErrUnknownMailbox,
+		Resolve: func(rcpt *mail.Address) error {
+			_, err := resolver(rcpt)
+			return err
+		},
+		Deliver:      m.Deliver,
+		ReportingMTA: settings.ReportingMTA,
+		Bounce:       settings.Bounce,
+	}
+	return m
+}
+
+// Hooks rejects recipients without a mailbox in RCPT
+func (m *Mbox) Hooks() smtpx.Hooks {
+	return m.agent.Hooks()
+}
+
+// Handler returns a smtpx.Handler that appends a copy of the message to the mbox of each recipient.
+//
+// Recipients without a mailbox are skipped, and should be rejected in RCPT by Hooks. A 451 is returned if no
+// copy could be appended, e.g. on disk errors or lock timeouts. Once a copy was appended the message is
+// accepted, and the recipients that failed are bounced to the sender, see WithBounce
+func (m *Mbox) Handler() smtpx.Handler {
+	return m.agent.Handler()
+}
+
+// Deliver appends a copy of the message to the mbox of the recipient, with Return-Path and Delivered-To headers
+func (m *Mbox) Deliver(e *envelope.Envelope, rcpt *mail.Address) error {
+	path, err := m.resolver(rcpt)
+	if err != nil {
+		return err
+	}
+
+	err = delivery.Copy(e, rcpt, func(e *envelope.Envelope) error {
+		return m.Append(path, e.MailFrom.Address, time.Now(), e.Data.Bytes())
+	})
+	if err != nil {
+		return err
+	}
+	m.log("mbox, delivered", "rcpt", rcpt.Address, "path", path)
+	return nil
+}
+
+// Append appends the message to the mbox file at path, creating it if needed. The file is locked while appended
+// to, and truncated to its former size if the write fails
+func (m *Mbox) Append(path string, sender string, received time.Time, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, m.settings.Perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	unlock, err := lock(f, path, m.settings.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(Encode(m.settings.Format, sender, received, data))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Truncate(info.Size())
+		return err
+	}
+	return nil
+}
+
+var (
+	fromLine      = regexp.MustCompile(`(?m)^(>*From )`)
+	contentLength = regexp.MustCompile(`(?im)^Content-Length:.*\n`)
+)
+
+// Encode returns the message as a mbox entry, i.e. a From  line, the message in the format, and a blank line
+func Encode(format Format, sender string, received time.Time, data []byte) []byte {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+
+	var b bytes.Buffer
+	b.WriteString(fmt.Sprintf("From %s %s\n", sender, received.UTC().Format(fromTime)))
+
+	switch format {
+	case Mboxcl2:
+		header, body, found := bytes.Cut(data, []byte("\n\n"))
+		if !found {
+			header, body = bytes.TrimSuffix(data, []byte("\n")), nil
+		}
+		header = contentLength.ReplaceAll(append(header, '\n'), nil)
+		b.Write(header)
+		b.WriteString(fmt.Sprintf("Content-Length: %d\n\n", len(body)))
+		b.Write(body)
+	default:
+		b.Write(fromLine.ReplaceAll(data, []byte(">$1")))
+	}
+
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+func (m *Mbox) log(msg string, args ...any) {
+	if m.settings.Logger != nil {
+		m.settings.Logger.Debug(msg, args...)
+	}
+}
@@ -0,0 +1,139 @@
+package mbox
+
+import (
+	"errors"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var received = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+const message = "Subject: Hello\r\n" +
+	"\r\n" +
+	"From the start\r\n" +
+	">From quoted\r\n" +
+	"\r\n" +
+	"From here\r\n"
+
+func TestEncode(t *testing.T) {
+	t.Run("Mboxrd", func(t *testing.T) {
+		assert.Equal(t, "From sender@example.com Tue Jan  2 03:04:05 2024\n"+
+			"Subject: Hello\n"+
+			"\n"+
+			">From the start\n"+
+			">>From quoted\n"+
+			"\n"+
+			">From here\n"+
+			"\n", string(Encode(Mboxrd, "sender@example.com", received, []byte(message))))
+	})
+
+	t.Run("Mboxcl2", func(t *testing.T) {
+		assert.Equal(t, "From MAILER-DAEMON Tue Jan  2 03:04:05 2024\n"+
+			"Subject: Hello\n"+
+			"Content-Length: 39\n"+
+			"\n"+
+			"From the start\n"+
+			">From quoted\n"+
+			"\n"+
+			"From here\n"+
+			"\n", string(Encode(Mboxcl2, "", received, []byte("Subject: Hello\nContent-Length: 1\n\n"+
+			"From the start\n>From quoted\n\nFrom here\n"))))
+	})
+}
+
+func TestReader(t *testing.T) {
+	for _, format := range []Format{Mboxrd, Mboxcl2} {
+		path := filepath.Join(t.TempDir(), "mbox")
+		mb := New(nil, WithFormat(format))
+		require.NoError(t, mb.Append(path, "sender@example.com", received, []byte(message)))
+		require.NoError(t, mb.Append(path, "", received, []byte("Delivered-To: to@example.com\n\nSecond\n")))
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		r := NewReader(f, format)
+
+		m, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "sender@example.com", r.Sender())
+		assert.Equal(t, received, r.Received())
+		assert.Equal(t, "Subject: Hello\n", string(m.RawHeaders[:15]))
+		assert.True(t, strings.HasSuffix(string(m.RawBody), "From the start\n>From quoted\n\nFrom here\n"),
+			"%d %q", format, m.RawBody)
+
+		e, err := r.NextEnvelope()
+		require.NoError(t, err)
+		assert.Equal(t, "", e.MailFrom.Address)
+		require.Len(t, e.RcptTo, 1)
+		assert.Equal(t, "to@example.com", e.RcptTo[0].Address)
+		assert.True(t, strings.HasSuffix(e.Data.String(), "\n\nSecond\n"), "%d %q", format, e.Data.String())
+
+		_, err = r.Next()
+		assert.True(t, errors.Is(err, io.EOF))
+		_ = f.Close()
+	}
+
+	t.Run("UnreliableContentLength", func(t *testing.T) {
+		data := "From a@example.com Tue Jan  2 03:04:05 2024\n" +
+			"Content-Length: 3\n" +
+			"\n" +
+			"First message\n" +
+			"\n" +
+			"From b@example.com Tue Jan  2 03:04:05 2024\n" +
+			"Subject: second\n" +
+			"\n" +
+			"Second\n"
+		r := NewReader(strings.NewReader(data), Mboxcl2)
+		m, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "First message\n", string(m.RawBody))
+		m, err = r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "b@example.com", r.Sender())
+		assert.Equal(t, "Second\n", string(m.RawBody))
+	})
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	require.NoError(t, os.WriteFile(path+".lock", nil, 0o600))
+
+	mb := New(nil, WithLockTimeout(200*time.Millisecond))
+	err := mb.Append(path, "sender@example.com", received, []byte(message))
+	assert.ErrorIs(t, err, ErrLockTimeout)
+
+	// a stale lock is removed
+	old := time.Now().Add(-staleLock - time.Minute)
+	require.NoError(t, os.Chtimes(path+".lock", old, old))
+	require.NoError(t, mb.Append(path, "sender@example.com", received, []byte(message)))
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err), "the lock is released")
+}
+
+func TestHandler(t *testing.T) {
+	base := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "example.com"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "example.com", "alice"), nil, 0o600))
+	mb := New(Virtual(base))
+
+	assert.Equal(t, 550, mb.Hooks().Rcpt(nil, &mail.Address{Address: "bob@example.com"}).StatusCode())
+	assert.Nil(t, mb.Hooks().Rcpt(nil, &mail.Address{Address: "alice@example.com"}))
+
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+	e.RcptTo = []*mail.Address{{Address: "alice@example.com"}}
+	_, _ = e.Data.WriteString(message)
+	assert.Nil(t, mb.Handler().Data(e))
+
+	b, err := os.ReadFile(filepath.Join(base, "example.com", "alice"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "From sender@example.com "))
+	assert.Contains(t, string(b), "\nReturn-Path: <sender@example.com>\nDelivered-To: alice@example.com\nSubject: Hello\n")
+}
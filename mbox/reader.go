@@ -0,0 +1,184 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/modfin/smtpx/envelope"
+	"io"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reader reads the messages of a mbox file
+//
+// Example usage, replaying an archive through a handler:
+//
+//	r := mbox.NewReader(f, mbox.Mboxrd)
+//	for {
+//		e, err := r.NextEnvelope()
+//		if errors.Is(err, io.EOF) {
+//			break
+//		}
+//		...
+//		handler(e)
+//	}
+type Reader struct {
+	r      *bufio.Reader
+	format Format
+
+	// next is the From  line of the next message, read while reading the previous one
+	next []byte
+	err  error
+
+	sender   string
+	received time.Time
+}
+
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{r: bufio.NewReader(r), format: format}
+}
+
+// Sender returns the sender in the From  line of the last message read
+func (r *Reader) Sender() string {
+	return r.sender
+}
+
+// Received returns the date in the From  line of the last message read, the zero time if it could not be parsed
+func (r *Reader) Received() time.Time {
+	return r.received
+}
+
+// Next returns the next message, or io.EOF when there are no more
+func (r *Reader) Next() (*envelope.Mail, error) {
+	data, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	return envelope.NewMail(data, false)
+}
+
+// NextEnvelope returns the next message as an envelope, e.g. to replay it through the middleware chain.
+// The sender is the one of the From  line, and the recipients are those of the Delivered-To headers
+func (r *Reader) NextEnvelope() (*envelope.Envelope, error) {
+	data, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{}
+	if r.sender != "MAILER-DAEMON" {
+		e.MailFrom.Address = r.sender
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		for _, rcpt := range msg.Header["Delivered-To"] {
+			e.RcptTo = append(e.RcptTo, &mail.Address{Address: strings.TrimSpace(rcpt)})
+		}
+	}
+	_, _ = e.Data.Write(data)
+	return e, nil
+}
+
+var quotedFrom = regexp.MustCompile(`(?m)^>(>*From )`)
+
+// read returns the next message, without its From  line and the blank line that ends it
+func (r *Reader) read() ([]byte, error) {
+	from := r.next
+	r.next = nil
+	for from == nil {
+		if r.err != nil {
+			return nil, r.err
+		}
+		var line []byte
+		line, r.err = r.r.ReadBytes('\n')
+		if bytes.HasPrefix(line, []byte("From ")) {
+			from = line
+		} else if len(bytes.TrimSpace(line)) > 0 {
+			return nil, errors.New("mbox: expected a From line")
+		}
+	}
+	r.parseFrom(from)
+
+	if r.format == Mboxcl2 {
+		return r.readContentLength(), nil
+	}
+	return quotedFrom.ReplaceAll(r.readUntilFrom(), []byte("$1")), nil
+}
+
+// readUntilFrom reads until the next From  line that follows a blank line, which is kept for the next message
+func (r *Reader) readUntilFrom() []byte {
+	var data []byte
+	blank := false
+	for r.err == nil {
+		var line []byte
+		line, r.err = r.r.ReadBytes('\n')
+		if blank && bytes.HasPrefix(line, []byte("From ")) {
+			r.next = line
+			break
+		}
+		data = append(data, line...)
+		blank = bytes.Equal(line, []byte("\n")) || bytes.Equal(line, []byte("\r\n"))
+	}
+	// the blank line separates the messages
+	return trimSeparator(data)
+}
+
+// readContentLength reads the headers and a body of the length in Content-Length. If the header is missing, or
+// the body is not followed by the next From  line or the end of the file, the From  lines are used instead
+func (r *Reader) readContentLength() []byte {
+	var header []byte
+	length := -1
+	for r.err == nil {
+		var line []byte
+		line, r.err = r.r.ReadBytes('\n')
+		header = append(header, line...)
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if key, value, found := bytes.Cut(line, []byte(":")); found && strings.EqualFold(string(key), "Content-Length") {
+			length, _ = strconv.Atoi(string(bytes.TrimSpace(value)))
+		}
+	}
+
+	if length >= 0 && r.err == nil {
+		body := make([]byte, length)
+		n, err := io.ReadFull(r.r, body)
+		body = body[:n]
+		after, _ := r.r.Peek(len("\nFrom "))
+		if err == nil && (bytes.Equal(after, []byte("\nFrom ")) || len(after) == 0 || bytes.Equal(after, []byte("\n"))) {
+			return append(header, body...)
+		}
+		// the body is read again below
+		r.r = bufio.NewReader(io.MultiReader(bytes.NewReader(body), r.r))
+	}
+
+	// an unreliable Content-Length, fall back to the From  lines
+	rest := r.readUntilFrom()
+	return append(header, rest...)
+}
+
+func trimSeparator(data []byte) []byte {
+	if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		return data[:len(data)-2]
+	}
+	if bytes.HasSuffix(data, []byte("\n\n")) {
+		return data[:len(data)-1]
+	}
+	return data
+}
+
+// parseFrom parses a From  line, e.g. From sender@example.com Mon Jan  2 15:04:05 2006
+func (r *Reader) parseFrom(line []byte) {
+	fields := strings.Fields(string(line))
+	r.sender, r.received = "", time.Time{}
+	if len(fields) < 2 {
+		return
+	}
+	r.sender = fields[1]
+	if len(fields) >= 7 {
+		r.received, _ = time.Parse(fromTime, strings.Join(fields[2:7], " "))
+	}
+}
@@ -249,10 +249,10 @@ func spfCheck(e *envelope.Envelope) *authres.SPFResult {
 	var reason string
 	var from = e.MailFrom.Address
 
-	ip, _, _ := strings.Cut(e.RemoteAddr.String(), ":")
+	ip := net.IP(e.ClientAddr().Addr().AsSlice())
 
 	result, err := spf.CheckHostWithSender(
-		net.ParseIP(ip),
+		ip,
 		e.Helo,
 		from,
 	)
@@ -0,0 +1,365 @@
+// Package dnsbl checks the connecting client against DNS blocklists (DNSBL/RBL), and the HELO name and
+// MAIL FROM domain against domain blocklists (RHSBL).
+//
+// Every listing adds the weight of its zone to a score. When the score reaches the threshold the client is
+// rejected, at connect for the ip zones and at MAIL FROM for all zones. The result can also be written to
+// a header by the AddHeader middleware.
+//
+// Example usage:
+//
+//	checker := dnsbl.New(
+//		dnsbl.WithZone(dnsbl.Zone{Name: "zen.spamhaus.org", Type: dnsbl.TypeIP, Weight: 2}),
+//		dnsbl.WithZone(dnsbl.Zone{Name: "dbl.spamhaus.org", Type: dnsbl.TypeSender, Weight: 1, Codes: []string{"127.0.1.2"}}),
+//		dnsbl.WithThreshold(2),
+//	)
+//	server.Hook(checker.Hooks())
+//	server.Use(checker.AddHeader())
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/utils"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultCacheTTL = 5 * time.Minute
+	defaultHeader   = "X-DNSBL"
+)
+
+// Resolver is the DNS resolver used for lookups, net.DefaultResolver satisfies it
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// ZoneType is what is looked up in a zone
+type ZoneType int
+
+const (
+	// TypeIP looks up the remote ip address, reversed, e.g. 2.0.0.127.zen.spamhaus.org
+	TypeIP ZoneType = iota
+	// TypeHelo looks up the name given in HELO/EHLO, e.g. mail.example.com.dbl.spamhaus.org
+	TypeHelo
+	// TypeSender looks up the domain given in MAIL FROM, e.g. example.com.dbl.spamhaus.org
+	TypeSender
+)
+
+// Zone is a DNS blocklist
+type Zone struct {
+	// Name of the zone, e.g. zen.spamhaus.org
+	Name string
+	Type ZoneType
+	// Weight is added to the score when listed, defaults to 1
+	Weight float64
+	// Codes are the return codes, e.g. 127.0.0.2, that counts as a listing.
+	// If empty any 127.0.0.0/8 address counts, except 127.255.255.0/24 which is used for errors
+	Codes []string
+}
+
+// Listing is a hit in a zone
+type Listing struct {
+	Zone   string
+	Query  string
+	Codes  []string
+	Weight float64
+}
+
+// Result of a check
+type Result struct {
+	Score    float64
+	Listings []Listing
+}
+
+// String formats the result for a header, e.g. `score=2; zen.spamhaus.org=127.0.0.2,127.0.0.4`
+func (r Result) String() string {
+	s := fmt.Sprintf("score=%g", r.Score)
+	for _, l := range r.Listings {
+		s += fmt.Sprintf("; %s=%s", l.Zone, strings.Join(l.Codes, ","))
+	}
+	return s
+}
+
+type Settings struct {
+	Resolver Resolver
+	Logger   *slog.Logger
+	Zones    []Zone
+
+	// Threshold is the score at which the client is rejected, 0 never rejects
+	Threshold float64
+	// Timeout for the lookups of a check
+	Timeout time.Duration
+	// CacheTTL is how long a lookup is cached
+	CacheTTL time.Duration
+}
+
+type Option func(*Settings)
+
+// WithResolver sets the resolver used for lookups, defaults to net.DefaultResolver
+func WithResolver(r Resolver) Option {
+	return func(s *Settings) {
+		s.Resolver = r
+	}
+}
+
+// WithLogger logs listings and lookup errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithZone adds a zone to check
+func WithZone(zones ...Zone) Option {
+	return func(s *Settings) {
+		s.Zones = append(s.Zones, zones...)
+	}
+}
+
+// WithThreshold sets the score at which the client is rejected, defaults to 0, i.e. never reject
+func WithThreshold(score float64) Option {
+	return func(s *Settings) {
+		s.Threshold = score
+	}
+}
+
+// WithTimeout sets the timeout for the lookups of a check, defaults to 5 seconds
+func WithTimeout(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Timeout = d
+	}
+}
+
+// WithCacheTTL sets how long lookups are cached, defaults to 5 minutes
+func WithCacheTTL(d time.Duration) Option {
+	return func(s *Settings) {
+		s.CacheTTL = d
+	}
+}
+
+type cached struct {
+	addrs   []string
+	expires time.Time
+}
+
+type Checker struct {
+	settings *Settings
+
+	mu    sync.Mutex
+	cache map[string]cached
+	now   func() time.Time
+}
+
+func New(opts ...Option) *Checker {
+	settings := &Settings{
+		Resolver: net.DefaultResolver,
+		Timeout:  defaultTimeout,
+		CacheTTL: defaultCacheTTL,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	return &Checker{
+		settings: settings,
+		cache:    map[string]cached{},
+		now:      time.Now,
+	}
+}
+
+// Hooks returns the hooks that rejects listed clients, i.e. server.Hook(checker.Hooks())
+func (c *Checker) Hooks() smtpx.Hooks {
+	return smtpx.Hooks{
+		Connect: func(e *envelope.Envelope) smtpx.Response {
+			if c.settings.Threshold <= 0 {
+				return nil
+			}
+			res := c.Check(e.Context(), e, TypeIP)
+			if res.Score >= c.settings.Threshold {
+				c.log("dnsbl, client rejected", "result", res.String())
+				return responses.FailBlocklistedClient
+			}
+			return nil
+		},
+		Mail: func(e *envelope.Envelope) smtpx.Response {
+			if c.settings.Threshold <= 0 {
+				return nil
+			}
+			res := c.Check(e.Context(), e)
+			if res.Score >= c.settings.Threshold {
+				c.log("dnsbl, sender rejected", "result", res.String())
+				return responses.FailBlocklistedSender
+			}
+			return nil
+		},
+	}
+}
+
+// AddHeader prepends the result of the check as a X-DNSBL header
+func (c *Checker) AddHeader() smtpx.Middleware {
+	return func(next smtpx.HandlerFunc) smtpx.HandlerFunc {
+		return func(e *envelope.Envelope) smtpx.Response {
+			res := c.Check(e.Context(), e)
+			_ = e.PrependHeader(defaultHeader, res.String())
+			return next(e)
+		}
+	}
+}
+
+// Check looks up the envelope in the zones of the given types, or all zones if no type is given
+func (c *Checker) Check(ctx context.Context, e *envelope.Envelope, types ...ZoneType) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.settings.Timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var res Result
+
+	for _, zone := range c.settings.Zones {
+		if len(types) > 0 && !slices.Contains(types, zone.Type) {
+			continue
+		}
+		query := queryOf(e, zone)
+		if query == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(zone Zone, query string) {
+			defer wg.Done()
+			codes := c.lookup(ctx, query)
+			codes = matching(codes, zone.Codes)
+			if len(codes) == 0 {
+				return
+			}
+			weight := zone.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Score += weight
+			res.Listings = append(res.Listings, Listing{Zone: zone.Name, Query: query, Codes: codes, Weight: weight})
+		}(zone, query)
+	}
+	wg.Wait()
+
+	// keep the result in the order of the zones
+	slices.SortStableFunc(res.Listings, func(a, b Listing) int {
+		return c.zoneIndex(a.Zone) - c.zoneIndex(b.Zone)
+	})
+	return res
+}
+
+func (c *Checker) zoneIndex(name string) int {
+	return slices.IndexFunc(c.settings.Zones, func(z Zone) bool { return z.Name == name })
+}
+
+// lookup resolves query, using the cache. Not found is cached, other errors are not
+func (c *Checker) lookup(ctx context.Context, query string) []string {
+	c.mu.Lock()
+	hit, ok := c.cache[query]
+	c.mu.Unlock()
+	if ok && c.now().Before(hit.expires) {
+		return hit.addrs
+	}
+
+	addrs, err := c.settings.Resolver.LookupHost(ctx, query)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			c.log("dnsbl, lookup failed", "query", query, "err", err)
+			return nil
+		}
+		addrs = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.cache[query] = cached{addrs: addrs, expires: now.Add(c.settings.CacheTTL)}
+	for k, v := range c.cache {
+		if !now.Before(v.expires) {
+			delete(c.cache, k)
+		}
+	}
+	return addrs
+}
+
+func (c *Checker) log(msg string, args ...any) {
+	if c.settings.Logger != nil {
+		c.settings.Logger.Debug(msg, args...)
+	}
+}
+
+// matching returns the codes that are listings
+func matching(codes []string, accept []string) []string {
+	var res []string
+	for _, code := range codes {
+		if len(accept) > 0 {
+			if slices.Contains(accept, code) {
+				res = append(res, code)
+			}
+			continue
+		}
+		ip := net.ParseIP(code).To4()
+		if ip == nil || ip[0] != 127 || (ip[1] == 255 && ip[2] == 255) {
+			continue
+		}
+		res = append(res, code)
+	}
+	return res
+}
+
+// queryOf returns the name to look up in zone, or an empty string if there is nothing to look up
+func queryOf(e *envelope.Envelope, zone Zone) string {
+	var name string
+	switch zone.Type {
+	case TypeIP:
+		name = ReverseIP(e.ClientAddr().Addr())
+	case TypeHelo:
+		if e.HeloName.Type != envelope.HeloDomain || !e.HeloName.FQDN {
+			return ""
+		}
+		name = e.HeloName.Domain
+	case TypeSender:
+		name = utils.DomainOfEmail(e.MailFrom)
+	}
+	if name == "" {
+		return ""
+	}
+	return name + "." + strings.Trim(zone.Name, ".")
+}
+
+// ReverseIP returns the ip in the format used by DNSBLs. IPv4 addresses has its octets reversed,
+// e.g. 192.0.2.1 -> 1.2.0.192, and IPv6 addresses has its nibbles reversed, e.g.
+// 2001:db8::1 -> 1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2
+func ReverseIP(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		ip4 := addr.As4()
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := addr.As16()
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, 64)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		buf = append(buf, hex[ip16[i]&0x0f], '.', hex[ip16[i]>>4], '.')
+	}
+	return string(buf[:len(buf)-1])
+}
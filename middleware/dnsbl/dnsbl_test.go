@@ -0,0 +1,120 @@
+package dnsbl
+
+import (
+	"context"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/mail"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+type fakeResolver struct {
+	mu      sync.Mutex
+	records map[string][]string
+	queries []string
+}
+
+func (f *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, host)
+	addrs, ok := f.records[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func newEnvelope(ip string) *envelope.Envelope {
+	e := envelope.NewEnvelope(&net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}, 1)
+	e.Helo = "mail.example.com"
+	e.HeloName, _ = envelope.ParseHelo(e.Helo)
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+	return e
+}
+
+func TestReverseIP(t *testing.T) {
+	assert.Equal(t, "1.2.0.192", ReverseIP(netip.MustParseAddr("192.0.2.1")))
+	assert.Equal(t, "1.2.0.192", ReverseIP(netip.MustParseAddr("::ffff:192.0.2.1")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2", ReverseIP(netip.MustParseAddr("2001:db8::1")))
+	assert.Equal(t, "", ReverseIP(netip.Addr{}))
+}
+
+func TestCheck(t *testing.T) {
+	resolver := &fakeResolver{records: map[string][]string{
+		"1.2.0.192.ip.example.net":         {"127.0.0.2"},
+		"1.2.0.192.errors.example.net":     {"127.255.255.254"},
+		"mail.example.com.rhs.example.net": {"127.0.1.5"},
+		"example.com.rhs.example.net":      {"127.0.1.2"},
+	}}
+
+	checker := New(
+		WithResolver(resolver),
+		WithZone(
+			Zone{Name: "ip.example.net", Type: TypeIP, Weight: 2},
+			Zone{Name: "errors.example.net", Type: TypeIP},
+			Zone{Name: "rhs.example.net", Type: TypeHelo, Codes: []string{"127.0.1.2"}},
+			Zone{Name: "rhs.example.net", Type: TypeSender, Weight: 0.5, Codes: []string{"127.0.1.2"}},
+		),
+	)
+
+	res := checker.Check(context.Background(), newEnvelope("192.0.2.1"))
+	assert.Equal(t, 2.5, res.Score)
+	require.Len(t, res.Listings, 2)
+	assert.Equal(t, "ip.example.net", res.Listings[0].Zone)
+	assert.Equal(t, "example.com.rhs.example.net", res.Listings[1].Query)
+	assert.Equal(t, "score=2.5; ip.example.net=127.0.0.2; rhs.example.net=127.0.1.2", res.String())
+
+	res = checker.Check(context.Background(), newEnvelope("192.0.2.2"), TypeIP)
+	assert.Equal(t, 0.0, res.Score)
+
+	// cached lookups
+	n := len(resolver.queries)
+	checker.Check(context.Background(), newEnvelope("192.0.2.1"))
+	assert.Equal(t, n, len(resolver.queries))
+}
+
+func TestHooks(t *testing.T) {
+	resolver := &fakeResolver{records: map[string][]string{
+		"1.2.0.192.ip.example.net":    {"127.0.0.2"},
+		"example.com.rhs.example.net": {"127.0.1.2"},
+	}}
+
+	hooks := New(
+		WithResolver(resolver),
+		WithZone(Zone{Name: "ip.example.net", Type: TypeIP}, Zone{Name: "rhs.example.net", Type: TypeSender}),
+		WithThreshold(2),
+	).Hooks()
+
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.1")), "a single listing should not reject at connect")
+
+	res := hooks.Mail(newEnvelope("192.0.2.1"))
+	require.NotNil(t, res)
+	assert.Equal(t, 550, res.StatusCode())
+
+	assert.Nil(t, hooks.Mail(newEnvelope("192.0.2.2")))
+}
+
+func TestAddHeader(t *testing.T) {
+	resolver := &fakeResolver{records: map[string][]string{
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip.example.net": {"127.0.0.3"},
+	}}
+	checker := New(WithResolver(resolver), WithZone(Zone{Name: "ip.example.net", Type: TypeIP}))
+
+	e := newEnvelope("2001:db8::1")
+	_, _ = e.Data.WriteString("Subject: test\r\n\r\nHello")
+
+	handler := checker.AddHeader()(func(e *envelope.Envelope) smtpx.Response { return nil })
+	handler(e)
+
+	m, err := e.Mail()
+	require.NoError(t, err)
+	h, err := m.Headers()
+	require.NoError(t, err)
+	assert.Equal(t, "score=1; ip.example.net=127.0.0.3", h.Get("X-DNSBL"))
+}
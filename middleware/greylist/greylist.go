@@ -0,0 +1,200 @@
+// Package greylist implements greylisting on (subnet, MAIL FROM, RCPT TO) triplets.
+//
+// The first time a triplet is seen the recipient is rejected with a 451 4.7.1. A well-behaved MTA will retry,
+// and if the retry happens after the Delay, but within the RetryWindow, the triplet is passed and remembered
+// until it has not been seen for Expiry. A subnet that has passed AutoAllowlist triplets is no longer greylisted.
+//
+// Example usage:
+//
+//	store, err := greylist.NewFileStore("/var/lib/smtpx/greylist.json")
+//	...
+//	server.Hook(greylist.New(greylist.WithStore(store)).Hooks())
+package greylist
+
+import (
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/utils"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDelay         = 5 * time.Minute
+	defaultRetryWindow   = 48 * time.Hour
+	defaultExpiry        = 35 * 24 * time.Hour
+	defaultAutoAllowlist = 5
+)
+
+type Settings struct {
+	Store  Store
+	Logger *slog.Logger
+
+	// Delay is the minimum time before a retry is accepted
+	Delay time.Duration
+	// RetryWindow is the time a client has to retry, after that the triplet is seen as new
+	RetryWindow time.Duration
+	// Expiry is how long a passed triplet, or an allowlisted subnet, is remembered since last seen
+	Expiry time.Duration
+	// AutoAllowlist is the number of passed triplets after which the subnet no longer is greylisted, 0 disables it
+	AutoAllowlist int
+}
+
+type Option func(*Settings)
+
+// WithStore sets the Store used, defaults to a MemoryStore
+func WithStore(store Store) Option {
+	return func(s *Settings) {
+		s.Store = store
+	}
+}
+
+// WithLogger logs greylisted triplets and store errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithDelay sets the minimum time before a retry is accepted, defaults to 5 minutes
+func WithDelay(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Delay = d
+	}
+}
+
+// WithRetryWindow sets the time a client has to retry, defaults to 48 hours
+func WithRetryWindow(d time.Duration) Option {
+	return func(s *Settings) {
+		s.RetryWindow = d
+	}
+}
+
+// WithExpiry sets how long passed triplets are remembered, defaults to 35 days
+func WithExpiry(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Expiry = d
+	}
+}
+
+// WithAutoAllowlist sets the number of passed triplets after which a subnet no longer is greylisted,
+// defaults to 5. 0 disables auto allowlisting
+func WithAutoAllowlist(n int) Option {
+	return func(s *Settings) {
+		s.AutoAllowlist = n
+	}
+}
+
+type Greylist struct {
+	settings *Settings
+	now      func() time.Time
+}
+
+func New(opts ...Option) *Greylist {
+	settings := &Settings{
+		Delay:         defaultDelay,
+		RetryWindow:   defaultRetryWindow,
+		Expiry:        defaultExpiry,
+		AutoAllowlist: defaultAutoAllowlist,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	if settings.Store == nil {
+		settings.Store = NewMemoryStore()
+	}
+	return &Greylist{settings: settings, now: time.Now}
+}
+
+// Hooks returns the hooks that should be added to the server, i.e. server.Hook(greylist.Hooks())
+func (g *Greylist) Hooks() smtpx.Hooks {
+	return smtpx.Hooks{
+		Rcpt: g.rcpt,
+	}
+}
+
+func (g *Greylist) rcpt(e *envelope.Envelope, rcpt *mail.Address) smtpx.Response {
+	subnet := utils.SubnetOf(e.ClientAddr().Addr())
+	if subnet == "" || e.MailFrom == nil || rcpt == nil {
+		return nil
+	}
+
+	now := g.now()
+	store := g.settings.Store
+
+	subnetKey := "s:" + subnet
+	if g.settings.AutoAllowlist > 0 {
+		entry, found, err := store.Get(subnetKey)
+		if err != nil {
+			g.log("greylist, store error", "key", subnetKey, "err", err)
+			return nil
+		}
+		if found && entry.Passes >= g.settings.AutoAllowlist {
+			entry.Expires = now.Add(g.settings.Expiry)
+			g.put(subnetKey, entry)
+			return nil
+		}
+	}
+
+	key := "t:" + subnet + "|" + strings.ToLower(e.MailFrom.Address) + "|" + strings.ToLower(rcpt.Address)
+	entry, found, err := store.Get(key)
+	if err != nil {
+		g.log("greylist, store error", "key", key, "err", err)
+		return nil
+	}
+
+	switch {
+	case !found:
+		g.put(key, Entry{FirstSeen: now, Expires: now.Add(g.settings.RetryWindow)})
+		g.log("greylist, new triplet", "key", key)
+		return responses.ErrorGreylisted
+
+	case entry.Passed:
+		entry.Expires = now.Add(g.settings.Expiry)
+		g.put(key, entry)
+		return nil
+
+	case now.Sub(entry.FirstSeen) < g.settings.Delay:
+		g.log("greylist, retried too early", "key", key, "first-seen", entry.FirstSeen)
+		return responses.ErrorGreylisted
+	}
+
+	// The client has retried within the window
+	entry.Passed = true
+	entry.Expires = now.Add(g.settings.Expiry)
+	g.put(key, entry)
+
+	if g.settings.AutoAllowlist > 0 {
+		sub, _, err := store.Get(subnetKey)
+		if err != nil {
+			g.log("greylist, store error", "key", subnetKey, "err", err)
+			return nil
+		}
+		if sub.FirstSeen.IsZero() {
+			sub.FirstSeen = now
+		}
+		sub.Passes++
+		sub.Expires = now.Add(g.settings.Expiry)
+		g.put(subnetKey, sub)
+	}
+	return nil
+}
+
+func (g *Greylist) put(key string, entry Entry) {
+	err := g.settings.Store.Put(key, entry)
+	if err != nil {
+		g.log("greylist, store error", "key", key, "err", err)
+	}
+}
+
+func (g *Greylist) log(msg string, args ...any) {
+	if g.settings.Logger != nil {
+		g.settings.Logger.Debug(msg, args...)
+	}
+}
@@ -0,0 +1,109 @@
+package greylist
+
+import (
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/mail"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func newGreylist(c *clock, store *MemoryStore, opts ...Option) *Greylist {
+	store.now = c.now
+	g := New(append([]Option{WithStore(store)}, opts...)...)
+	g.now = c.now
+	return g
+}
+
+func newEnvelope(ip string, from string) *envelope.Envelope {
+	e := envelope.NewEnvelope(&net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}, 1)
+	e.MailFrom = &mail.Address{Address: from}
+	return e
+}
+
+func TestGreylist(t *testing.T) {
+	c := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	hooks := newGreylist(c, NewMemoryStore(), WithAutoAllowlist(0)).Hooks()
+
+	e := newEnvelope("192.0.2.1", "sender@example.com")
+	rcpt := &mail.Address{Address: "rcpt@example.org"}
+
+	res := hooks.Rcpt(e, rcpt)
+	require.NotNil(t, res, "unknown triplet should be greylisted")
+	assert.Equal(t, 451, res.StatusCode())
+	assert.Equal(t, "451 4.7.1 Greylisted, please try again later", res.String())
+
+	c.t = c.t.Add(time.Minute)
+	assert.NotNil(t, hooks.Rcpt(e, rcpt), "retry before delay should be greylisted")
+
+	c.t = c.t.Add(5 * time.Minute)
+	assert.Nil(t, hooks.Rcpt(newEnvelope("192.0.2.77", "Sender@example.com"), rcpt), "retry from the same subnet should pass")
+
+	c.t = c.t.Add(30 * 24 * time.Hour)
+	assert.Nil(t, hooks.Rcpt(e, rcpt), "passed triplet should be remembered")
+
+	assert.NotNil(t, hooks.Rcpt(e, &mail.Address{Address: "other@example.org"}), "other recipient is a new triplet")
+	assert.NotNil(t, hooks.Rcpt(newEnvelope("192.0.3.1", "sender@example.com"), rcpt), "other subnet is a new triplet")
+}
+
+func TestGreylistRetryWindow(t *testing.T) {
+	c := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	hooks := newGreylist(c, NewMemoryStore(), WithRetryWindow(time.Hour)).Hooks()
+
+	e := newEnvelope("192.0.2.1", "sender@example.com")
+	rcpt := &mail.Address{Address: "rcpt@example.org"}
+
+	assert.NotNil(t, hooks.Rcpt(e, rcpt))
+	c.t = c.t.Add(2 * time.Hour)
+	assert.NotNil(t, hooks.Rcpt(e, rcpt), "retry after the window is a new triplet")
+	c.t = c.t.Add(10 * time.Minute)
+	assert.Nil(t, hooks.Rcpt(e, rcpt))
+}
+
+func TestGreylistAutoAllowlist(t *testing.T) {
+	c := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	hooks := newGreylist(c, NewMemoryStore(), WithAutoAllowlist(2)).Hooks()
+
+	e := newEnvelope("192.0.2.1", "sender@example.com")
+	for _, to := range []string{"a@example.org", "b@example.org"} {
+		rcpt := &mail.Address{Address: to}
+		assert.NotNil(t, hooks.Rcpt(e, rcpt))
+		c.t = c.t.Add(10 * time.Minute)
+		assert.Nil(t, hooks.Rcpt(e, rcpt))
+	}
+
+	assert.Nil(t, hooks.Rcpt(e, &mail.Address{Address: "c@example.org"}), "subnet should be allowlisted")
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	entry := Entry{FirstSeen: time.Now().Truncate(time.Second), Passed: true, Expires: time.Now().Add(time.Hour).Truncate(time.Second)}
+	require.NoError(t, store.Put("key", entry))
+	require.NoError(t, store.Put("expired", Entry{Expires: time.Now().Add(-time.Hour)}))
+
+	reopened, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	got, found, err := reopened.Get("key")
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.True(t, entry.FirstSeen.Equal(got.FirstSeen))
+	assert.True(t, got.Passed)
+
+	_, found, err = reopened.Get("expired")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
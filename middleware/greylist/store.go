@@ -0,0 +1,158 @@
+package greylist
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry is the state of a greylisted triplet, or of an allowlisted subnet
+type Entry struct {
+	// FirstSeen is when the triplet was first seen
+	FirstSeen time.Time `json:"first_seen"`
+	// Passed is set when the client has retried within the retry window
+	Passed bool `json:"passed"`
+	// Passes is the number of triplets that has passed for a subnet
+	Passes int `json:"passes,omitempty"`
+	// Expires is when the entry is forgotten
+	Expires time.Time `json:"expires"`
+}
+
+// Store persists greylist entries. Implementations must be safe for concurrent use
+type Store interface {
+	// Get returns the entry of key, found is false if there is no entry or if it has expired
+	Get(key string) (entry Entry, found bool, err error)
+	// Put saves an entry
+	Put(key string, entry Entry) error
+}
+
+// MemoryStore is an in-memory Store
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]Entry
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: map[string]Entry{},
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryStore) Get(key string) (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || !m.now().Before(e.Expires) {
+		return Entry{}, false, nil
+	}
+	return e, true, nil
+}
+
+func (m *MemoryStore) Put(key string, entry Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = entry
+	m.sweep()
+	return nil
+}
+
+// Len returns the number of entries held by the store
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// sweep removes expired entries, at most once a minute
+func (m *MemoryStore) sweep() {
+	now := m.now()
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for k, e := range m.entries {
+		if !now.Before(e.Expires) {
+			delete(m.entries, k)
+		}
+	}
+}
+
+// FileStore is a MemoryStore that is persisted as JSON to a file, the file is rewritten on every Put.
+// It is meant for a single server with moderate traffic
+type FileStore struct {
+	*MemoryStore
+	path string
+	fmu  sync.Mutex
+}
+
+// NewFileStore opens, or creates, a FileStore at path
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	err = json.Unmarshal(data, &s.entries)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (f *FileStore) Put(key string, entry Entry) error {
+	err := f.MemoryStore.Put(key, entry)
+	if err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// save writes the entries to a temporary file and renames it, so that the file never is half written
+func (f *FileStore) save() error {
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+
+	f.mu.Lock()
+	data, err := json.Marshal(f.entries)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
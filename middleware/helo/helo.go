@@ -0,0 +1,142 @@
+// Package helo implements policies on the HELO/EHLO argument, e.g. rejecting clients that
+// do not present a fully qualified domain name or claims to be us.
+//
+// Example usage:
+//
+//	policy := helo.New(
+//		helo.RejectInvalid(),
+//		helo.RejectNonFQDN(),
+//		helo.RejectOwn("mx.example.com", netip.MustParseAddr("192.0.2.25")),
+//		helo.RejectLiteralMismatch(),
+//	)
+//	server.Hook(policy.Hooks())
+package helo
+
+import (
+	"context"
+	"errors"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Resolver is the DNS resolver used to check that names resolve, net.DefaultResolver satisfies it
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// Check is a policy on the HELO/EHLO argument, returning a non nil Response rejects the command
+type Check func(e *envelope.Envelope) smtpx.Response
+
+// RejectInvalid rejects arguments that are neither a valid domain nor a valid address literal
+func RejectInvalid() Check {
+	return func(e *envelope.Envelope) smtpx.Response {
+		if e.HeloName.Type == envelope.HeloUnknown {
+			return responses.FailHeloInvalid
+		}
+		return nil
+	}
+}
+
+// RejectNonFQDN rejects domains that are not fully qualified, e.g. localhost.
+// Address literals are allowed
+func RejectNonFQDN() Check {
+	return func(e *envelope.Envelope) smtpx.Response {
+		if e.HeloName.Type == envelope.HeloDomain && !e.HeloName.FQDN {
+			return responses.FailHeloNotFQDN
+		}
+		return nil
+	}
+}
+
+// RejectOwn rejects clients that claims to be us, by using our hostname or one of our addresses
+func RejectOwn(hostname string, addrs ...netip.Addr) Check {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	return func(e *envelope.Envelope) smtpx.Response {
+		h := e.HeloName
+		if h.Type == envelope.HeloDomain && h.Domain == hostname {
+			return responses.FailHeloSpoofed
+		}
+		if h.IsLiteral() && slices.Contains(addrs, h.Addr.Unmap()) {
+			return responses.FailHeloSpoofed
+		}
+		return nil
+	}
+}
+
+// RejectLiteralMismatch rejects address literals that does not match the address of the client
+func RejectLiteralMismatch() Check {
+	return func(e *envelope.Envelope) smtpx.Response {
+		h := e.HeloName
+		if !h.IsLiteral() {
+			return nil
+		}
+		client := e.ClientAddr().Addr()
+		if !client.IsValid() {
+			return nil
+		}
+		if client != h.Addr.Unmap() {
+			return responses.FailHeloMismatch
+		}
+		return nil
+	}
+}
+
+// RejectUnresolvable rejects domains that does not resolve to any address, using resolver.
+// A nil resolver uses net.DefaultResolver. Temporary DNS errors will not reject the client
+func RejectUnresolvable(resolver Resolver, timeout time.Duration) Check {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return func(e *envelope.Envelope) smtpx.Response {
+		h := e.HeloName
+		if h.Type != envelope.HeloDomain {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(e.Context(), timeout)
+		defer cancel()
+		addrs, err := resolver.LookupHost(ctx, h.Domain)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return responses.ErrorHeloNotFound
+		}
+		if err == nil && len(addrs) == 0 {
+			return responses.ErrorHeloNotFound
+		}
+		return nil
+	}
+}
+
+type Policy struct {
+	checks []Check
+}
+
+// New returns a policy that runs the checks in order, the first rejection is returned
+func New(checks ...Check) *Policy {
+	return &Policy{checks: checks}
+}
+
+// Hooks returns the hooks that should be added to the server, i.e. server.Hook(policy.Hooks())
+func (p *Policy) Hooks() smtpx.Hooks {
+	return smtpx.Hooks{
+		Helo: p.Check,
+	}
+}
+
+// Check runs the checks on the HELO/EHLO argument of e
+func (p *Policy) Check(e *envelope.Envelope) smtpx.Response {
+	for _, check := range p.checks {
+		if check == nil {
+			continue
+		}
+		if res := check(e); res != nil {
+			return res
+		}
+	}
+	return nil
+}
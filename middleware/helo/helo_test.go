@@ -0,0 +1,68 @@
+package helo
+
+import (
+	"context"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func newEnvelope(ip string, helo string) *envelope.Envelope {
+	e := envelope.NewEnvelope(&net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}, 1)
+	e.Helo = helo
+	e.HeloName, _ = envelope.ParseHelo(helo)
+	return e
+}
+
+func TestPolicy(t *testing.T) {
+	policy := New(
+		RejectInvalid(),
+		RejectNonFQDN(),
+		RejectOwn("mx.example.com", netip.MustParseAddr("192.0.2.25")),
+		RejectLiteralMismatch(),
+		RejectUnresolvable(fakeResolver{"mail.example.org": {"192.0.2.1"}}, time.Second),
+	)
+
+	tests := []struct {
+		ip   string
+		helo string
+		code int
+	}{
+		{ip: "192.0.2.1", helo: "mail.example.org"},
+		{ip: "192.0.2.1", helo: "[192.0.2.1]"},
+		{ip: "2001:db8::1", helo: "[IPv6:2001:db8::1]"},
+		{ip: "192.0.2.1", helo: "b@d", code: 501},
+		{ip: "192.0.2.1", helo: "192.0.2.1", code: 501},
+		{ip: "192.0.2.1", helo: "localhost", code: 504},
+		{ip: "192.0.2.1", helo: "MX.example.com", code: 554},
+		{ip: "192.0.2.1", helo: "[192.0.2.25]", code: 554},
+		{ip: "192.0.2.1", helo: "[192.0.2.2]", code: 550},
+		{ip: "192.0.2.1", helo: "unknown.example.org", code: 450},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.helo, func(t *testing.T) {
+			res := policy.Check(newEnvelope(tt.ip, tt.helo))
+			if tt.code == 0 {
+				assert.Nil(t, res)
+				return
+			}
+			require.NotNil(t, res)
+			assert.Equal(t, tt.code, res.StatusCode())
+		})
+	}
+}
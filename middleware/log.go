@@ -31,7 +31,7 @@ func Logger(logger *slog.Logger, opts ...Option) smtpx.Middleware {
 			return "HELO", e.Helo
 		},
 
-		func(envelope *envelope.Envelope) (string, any) { return "remote-ip", envelope.RemoteAddr },
+		func(envelope *envelope.Envelope) (string, any) { return "remote-ip", envelope.ClientAddr() },
 		func(envelope *envelope.Envelope) (string, any) { return "MAIL", envelope.MailFrom.Address },
 		func(envelope *envelope.Envelope) (string, any) {
 			var tos []string
@@ -90,7 +90,7 @@ func Logger(logger *slog.Logger, opts ...Option) smtpx.Middleware {
 			l = logger.With("connection-id", envelope.ConnectionId())
 
 			if m, _ := envelope.Mail(); m != nil {
-				if h, _ := m.Headers(); h != nil {
+				if h, err := m.Headers(); err == nil {
 					l = l.With("message-id", h.Get("Message-Id"))
 				}
 			}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/modfin/smtpx"
 	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/utils"
 	"strings"
 	"time"
 )
@@ -43,7 +44,7 @@ func AddReceivedHeaders(hostname string) smtpx.Middleware {
 
 			id := fmt.Sprintf("%d-%s@%s", clientId, envelopeId, hostname)
 
-			received := fmt.Sprintf("from %s (%s [%s])\r\n", e.Helo, e.Helo, e.RemoteAddr.String())
+			received := fmt.Sprintf("from %s (%s [%s])\r\n", e.Helo, e.Helo, utils.AddressLiteral(e.ClientAddr().Addr()))
 			received += fmt.Sprintf("  by %s with %s id %s\r\n", hostname, protocol, id)
 			if len(e.RcptTo) == 1 {
 				received += fmt.Sprintf("  for <%s>\r\n", e.RcptTo[0].Address)
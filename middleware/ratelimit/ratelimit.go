@@ -0,0 +1,174 @@
+// Package ratelimit limits connections, messages and recipients per client, subnet, HELO name or sender domain.
+//
+// Example usage:
+//
+//	limiter := ratelimit.New(
+//		ratelimit.Connections(ratelimit.BySubnet, 60, time.Minute),
+//		ratelimit.Messages(ratelimit.ByIP, 100, time.Hour),
+//		ratelimit.Recipients(ratelimit.BySenderDomain, 1000, time.Hour),
+//	)
+//	server.Hook(limiter.Hooks())
+package ratelimit
+
+import (
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/utils"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Key extracts the value a limit is keyed on from the envelope. An empty string means that the limit does not apply
+type Key struct {
+	Name string
+	Fn   func(e *envelope.Envelope) string
+}
+
+var (
+	// ByIP keys the limit on the remote ip address
+	ByIP = Key{Name: "ip", Fn: func(e *envelope.Envelope) string {
+		addr := e.ClientAddr().Addr()
+		if !addr.IsValid() {
+			return ""
+		}
+		return addr.String()
+	}}
+
+	// BySubnet keys the limit on the /24 (IPv4) or /64 (IPv6) subnet of the remote ip address
+	BySubnet = Key{Name: "subnet", Fn: func(e *envelope.Envelope) string {
+		return utils.SubnetOf(e.ClientAddr().Addr())
+	}}
+
+	// ByHelo keys the limit on the name given in HELO/EHLO
+	ByHelo = Key{Name: "helo", Fn: func(e *envelope.Envelope) string {
+		return strings.ToLower(e.Helo)
+	}}
+
+	// BySenderDomain keys the limit on the domain given in MAIL FROM
+	BySenderDomain = Key{Name: "sender", Fn: func(e *envelope.Envelope) string {
+		return utils.DomainOfEmail(e.MailFrom)
+	}}
+)
+
+// Limit allows Count events per Window for each value of Key
+type Limit struct {
+	Key    Key
+	Count  int64
+	Window time.Duration
+}
+
+type Settings struct {
+	Store  Store
+	Logger *slog.Logger
+
+	Connections []Limit
+	Messages    []Limit
+	Recipients  []Limit
+}
+
+type Option func(*Settings)
+
+// WithStore sets the Store used for the counters, defaults to a MemoryStore
+func WithStore(store Store) Option {
+	return func(s *Settings) {
+		s.Store = store
+	}
+}
+
+// WithLogger logs rejections and store errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// Connections limits the number of connections, checked when the client connects.
+// Exceeding the limit results in a 421 and the connection is closed
+func Connections(key Key, count int64, window time.Duration) Option {
+	return func(s *Settings) {
+		s.Connections = append(s.Connections, Limit{Key: key, Count: count, Window: window})
+	}
+}
+
+// Messages limits the number of messages, checked on MAIL FROM.
+// Exceeding the limit results in a 450
+func Messages(key Key, count int64, window time.Duration) Option {
+	return func(s *Settings) {
+		s.Messages = append(s.Messages, Limit{Key: key, Count: count, Window: window})
+	}
+}
+
+// Recipients limits the number of recipients, checked on RCPT TO.
+// Exceeding the limit results in a 450
+func Recipients(key Key, count int64, window time.Duration) Option {
+	return func(s *Settings) {
+		s.Recipients = append(s.Recipients, Limit{Key: key, Count: count, Window: window})
+	}
+}
+
+type Limiter struct {
+	settings *Settings
+}
+
+func New(opts ...Option) *Limiter {
+	settings := &Settings{}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	if settings.Store == nil {
+		settings.Store = NewMemoryStore()
+	}
+	return &Limiter{settings: settings}
+}
+
+// Hooks returns the hooks that should be added to the server, i.e. server.Hook(limiter.Hooks())
+func (l *Limiter) Hooks() smtpx.Hooks {
+	return smtpx.Hooks{
+		Connect: func(e *envelope.Envelope) smtpx.Response {
+			return l.check(e, "conn", l.settings.Connections, responses.ErrorTooManyConnections)
+		},
+		Mail: func(e *envelope.Envelope) smtpx.Response {
+			return l.check(e, "mail", l.settings.Messages, responses.ErrorTooManyMessages)
+		},
+		Rcpt: func(e *envelope.Envelope, _ *mail.Address) smtpx.Response {
+			return l.check(e, "rcpt", l.settings.Recipients, responses.ErrorTooManyRecipientsRate)
+		},
+	}
+}
+
+// check increments the counters of the limits in order and returns reject at the first one that is exceeded,
+// so that a rejected attempt does not count against the limits after it. A failing store will not reject the client
+func (l *Limiter) check(e *envelope.Envelope, kind string, limits []Limit, reject smtpx.Response) smtpx.Response {
+	for _, limit := range limits {
+		if limit.Key.Fn == nil {
+			continue
+		}
+		val := limit.Key.Fn(e)
+		if val == "" {
+			continue
+		}
+		key := kind + ":" + limit.Key.Name + ":" + limit.Window.String() + ":" + val
+		count, err := l.settings.Store.Incr(e.Context(), key, limit.Window)
+		if err != nil {
+			l.log("ratelimit, store error", "key", key, "err", err)
+			continue
+		}
+		if count > limit.Count {
+			l.log("ratelimit, limit exceeded", "key", key, "count", count, "limit", limit.Count)
+			return reject
+		}
+	}
+	return nil
+}
+
+func (l *Limiter) log(msg string, args ...any) {
+	if l.settings.Logger != nil {
+		l.settings.Logger.Debug(msg, args...)
+	}
+}
@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func newEnvelope(ip string) *envelope.Envelope {
+	return envelope.NewEnvelope(&net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}, 1)
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	for i := int64(1); i <= 3; i++ {
+		count, err := store.Incr(context.Background(), "a", time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, i, count)
+	}
+	count, _ := store.Incr(context.Background(), "b", time.Minute)
+	assert.Equal(t, int64(1), count)
+
+	now = now.Add(time.Minute)
+	count, _ = store.Incr(context.Background(), "a", time.Minute)
+	assert.Equal(t, int64(1), count, "counter should be reset after the window")
+	assert.Equal(t, 1, store.Len(), "expired counters should be swept")
+}
+
+func TestConnections(t *testing.T) {
+	hooks := New(Connections(ByIP, 2, time.Minute)).Hooks()
+
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.1")))
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.1")))
+
+	res := hooks.Connect(newEnvelope("192.0.2.1"))
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 421, res.StatusCode())
+	}
+
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.2")), "other ip should not be limited")
+}
+
+func TestSubnet(t *testing.T) {
+	hooks := New(Connections(BySubnet, 1, time.Minute)).Hooks()
+
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.1")))
+	assert.NotNil(t, hooks.Connect(newEnvelope("192.0.2.200")))
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.3.1")))
+
+	assert.Nil(t, hooks.Connect(newEnvelope("2001:db8:0:1::1")))
+	assert.NotNil(t, hooks.Connect(newEnvelope("2001:db8:0:1:ffff::1")))
+	assert.Nil(t, hooks.Connect(newEnvelope("2001:db8:0:2::1")))
+}
+
+func TestMessagesAndRecipients(t *testing.T) {
+	hooks := New(
+		Messages(BySenderDomain, 1, time.Hour),
+		Recipients(ByHelo, 2, time.Hour),
+	).Hooks()
+
+	e := newEnvelope("192.0.2.1")
+	e.Helo = "mail.example.com"
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+
+	assert.Nil(t, hooks.Mail(e))
+	res := hooks.Mail(e)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 450, res.StatusCode())
+	}
+
+	rcpt := &mail.Address{Address: "rcpt@example.org"}
+	assert.Nil(t, hooks.Rcpt(e, rcpt))
+	assert.Nil(t, hooks.Rcpt(e, rcpt))
+	res = hooks.Rcpt(e, rcpt)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 450, res.StatusCode())
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Incr(context.Context, string, time.Duration) (int64, error) {
+	return 0, assert.AnError
+}
+
+func TestStoreErrorFailsOpen(t *testing.T) {
+	hooks := New(Connections(ByIP, 0, time.Minute), WithStore(failingStore{})).Hooks()
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.1")))
+}
+
+func TestRejectedNotCounted(t *testing.T) {
+	hooks := New(
+		Connections(ByIP, 1, time.Minute),
+		Connections(BySubnet, 2, time.Minute),
+	).Hooks()
+
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.1")))
+	assert.NotNil(t, hooks.Connect(newEnvelope("192.0.2.1")))
+	assert.Nil(t, hooks.Connect(newEnvelope("192.0.2.2")), "rejected connection should not count against the subnet")
+	assert.NotNil(t, hooks.Connect(newEnvelope("192.0.2.3")))
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store keeps the counters of the rate limiter. The interface is small enough to be backed by
+// e.g. redis (INCR + EXPIRE) in order to share the state between several servers
+type Store interface {
+	// Incr increments the counter of key and returns the new count. A counter is reset to 0
+	// when window has passed since it was first incremented
+	Incr(ctx context.Context, key string, window time.Duration) (int64, error)
+}
+
+type counter struct {
+	count   int64
+	expires time.Time
+}
+
+// MemoryStore is an in-memory Store, it is safe for concurrent use
+type MemoryStore struct {
+	mu        sync.Mutex
+	counters  map[string]*counter
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		counters: map[string]*counter{},
+		now:      time.Now,
+	}
+}
+
+func (m *MemoryStore) Incr(_ context.Context, key string, window time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	c, ok := m.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &counter{expires: now.Add(window)}
+		m.counters[key] = c
+	}
+	c.count++
+	return c.count, nil
+}
+
+// Len returns the number of counters held by the store
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.counters)
+}
+
+// sweep removes expired counters, at most once a minute
+func (m *MemoryStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for k, c := range m.counters {
+		if !now.Before(c.expires) {
+			delete(m.counters, k)
+		}
+	}
+}
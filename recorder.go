@@ -0,0 +1,166 @@
+package smtpx
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/modfin/smtpx/transcript"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Recorder records the SMTP sessions of a server as transcripts, which can be replayed in tests to reproduce
+// the behavior of a client, see package transcript
+type Recorder struct {
+	// Open returns where the transcript of a session is written, which is closed with the connection.
+	// Return nil to not record the session
+	Open func(s *Session) (io.WriteCloser, error)
+
+	// RedactAuth replaces the credentials sent with AUTH, i.e. its initial response and the lines sent after
+	// a 334 challenge, with transcript.Redacted
+	RedactAuth bool
+	// RedactData replaces the messages sent after DATA with their size
+	RedactData bool
+}
+
+// RecordToDir returns a Recorder.Open that writes the transcript of each session to a file in dir, named by
+// the time and the id of the connection, e.g. 20240102T030405Z-12.txt
+func RecordToDir(dir string) func(s *Session) (io.WriteCloser, error) {
+	return func(s *Session) (io.WriteCloser, error) {
+		name := fmt.Sprintf("%s-%d.txt", time.Now().UTC().Format("20060102T150405Z"), s.Envelope().ConnectionId())
+		return os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	}
+}
+
+// recording is the transcript of a connection being recorded
+type recording struct {
+	w      *transcript.Writer
+	closer io.Closer
+
+	redactAuth bool
+	redactData bool
+
+	// pending are the replies that are buffered, they are recorded when sent so that the transcript keeps
+	// the order of the wire when commands are pipelined
+	pending []transcript.Entry
+	// challenged is true if the last reply was a 334, i.e. the next line is an AUTH response
+	challenged bool
+}
+
+// record starts recording the session, if the recorder returns somewhere to write it
+func (c *connection) record(r *Recorder, session *Session) {
+	if r.Open == nil {
+		return
+	}
+	w, err := r.Open(session)
+	if err != nil {
+		c.log.Warn("could not open transcript", "err", err)
+		return
+	}
+	if w == nil {
+		return
+	}
+	c.recording = &recording{
+		w:          transcript.NewWriter(w),
+		closer:     w,
+		redactAuth: r.RedactAuth,
+		redactData: r.RedactData,
+	}
+	c.recording.w.Comment("connection %d from %s at %s", c.ConnectionId(), c.Remote, c.ConnectedAt.UTC().Format(time.RFC3339))
+}
+
+// recordCommand records a line read from the client
+func (c *connection) recordCommand(line string) {
+	r := c.recording
+	if r == nil {
+		return
+	}
+	if r.redactAuth {
+		// AUTH <mechanism> [initial-response]
+		fields := strings.Fields(line)
+		switch {
+		case r.challenged:
+			line = transcript.Redacted
+		case len(fields) > 2 && strings.EqualFold(fields[0], "AUTH"):
+			line = fields[0] + " " + fields[1] + " " + transcript.Redacted
+		}
+	}
+	r.w.Record(transcript.Client, line)
+}
+
+// recordReply records the lines of a reply once it is sent, see recordSent
+func (c *connection) recordReply(wire string) {
+	r := c.recording
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	lines := strings.Split(strings.TrimSuffix(wire, commandSuffix), commandSuffix)
+	for _, line := range lines {
+		r.pending = append(r.pending, transcript.Entry{Time: now, Direction: transcript.Server, Line: line})
+	}
+	r.challenged = strings.HasPrefix(lines[len(lines)-1], "334")
+}
+
+// recordSent records the replies that were buffered
+func (c *connection) recordSent() {
+	r := c.recording
+	if r == nil {
+		return
+	}
+	for _, e := range r.pending {
+		r.w.Add(e)
+	}
+	r.pending = r.pending[:0]
+}
+
+// recordData records the message read after DATA as it was sent, i.e. dot-stuffed and, if it was read to the
+// end, with the terminating line
+func (c *connection) recordData(complete bool) {
+	r := c.recording
+	if r == nil {
+		return
+	}
+	data := c.Envelope.Data.Bytes()
+	if r.redactData {
+		r.w.Record(transcript.Data, fmt.Sprintf("%s %d bytes", transcript.Redacted, len(data)))
+	} else {
+		lines := strings.Split(string(data), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		for _, line := range lines {
+			line = strings.TrimSuffix(line, "\r")
+			if strings.HasPrefix(line, ".") {
+				line = "." + line
+			}
+			r.w.Record(transcript.Data, line)
+		}
+	}
+	if complete {
+		r.w.Record(transcript.Data, ".")
+	}
+}
+
+// recordTLS notes that the connection was upgraded to TLS
+func (c *connection) recordTLS(version uint16) {
+	if c.recording != nil {
+		c.recording.w.Comment("TLS handshake, %s", tls.VersionName(version))
+	}
+}
+
+// recordClose records the replies that are left and closes the transcript
+func (c *connection) recordClose() {
+	r := c.recording
+	if r == nil {
+		return
+	}
+	c.recordSent()
+	if err := r.w.Err(); err != nil {
+		c.log.Warn("could not write transcript", "err", err)
+	}
+	_ = r.closer.Close()
+	c.recording = nil
+}
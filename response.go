@@ -4,7 +4,9 @@ import "fmt"
 
 // Response represents a response to an SMTP connection after receiving DATA.
 // The String method should return an SMTP message ready to send back to the
-// connection, for example `250 OK: Message received`.
+// connection, for example `250 OK: Message received`. Multi-line replies are separated by \r\n.
+//
+// Use responses.New to build replies with enhanced status codes and multiple lines.
 type Response interface {
 	fmt.Stringer
 	StatusCode() int
@@ -41,6 +43,7 @@ func (r result) Class() int {
 	return r.code / 100
 }
 
+// NewResponse returns a single line response, e.g. `550 Permanent failure: comment`
 func NewResponse(code int, comment string) Response {
 	return result{code: code, str: comment}
 }
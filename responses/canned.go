@@ -15,7 +15,7 @@ var FailNestedMailCmd = &response{
 	enhancedCode: InvalidCommand,
 	basicCode:    503,
 	class:        ClassPermanentFailure,
-	comment:      "GetError: nested MAIL command",
+	comment:      "Nested MAIL command",
 }
 
 var RejectedSenderMailCmd = &response{
@@ -66,7 +66,7 @@ var ErrorRelayDenied = &response{
 	enhancedCode: BadDestinationMailboxAddress,
 	basicCode:    454,
 	class:        ClassTransientFailure,
-	comment:      "GetError: Relay access denied:",
+	comment:      "Relay access denied",
 }
 
 var SuccessQuitCmd = &response{
@@ -80,14 +80,14 @@ var FailNoSenderDataCmd = &response{
 	enhancedCode: InvalidCommand,
 	basicCode:    503,
 	class:        ClassPermanentFailure,
-	comment:      "GetError: No sender",
+	comment:      "No sender",
 }
 
 var FailNoRecipientsDataCmd = &response{
 	enhancedCode: InvalidCommand,
 	basicCode:    503,
 	class:        ClassPermanentFailure,
-	comment:      "GetError: No recipients",
+	comment:      "No recipients",
 }
 
 var SuccessDataCmd = &response{
@@ -134,21 +134,21 @@ var FailReadLimitExceededDataCmd = &response{
 	enhancedCode: MessageLengthExceedsAdministrativeLimit,
 	basicCode:    550,
 	class:        ClassPermanentFailure,
-	comment:      "GetError:",
+	comment:      "Message exceeds the read limit",
 }
 
 var FailMessageSizeExceeded = &response{
 	enhancedCode: OtherOrUndefinedNetworkOrRoutingStatus,
 	basicCode:    552,
 	class:        ClassPermanentFailure,
-	comment:      "GetError:",
+	comment:      "Message size exceeds fixed maximum message size",
 }
 
 var FailReadErrorDataCmd = &response{
 	enhancedCode: OtherOrUndefinedMailSystemStatus,
 	basicCode:    451,
 	class:        ClassTransientFailure,
-	comment:      "GetError:",
+	comment:      "Error reading the message",
 }
 
 var FailPathTooLong = &response{
@@ -197,7 +197,7 @@ var FailBackendTransaction = &response{
 	enhancedCode: OtherOrUndefinedProtocolStatus,
 	basicCode:    554,
 	class:        ClassPermanentFailure,
-	comment:      "GetError:",
+	comment:      "Transaction failed",
 }
 
 var SuccessMessageQueued = &response{
@@ -218,7 +218,7 @@ var FailBackendTimeout = &response{
 	enhancedCode: OtherOrUndefinedProtocolStatus,
 	basicCode:    554,
 	class:        ClassPermanentFailure,
-	comment:      "GetError: transaction timeout",
+	comment:      "Transaction timeout",
 }
 
 var FailRcptCmd = &response{
@@ -234,3 +234,101 @@ var FailMailCmd = &response{
 	class:        ClassPermanentFailure,
 	comment:      "User unknown in local recipient table",
 }
+
+var ErrorTooManyConnections = &response{
+	enhancedCode: OtherOrUndefinedSecurityStatus,
+	basicCode:    421,
+	class:        ClassTransientFailure,
+	comment:      "Too many connections, try again later",
+}
+
+var ErrorTooManyMessages = &response{
+	enhancedCode: OtherOrUndefinedSecurityStatus,
+	basicCode:    450,
+	class:        ClassTransientFailure,
+	comment:      "Too many messages, try again later",
+}
+
+var ErrorTooManyRecipientsRate = &response{
+	enhancedCode: OtherOrUndefinedSecurityStatus,
+	basicCode:    450,
+	class:        ClassTransientFailure,
+	comment:      "Too many recipients, try again later",
+}
+
+var ErrorGreylisted = &response{
+	enhancedCode: DeliveryNotAuthorized,
+	basicCode:    451,
+	class:        ClassTransientFailure,
+	comment:      "Greylisted, please try again later",
+}
+
+var FailBlocklistedClient = &response{
+	enhancedCode: DeliveryNotAuthorized,
+	basicCode:    554,
+	class:        ClassPermanentFailure,
+	comment:      "Client host rejected, listed in DNS blocklist",
+}
+
+var FailBlocklistedSender = &response{
+	enhancedCode: DeliveryNotAuthorized,
+	basicCode:    550,
+	class:        ClassPermanentFailure,
+	comment:      "Sender rejected, listed in DNS blocklist",
+}
+
+var FailEarlyTalker = &response{
+	enhancedCode: InvalidCommand,
+	basicCode:    554,
+	class:        ClassPermanentFailure,
+	comment:      "Protocol error, talking before the greeting",
+}
+
+var FailHeloInvalid = &response{
+	enhancedCode: SyntaxError,
+	basicCode:    501,
+	class:        ClassPermanentFailure,
+	comment:      "Helo command rejected: Invalid name",
+}
+
+var FailHeloNotFQDN = &response{
+	enhancedCode: SyntaxError,
+	basicCode:    504,
+	class:        ClassPermanentFailure,
+	comment:      "Helo command rejected: Need fully-qualified hostname",
+}
+
+var FailHeloSpoofed = &response{
+	enhancedCode: DeliveryNotAuthorized,
+	basicCode:    554,
+	class:        ClassPermanentFailure,
+	comment:      "Helo command rejected: You are not me",
+}
+
+var FailHeloMismatch = &response{
+	enhancedCode: DeliveryNotAuthorized,
+	basicCode:    550,
+	class:        ClassPermanentFailure,
+	comment:      "Helo command rejected: Address literal does not match the client address",
+}
+
+var ErrorHeloNotFound = &response{
+	enhancedCode: DeliveryNotAuthorized,
+	basicCode:    450,
+	class:        ClassTransientFailure,
+	comment:      "Helo command rejected: Host not found",
+}
+
+var FailBadSequence = &response{
+	enhancedCode: InvalidCommand,
+	basicCode:    503,
+	class:        ClassPermanentFailure,
+	comment:      "Bad sequence of commands",
+}
+
+var FailPipelining = &response{
+	enhancedCode: OtherOrUndefinedProtocolStatus,
+	basicCode:    554,
+	class:        ClassPermanentFailure,
+	comment:      "Improper use of SMTP command pipelining",
+}
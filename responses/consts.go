@@ -63,6 +63,8 @@ const (
 	ConversionRequiredButNotSupported       = ".6.3"
 	ConversionWithLossPerformed             = ".6.4"
 	ConversionFailed                        = ".6.5"
+	OtherOrUndefinedSecurityStatus          = ".7.0"
+	DeliveryNotAuthorized                   = ".7.1"
 )
 
 var defaultTexts = struct {
@@ -59,17 +59,7 @@ func (r *response) String() string {
 	comment := r.comment
 
 	if len(comment) == 0 {
-		comment = defaultTexts.m[enhancedCode]
-	}
-	if len(comment) == 0 {
-		switch class {
-		case 2:
-			comment = "OK"
-		case 4:
-			comment = "Temporary failure."
-		case 5:
-			comment = "Permanent failure."
-		}
+		comment = defaultText(enhancedCode)
 	}
 
 	str := fmt.Sprintf("%d %s %s", basicCode, enhancedCode.String(), comment)
@@ -1,7 +1,6 @@
 package responses
 
 import (
-	"github.com/modfin/smtpx"
 	"testing"
 )
 
@@ -22,11 +21,11 @@ func TestGetBasicStatusCode(t *testing.T) {
 // TestString for the String function
 func TestCustomString(t *testing.T) {
 	// Basic testing
-	resp := &smtpx.Response{
-		EnhancedCode: OtherStatus,
-		BasicCode:    200,
-		Class:        ClassSuccess,
-		Comment:      "Test",
+	resp := &response{
+		enhancedCode: OtherStatus,
+		basicCode:    200,
+		class:        ClassSuccess,
+		comment:      "Test",
 	}
 
 	if resp.String() != "200 2.0.0 Test" {
@@ -34,9 +33,9 @@ func TestCustomString(t *testing.T) {
 	}
 
 	// Default String
-	resp2 := &smtpx.Response{
-		EnhancedCode: OtherStatus,
-		Class:        ClassSuccess,
+	resp2 := &response{
+		enhancedCode: OtherStatus,
+		class:        ClassSuccess,
 	}
 	if resp2.String() != "200 2.0.0 OK" {
 		t.Errorf("String failed. String \"%s\" not expected.", resp2)
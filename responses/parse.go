@@ -0,0 +1,150 @@
+package responses
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidReply = errors.New("invalid smtp reply")
+
+// Parse parses a raw server reply, single or multi-line, with or without enhanced status codes, e.g.
+//
+//	250-mx.example.com Hello
+//	250-SIZE 10485760
+//	250 PIPELINING
+//
+// Lines may be separated by \r\n or \n. All lines must have the same code, and all but the last must have a
+// dash after the code. The enhanced code is only recognized if it is on every line and matches the class
+// of the basic code, it is removed from the text of the lines
+func Parse(raw string) (*Reply, error) {
+	raw = strings.TrimRight(raw, "\r\n")
+	if raw == "" {
+		return nil, fmt.Errorf("%w: empty reply", ErrInvalidReply)
+	}
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+
+	r := &Reply{}
+	for i, line := range lines {
+		code, more, text, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			r.code = code
+		}
+		if code != r.code {
+			return nil, fmt.Errorf("%w: mixed codes %d and %d", ErrInvalidReply, r.code, code)
+		}
+		if more != (i < len(lines)-1) {
+			return nil, fmt.Errorf("%w: bad continuation on line %d, %q", ErrInvalidReply, i+1, line)
+		}
+		r.lines = append(r.lines, text)
+	}
+	r.enhanced = r.cutEnhanced()
+	return r, nil
+}
+
+// ReadReply reads and parses a reply from a server
+func ReadReply(r *textproto.Reader) (*Reply, error) {
+	var lines []string
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+
+		_, more, _, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	return Parse(strings.Join(lines, "\r\n"))
+}
+
+// parseLine splits a reply line into its code, if more lines follows, and the text
+func parseLine(line string) (code int, more bool, text string, err error) {
+	if len(line) < 3 {
+		return 0, false, "", fmt.Errorf("%w: short line %q", ErrInvalidReply, line)
+	}
+	code, err = strconv.Atoi(line[:3])
+	if err != nil || code < 200 || code > 599 {
+		return 0, false, "", fmt.Errorf("%w: bad code in %q", ErrInvalidReply, line)
+	}
+	if len(line) == 3 {
+		return code, false, "", nil
+	}
+	switch line[3] {
+	case '-':
+		more = true
+	case ' ':
+	default:
+		return 0, false, "", fmt.Errorf("%w: bad separator in %q", ErrInvalidReply, line)
+	}
+	return code, more, line[4:], nil
+}
+
+// cutEnhanced removes the enhanced code from the lines, if all of them have the same one
+func (r *Reply) cutEnhanced() subjectDetail {
+	var enhanced string
+	for i, line := range r.lines {
+		code, _, _ := strings.Cut(line, SP)
+		if i == 0 {
+			enhanced = code
+		}
+		if code != enhanced {
+			return ""
+		}
+	}
+	e, ok := parseEnhanced(enhanced)
+	if !ok || int(e.Class) != r.Class() {
+		return ""
+	}
+	for i, line := range r.lines {
+		r.lines[i] = strings.TrimPrefix(strings.TrimPrefix(line, enhanced), SP)
+	}
+	return e.SubjectDetailCode
+}
+
+// parseEnhanced parses an enhanced status code, e.g. "5.1.1"
+func parseEnhanced(s string) (EnhancedStatusCode, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return EnhancedStatusCode{}, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || len(part) > 3 || (i == 0 && n != 2 && n != 4 && n != 5) {
+			return EnhancedStatusCode{}, false
+		}
+	}
+	c, _ := strconv.Atoi(parts[0])
+	return EnhancedStatusCode{class(c), subjectDetail("." + parts[1] + "." + parts[2])}, true
+}
+
+// BasicCode returns the basic status code that the enhanced status code maps to, e.g. 550 for 5.1.1
+func (e EnhancedStatusCode) BasicCode() int {
+	return getBasicStatusCode(e)
+}
+
+// DefaultEnhancedCode returns the enhanced status code of a basic code. It is the only enhanced code that
+// maps to the basic code, or X.0.0 if there are none or several of them
+func DefaultEnhancedCode(code int) EnhancedStatusCode {
+	c := class(code / 100)
+	var found []EnhancedStatusCode
+	for e, basic := range codeMap.m {
+		if basic == code {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 1 {
+		return found[0]
+	}
+	return EnhancedStatusCode{c, OtherStatus}
+}
@@ -0,0 +1,115 @@
+package responses
+
+import (
+	"bufio"
+	"errors"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		code     int
+		enhanced string
+		lines    []string
+	}{
+		{"Single", "250 OK", 250, "", []string{"OK"}},
+		{"Enhanced", "550 5.1.1 User unknown\r\n", 550, "5.1.1", []string{"User unknown"}},
+		{"Code only", "354", 354, "", []string{""}},
+		{"Multi-line", "250-mx.example.com Hello\r\n250-SIZE 1024\r\n250 PIPELINING", 250, "",
+			[]string{"mx.example.com Hello", "SIZE 1024", "PIPELINING"}},
+		{"Multi-line enhanced", "451-4.7.1 Greylisted\n451 4.7.1 Try again later", 451, "4.7.1",
+			[]string{"Greylisted", "Try again later"}},
+		{"Class mismatch", "550 4.7.1 Odd", 550, "", []string{"4.7.1 Odd"}},
+		{"Not enhanced", "250 2.0 OK", 250, "", []string{"2.0 OK"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := Parse(test.raw)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if r.StatusCode() != test.code {
+				t.Errorf("code %d, expected %d", r.StatusCode(), test.code)
+			}
+			e, ok := r.EnhancedCode()
+			if ok != (test.enhanced != "") || (ok && e.String() != test.enhanced) {
+				t.Errorf("enhanced code %v %v, expected %q", e, ok, test.enhanced)
+			}
+			if !slices.Equal(r.Lines(), test.lines) {
+				t.Errorf("lines %q, expected %q", r.Lines(), test.lines)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"OK",
+		"25 OK",
+		"999 OK",
+		"250_OK",
+		"250-first\r\n251 second",
+		"250 first\r\n250 second",
+		"250-unterminated",
+	} {
+		if _, err := Parse(raw); !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("expected ErrInvalidReply for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, res := range []interface{ String() string }{
+		New(550, "No such user", "Bye").Enhanced(".1.1"),
+		FailUnrecognizedCmd,
+		ErrorGreylisted,
+		SuccessMailCmd,
+	} {
+		r, err := Parse(res.String())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if r.String() != res.String() {
+			t.Errorf("round trip %q, expected %q", r, res)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	in := "250-mx.example.com Hello\r\n250 SIZE 1024\r\n550 5.1.1 User unknown\r\n"
+	tp := textproto.NewReader(bufio.NewReader(strings.NewReader(in)))
+
+	r, err := ReadReply(tp)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(r.Lines()) != 2 || r.StatusCode() != 250 {
+		t.Errorf("unexpected reply %q", r)
+	}
+
+	r, err = ReadReply(tp)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if r.String() != "550 5.1.1 User unknown" {
+		t.Errorf("unexpected reply %q", r)
+	}
+}
+
+func TestDefaultEnhancedCode(t *testing.T) {
+	if e := DefaultEnhancedCode(430); e.String() != "4.5.1" {
+		t.Errorf("unexpected enhanced code %s", e)
+	}
+	if e := DefaultEnhancedCode(550); e.String() != "5.0.0" {
+		t.Errorf("unexpected enhanced code %s", e)
+	}
+	if c := (EnhancedStatusCode{ClassPermanentFailure, BadDestinationMailboxAddress}).BasicCode(); c != 550 {
+		t.Errorf("unexpected basic code %d", c)
+	}
+}
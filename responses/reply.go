@@ -0,0 +1,130 @@
+package responses
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Reply is a SMTP reply built from a basic code, an optional enhanced code and one or more lines of text.
+// It satisfies smtpx.Response, and can be returned from handlers, middlewares and hooks.
+//
+// Example usage:
+//
+//	responses.New(550).
+//		Enhanced(responses.BadDestinationMailboxAddress).
+//		Line("No such user here").
+//		Line("See https://example.com/bounce")
+//
+// is sent to the client as
+//
+//	550-5.1.1 No such user here
+//	550 5.1.1 See https://example.com/bounce
+type Reply struct {
+	code     int
+	enhanced subjectDetail
+	lines    []string
+}
+
+// New returns a reply with the basic code, e.g. 250, and the lines of text
+func New(code int, lines ...string) *Reply {
+	r := &Reply{code: code}
+	return r.Line(lines...)
+}
+
+// Enhanced sets the enhanced status code (RFC 3463), either as a subject and detail, e.g. BadDestinationMailboxAddress
+// or ".1.1", or as a full code, e.g. "5.1.1". The class is always the one of the basic code
+func (r *Reply) Enhanced(code string) *Reply {
+	if i := strings.IndexByte(code, '.'); i > 0 {
+		code = code[i:]
+	}
+	r.enhanced = subjectDetail(code)
+	return r
+}
+
+// Line adds lines of text to the reply, text containing line breaks is split into several lines
+func (r *Reply) Line(text ...string) *Reply {
+	for _, t := range text {
+		t = strings.ReplaceAll(t, "\r\n", "\n")
+		r.lines = append(r.lines, strings.Split(t, "\n")...)
+	}
+	return r
+}
+
+func (r *Reply) StatusCode() int {
+	return r.code
+}
+
+func (r *Reply) Class() int {
+	return r.code / 100
+}
+
+// EnhancedCode returns the enhanced status code, and false if it is not set
+func (r *Reply) EnhancedCode() (EnhancedStatusCode, bool) {
+	if r.enhanced == "" {
+		return EnhancedStatusCode{}, false
+	}
+	return EnhancedStatusCode{class(r.Class()), r.enhanced}, true
+}
+
+// Lines returns the lines of text, without codes
+func (r *Reply) Lines() []string {
+	return r.lines
+}
+
+// String returns the reply as it is sent on the wire, multiple lines are separated by \r\n
+// and all but the last line has a dash after the code
+func (r *Reply) String() string {
+	lines := r.lines
+	enhanced, hasEnhanced := r.EnhancedCode()
+	if len(lines) == 0 {
+		lines = []string{defaultText(EnhancedStatusCode{class(r.Class()), r.enhanced})}
+	}
+
+	code := strconv.Itoa(r.code)
+	var b strings.Builder
+	for i, line := range lines {
+		b.WriteString(code)
+		if i < len(lines)-1 {
+			b.WriteString("-")
+		} else {
+			b.WriteString(SP)
+		}
+		if hasEnhanced {
+			b.WriteString(enhanced.String())
+			b.WriteString(SP)
+		}
+		b.WriteString(line)
+		if i < len(lines)-1 {
+			b.WriteString("\r\n")
+		}
+	}
+	return b.String()
+}
+
+// defaultText returns the default text of an enhanced code, or of its class
+func defaultText(e EnhancedStatusCode) string {
+	if text := defaultTexts.m[e]; len(text) > 0 {
+		return text
+	}
+	switch e.Class {
+	case 2:
+		return "OK"
+	case 4:
+		return "Temporary failure."
+	case 5:
+		return "Permanent failure."
+	}
+	return ""
+}
+
+// Rephrase returns a reply with the codes of res but other text, e.g. to localize a canned response
+func Rephrase(res interface{ StatusCode() int }, lines ...string) *Reply {
+	r := New(res.StatusCode(), lines...)
+	switch v := res.(type) {
+	case *response:
+		r.enhanced = v.enhancedCode
+	case *Reply:
+		r.enhanced = v.enhanced
+	}
+	return r
+}
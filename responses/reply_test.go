@@ -0,0 +1,54 @@
+package responses
+
+import (
+	"testing"
+)
+
+func TestReplyString(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  *Reply
+		expect string
+	}{
+		{"Basic", New(250, "Ok"), "250 Ok"},
+		{"Default text", New(250), "250 OK"},
+		{"Default enhanced text", New(500).Enhanced(InvalidCommand), "500 5.5.1 Invalid command"},
+		{"Enhanced", New(451).Enhanced(".7.1").Line("Greylisted"), "451 4.7.1 Greylisted"},
+		{"Full enhanced", New(550).Enhanced("5.7.1").Line("Blocked"), "550 5.7.1 Blocked"},
+		{"Multi-line", New(550, "No such user", "See https://example.com").Enhanced(".1.1"),
+			"550-5.1.1 No such user\r\n550 5.1.1 See https://example.com"},
+		{"Line breaks", New(250).Line("first\r\nsecond\nthird"), "250-first\r\n250-second\r\n250 third"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.reply.String(); got != test.expect {
+				t.Errorf("Reply.String() = %q, expected %q", got, test.expect)
+			}
+		})
+	}
+}
+
+func TestReplyCodes(t *testing.T) {
+	r := New(451).Enhanced(".7.1")
+	if r.StatusCode() != 451 || r.Class() != ClassTransientFailure {
+		t.Errorf("unexpected code %d, class %d", r.StatusCode(), r.Class())
+	}
+	e, ok := r.EnhancedCode()
+	if !ok || e.String() != "4.7.1" {
+		t.Errorf("unexpected enhanced code %s", e)
+	}
+	if _, ok := New(250).EnhancedCode(); ok {
+		t.Errorf("expected no enhanced code")
+	}
+}
+
+func TestRephrase(t *testing.T) {
+	r := Rephrase(FailUnrecognizedCmd, "Okänt kommando")
+	if r.String() != "554 5.5.1 Okänt kommando" {
+		t.Errorf("unexpected rephrase %q", r)
+	}
+	r = Rephrase(New(451).Enhanced(".7.1"), "Försök igen senare")
+	if r.String() != "451 4.7.1 Försök igen senare" {
+		t.Errorf("unexpected rephrase %q", r)
+	}
+}
@@ -10,10 +10,9 @@ import (
 	"io"
 	"log/slog"
 	"net"
-	"net/mail"
 	"os"
+	"reflect"
 	"slices"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,6 +31,24 @@ type Server struct {
 	// Handler will be receiving envelopes after the Data command
 	Handler Handler
 
+	// Hooks are called during the SMTP session, before the DATA command, and can reject the client early
+	Hooks []Hooks
+
+	// Extensions are custom verbs and EHLO keywords, added to, or replacing, the built-in ones
+	Extensions []Extension
+
+	// Responses overrides the replies sent to clients, e.g. to brand or localize them. The keys are
+	// the canned responses of the responses package, i.e.
+	//
+	//	Responses: map[smtpx.Response]smtpx.Response{
+	//		responses.FailUnrecognizedCmd: responses.Rephrase(responses.FailUnrecognizedCmd, "Okänt kommando"),
+	//	}
+	Responses map[Response]Response
+
+	// Greeting returns the text of the 220 greeting, sent after the Hostname. Defaults to
+	// "SMTP <Name>(<Version>) #<connection id>  <time>", set it to hide the software name and version from clients
+	Greeting func(s *Session) string
+
 	// TLSConfig will be used when TLS is enabled
 	TLSConfig *tls.Config
 	// AlwaysOn run this Server as a pure TLS Server, i.e. SMTPS
@@ -72,11 +89,28 @@ type Server struct {
 	// the connection, defaults to defaultMaxUnrecognizedCommands = 5
 	MaxUnrecognizedCommands int
 
+	// GreetPause delays the greeting. Clients that send data before the greeting, which spam bots often do,
+	// are rejected as early talkers. With ProxyOn, the PROXY line sent by a proxy is not counted.
+	// Defaults to 0, i.e. disabled
+	GreetPause time.Duration
+
+	// TarpitDelay delays every reply to a client that has made errors, e.g. rejected recipients or unrecognized
+	// commands, by TarpitDelay per error. This slows down dictionary attacks. Defaults to 0, i.e. disabled
+	TarpitDelay time.Duration
+	// TarpitMaxDelay is the maximum delay of a reply when tarpitting, defaults to defaultTarpitMaxDelay = 30s
+	TarpitMaxDelay time.Duration
+
+	// Recorder records the SMTP sessions as transcripts, e.g. to reproduce the behavior of a misbehaving
+	// client in a test. Defaults to nil, i.e. disabled
+	Recorder *Recorder
+
 	listener         net.Listener
 	closedListener   chan struct{}
 	wgConnections    sync.WaitGroup
 	countConnections atomic.Int64
 
+	registry *registry
+
 	state int
 }
 
@@ -117,6 +151,12 @@ func (c *Server) setDefaults() error {
 		c.MaxUnrecognizedCommands = defaultMaxUnrecognizedCommands
 	}
 
+	if c.TarpitMaxDelay == 0 {
+		c.TarpitMaxDelay = defaultTarpitMaxDelay
+	}
+
+	c.registry = newRegistry(builtins(), c.Extensions)
+
 	if c.closedListener == nil {
 		c.closedListener = make(chan struct{})
 	}
@@ -130,34 +170,6 @@ type allowedHosts struct {
 	sync.Mutex                 // guard access to the map
 }
 
-type command string
-
-var (
-	cmdHELO     command = "HELO"
-	cmdEHLO     command = "EHLO"
-	cmdHELP     command = "HELP"
-	cmdXCLIENT  command = "XCLIENT"
-	cmdMAIL     command = "MAIL FROM:"
-	cmdRCPT     command = "RCPT TO:"
-	cmdRSET     command = "RSET"
-	cmdVRFY     command = "VRFY"
-	cmdNOOP     command = "NOOP"
-	cmdQUIT     command = "QUIT"
-	cmdDATA     command = "DATA"
-	cmdSTARTTLS command = "STARTTLS"
-	cmdPROXY    command = "PROXY "
-)
-
-var commands = []command{cmdHELO, cmdEHLO, cmdXCLIENT, cmdMAIL, cmdRCPT, cmdRSET, cmdVRFY, cmdNOOP, cmdQUIT, cmdDATA, cmdSTARTTLS, cmdPROXY, cmdHELP}
-
-func (c command) match(cmd string) bool {
-	return strings.HasPrefix(strings.ToUpper(cmd), string(c))
-}
-
-func (c command) content(in string) string {
-	return strings.TrimSpace(in[len(c):]) // since we accept mixed cases here...
-}
-
 // ListenAndServe begin accepting SMTP clients. Will block unless there is an error or Server.Shutdown() is called
 func (s *Server) ListenAndServe() error {
 	err := s.setDefaults()
@@ -165,17 +177,29 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
-	log := s.log().With("inf", s.Addr)
-
-	var connectionId uint64
-
-	s.listener, err = net.Listen("tcp", s.Addr)
+	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		s.state = ServerStateStartError
 		return fmt.Errorf("cannot listen on %s, err %w ", s.Addr, err)
 	}
+	return s.Serve(l)
+}
+
+// Serve accepts SMTP clients on the listener, e.g. one with custom socket options, or an in-memory one in tests.
+// Addr is not used. Will block until the listener is closed or Server.Shutdown() is called
+func (s *Server) Serve(l net.Listener) error {
+	err := s.setDefaults()
+	if err != nil {
+		return err
+	}
+
+	log := s.log().With("inf", l.Addr().String())
 
-	log.Info("Listening on TCP")
+	var connectionId uint64
+
+	s.listener = l
+
+	log.Info("Listening on " + l.Addr().Network())
 	s.state = ServerStateRunning
 
 	for {
@@ -200,7 +224,10 @@ func (s *Server) ListenAndServe() error {
 			defer s.countConnections.Add(-1)
 			defer conn.Close()
 
-			s.handleConn(newConnection(conn, s.MaxSize, clientID, s.Logger))
+			c := newConnection(conn, s.MaxSize, clientID, s.Logger)
+			c.tarpit = s.tarpit
+			c.override = s.response
+			s.handleConn(c)
 
 		}(conn, connectionId)
 	}
@@ -241,38 +268,19 @@ func (s *Server) handleConn(conn *connection) {
 	conn.log.Info("Handle connection")
 	defer conn.log.Info("Close connection")
 
-	// Initial greeting
-	greeting := fmt.Sprintf("220 %s SMTP %s(%s) #%d  %s",
-		s.Hostname, Name, Version, conn.ID, time.Now().Format(time.RFC3339))
-
-	helo := fmt.Sprintf("250 %s Hello", s.Hostname)
-	// ehlo is a multi-line reply and need additional \r\n at the end
-	ehlo := fmt.Sprintf("250-%s Hello\r\n", s.Hostname)
-
-	// Extended feature advertisements
-	messageSize := fmt.Sprintf("250-SIZE %d\r\n", s.MaxSize)
-	extPipelining := "250-PIPELINING\r\n"
-	extTLS := "250-STARTTLS\r\n"
-	extEnhancedStatusCodes := "250-ENHANCEDSTATUSCODES\r\n"
-	extUFF8 := "250-SMTPUTF8\r\n"
-	// The last line doesn't need \r\n since string will be printed as a new line.
-	// Also, Last line has no dash -
-	help := "250 HELP"
+	session := &Session{server: s, conn: conn}
+	if s.Recorder != nil {
+		conn.record(s.Recorder, session)
+	}
 
 	if s.TLSAlwaysOn && s.TLSConfig != nil {
-		if err := conn.upgradeTLS(s.TLSConfig); err == nil {
-			extTLS = ""
-		} else {
+		if err := conn.upgradeTLS(s.TLSConfig); err != nil {
 			conn.log.Warn("Failed TLS handshake", "err", err)
 			// Server requires TLS, but can't handshake
 			conn.kill()
 			return
 		}
 	}
-	if s.TLSConfig == nil {
-		// STARTTLS turned off, don't advertise it
-		extTLS = ""
-	}
 
 	for conn.isAlive() {
 		if conn.bufErr != nil {
@@ -282,7 +290,24 @@ func (s *Server) handleConn(conn *connection) {
 
 		switch conn.state {
 		case ConnGreeting:
-			conn.sendResponse(greeting)
+			// behind a proxy, the client is not known until PROXY or XCLIENT is sent
+			if !s.ProxyOn && !s.XClientOn && !s.connect(conn) {
+				return
+			}
+			if s.GreetPause > 0 {
+				early, err := conn.earlyTalker(s.GreetPause, s.ProxyOn)
+				if err != nil {
+					conn.log.Warn("Client closed the connection before greeting", "err", err)
+					return
+				}
+				if early {
+					conn.log.Debug("Client talked before the greeting")
+					conn.sendResponse(responses.FailEarlyTalker)
+					conn.kill()
+					return
+				}
+			}
+			conn.sendResponse(s.greeting(session))
 			conn.state = ConnCmd
 			continue
 
@@ -313,231 +338,9 @@ func (s *Server) handleConn(conn *connection) {
 				continue
 			}
 
-			switch {
-			case cmdHELO.match(cmd):
-				// Client: HELO example.com
-				// The client sends the HELO command, followed by its own fully qualified domain name (FQDN) or IP address.
-				// HELO is the older "Hello" command, used in basic SMTP sessions
-				//  (as opposed to the extended ESMTP sessions initiated by EHLO).
-				//
-				// helo = "HELO" SP Domain CRLF
-				// HELO example.com\r\n
-				// HELO 192.168.1.10\r\n
-				conn.resetTransaction()
-
-				content := cmdHELO.content(cmd)
-				conn.Helo = strings.TrimSpace(content) // TODO parse domain or IP address
-
-				conn.sendResponse(helo)
-				continue
-
-			case cmdEHLO.match(cmd):
-				// Client: EHLO example.com
-				// The client sends the EHLO command, followed by its own fully qualified domain name (FQDN) or IP address.
-				// Client is saying "Hello, I am example.com, and I would like to establish an ESMTP connection."
-				//
-				// ehlo = "EHLO" SP ( Domain / address-literal ) CRLF
-				//  - SP is a single space
-				//  - Domain: A fully qualified domain name (FQDN).
-				//  - address-literal: An IP address enclosed in square brackets
-				// EHLO mail.example.com\r\n
-				// EHLO [192.168.1.10]\r\n
-				// EHLO [IPv6:2001:0db8:85a3:0000:0000:8a2e:0370:7334]\r\n
-
-				conn.resetTransaction()
-
-				content := cmdHELO.content(cmd)
-				conn.Helo = content
-				conn.ESMTP = true
-
-				conn.sendResponse(ehlo,
-					messageSize,
-					extPipelining,
-					extTLS,
-					extEnhancedStatusCodes,
-					extUFF8,
-					help)
-				continue
-
-			case cmdHELP.match(cmd):
-				// Client: HELP
-				// Server: 214-Supported commands:
-				// Server: 214-HELO EHLO MAIL RCPT DATA RSET NOOP QUIT VRFY EXPN HELP
-				// Server: 214 End of HELP info
-				coms := make([]string, 0, len(commands))
-				for _, c := range commands {
-					c := string(c)
-					c, _, _ = strings.Cut(c, " ")
-					coms = append(coms, c)
-				}
-
-				conn.sendResponse(
-					"214-Supported commands:\r\n",
-					fmt.Sprintf("214-%s\r\n", strings.Join(coms, " ")),
-					"214 End of HELP info")
-				continue
-
-			case cmdXCLIENT.match(cmd) && s.XClientOn:
-				// Client: XCLIENT ADDR=192.168.1.10 NAME=client.example.com PROTO=ESMTP AUTH=user@example.com
-				// The XCLIENT command is another Extended SMTP (ESMTP) command, but it's not standardized in the
-				// official RFCs. It's used by some mail servers, primarily Postfix, to provide client information to
-				// the server before the MAIL FROM command. This is particularly useful in situations where a proxy or
-				// load balancer is involved.
-				content := cmdXCLIENT.content(cmd)
-				toks := strings.Fields(content)
-				for _, tok := range toks {
-					key, val, found := strings.Cut(tok, "=")
-					if found {
-						if val == "[UNAVAILABLE]" {
-							continue
-						}
-						if key == "ADDR" {
-							ip := net.ParseIP(string(val))
-							conn.RemoteAddr = &net.TCPAddr{IP: ip}
-						}
-						if key == "HELO" {
-							conn.Helo = val
-						}
-					}
-				}
-				conn.sendResponse(responses.SuccessMailCmd)
-				continue
-
-			case cmdPROXY.match(cmd) && s.ProxyOn:
-				// Client: PROXY TCP4 remote.host.example.com 192.168.1.10 192.168.1.20 5000 6000
-				// PROXY
-				// - TCP4: Protocol version.
-				// - remote.host.example.com: The hostname of the connecting client.
-				// - 192.168.1.10: The client's IP address.
-				// - 192.168.1.20: The proxy's IP address.
-				// - 5000: The client's source port.
-				// - 6000: The proxy's destination port.
-				content := strings.TrimSpace(cmdPROXY.content(cmd))
-				toks := strings.Fields(content)
-				conn.log.Debug("PROXY", "command", content)
-
-				switch len(toks) {
-				case 5:
-					ip := net.ParseIP(toks[1])
-					conn.RemoteAddr = &net.TCPAddr{IP: ip}
-					conn.sendResponse(greeting)
-					continue
-				case 6:
-					ip := net.ParseIP(toks[2])
-					conn.RemoteAddr = &net.TCPAddr{IP: ip}
-					conn.sendResponse(greeting)
-					continue
-				default:
-					conn.log.Debug("PROXY, parse error, expected 5 or 6 parts", "data", content)
-					conn.sendResponse(responses.FailSyntaxError)
-					continue
-				}
-
-			case cmdMAIL.match(cmd):
-				// Client: MAIL FROM:<sender@example.com>
-				// This is the SMTP command that specifies the sender's email address.
-				// Used for the Return-Path header
-				if conn.isInTransaction() {
-					conn.sendResponse(responses.FailNestedMailCmd)
-					conn.errors++
-					continue
-				}
-				content := cmdMAIL.content(cmd)
-				addr, charser, _ := strings.Cut(content, " ")
-				if charser == CharsetUtf8 {
-					conn.charset = CharsetUtf8
-					conn.Envelope.UTF8 = true
-				}
-				conn.MailFrom, err = mail.ParseAddress(addr)
-				if err != nil {
-					conn.log.Debug("MAIL, parse error", "data", "["+string(content)+"]", "err", err)
-					conn.sendResponse(responses.RejectedSenderMailCmd)
-					conn.errors++
-					continue
-				}
-
-				// TODO CMD add hook system
-
-				conn.sendResponse(responses.SuccessMailCmd)
-				continue
-
-			case cmdRCPT.match(cmd):
-				// Client: RCPT TO:<recipient@example.com>
-				// This is the SMTP command that specifies the recipient's email address.
-				if len(conn.RcptTo) > s.MaxRecipients {
-					conn.sendResponse(responses.ErrorTooManyRecipients)
-					conn.errors++
-					continue
-				}
-				content := cmdRCPT.content(cmd)
-				to, err := mail.ParseAddress(content)
-				if err != nil {
-					conn.log.Debug("RCPT, parse error", "data", content, "err", err)
-					conn.sendResponse(responses.FailSyntaxError)
-					conn.errors++
-					continue
-				}
-
-				// TODO CMD add hook system
-
-				conn.RcptTo = append(conn.RcptTo, to)
-				conn.sendResponse(responses.SuccessRcptCmd)
-				continue
-
-			case cmdRSET.match(cmd):
-				// Client: RSET
-				// The client then decides to abort this transaction and sends the RSET command.
-				conn.resetTransaction()
-				conn.sendResponse(responses.SuccessResetCmd)
-				continue
-
-			case cmdVRFY.match(cmd):
-				// Client: VRFY user@example.com
-				//The SMTP VRFY command is designed to verify the existence of a mailbox or user on a mail serve
-				//Due to these security concerns, most modern SMTP servers have disabled or severely restricted the VRFY command.
-				conn.sendResponse(responses.SuccessVerifyCmd)
-				continue
-
-			case cmdNOOP.match(cmd):
-				// Client: NOOP
-				// Its primary purpose is to:
-				// - Check if the server is still alive and responsive.
-				// - Keep the connection alive during periods of inactivity.
-				// - Test the server's response.
-				conn.sendResponse(responses.SuccessNoopCmd)
-				continue
-
-			case cmdQUIT.match(cmd):
-				// Client: QUIT
-				// The QUIT command is the standard way for an SMTP client to gracefully close a connection to an SMTP server.
-				conn.sendResponse(responses.SuccessQuitCmd)
-				conn.kill()
-				return
-
-			case cmdDATA.match(cmd):
-				// Client: DATA
-				// The DATA command in SMTP is used to initiate the transfer of the email message content,
-				if len(conn.RcptTo) == 0 {
-					conn.sendResponse(responses.FailNoRecipientsDataCmd)
-					break
-				}
-				conn.sendResponse(responses.SuccessDataCmd)
-				conn.state = ConnData
-
-			case cmdSTARTTLS.match(cmd):
-				// Client: STARTTLS
-				// Server: 220 2.0.0 Ready to start TLS
-				// [TLS handshake occurs here]
-
-				if s.TLSConfig == nil {
-					conn.sendResponse(responses.FailCommandNotImplemented)
-					continue
-				}
-
-				conn.sendResponse(responses.SuccessStartTLSCmd)
-				conn.state = ConnStartTLS
-				continue
-			default:
+			verb, args := splitCommand(cmd)
+			ext, found := s.registry.lookup(verb)
+			if !found || !ext.enabled(session) {
 				conn.errors++
 				if conn.errors >= s.MaxUnrecognizedCommands {
 					conn.sendResponse(responses.FailMaxUnrecognizedCmd)
@@ -545,22 +348,34 @@ func (s *Server) handleConn(conn *connection) {
 				} else {
 					conn.sendResponse(responses.FailUnrecognizedCmd)
 				}
+				continue
 			}
+			if !ext.allowed(session.Phase()) {
+				conn.sendResponse(responses.FailBadSequence)
+				conn.errors++
+				continue
+			}
+			if s.connectsBefore(verb) && !s.connect(conn) {
+				continue
+			}
+			ext.Handler(session, args)
+			continue
 
 		case ConnData:
 
 			_, err := conn.Envelope.Data.ReadFrom(conn.in.DotReader())
+			conn.recordData(err == nil)
 
 			if errors.Is(err, LimitError) {
 				conn.log.Debug("DATA, to much data sent", "err", err)
-				conn.sendResponse(responses.FailMessageSizeExceeded, " ", LimitError.Error())
+				conn.sendResponse(responses.FailMessageSizeExceeded)
 				conn.kill()
 				continue
 			}
 
 			if err != nil {
 				conn.log.Warn("DATA, error reading data", "err", err)
-				conn.sendResponse(responses.FailReadErrorDataCmd, " ", err.Error())
+				conn.sendResponse(responses.FailReadErrorDataCmd)
 				conn.kill()
 				continue
 			}
@@ -629,8 +444,7 @@ func (s *Server) handleConn(conn *connection) {
 				conn.state = ConnCmd
 				continue
 			}
-			extTLS = ""
-			conn.resetTransaction()
+			conn.resetSession()
 			conn.state = ConnCmd
 			continue
 
@@ -644,6 +458,25 @@ func (s *Server) handleConn(conn *connection) {
 	}
 }
 
+// response returns the override of res in Responses, or res itself
+func (s *Server) response(res Response) Response {
+	if len(s.Responses) == 0 || res == nil || !reflect.TypeOf(res).Comparable() {
+		return res
+	}
+	if override, found := s.Responses[res]; found && override != nil {
+		return override
+	}
+	return res
+}
+
+// tarpit returns the delay of a reply to a client that has made errors
+func (s *Server) tarpit(errors int) time.Duration {
+	if s.TarpitDelay <= 0 || errors <= 0 {
+		return 0
+	}
+	return min(s.TarpitDelay*time.Duration(errors), s.TarpitMaxDelay)
+}
+
 func (s *Server) log() *slog.Logger {
 	if s.Logger == nil {
 		return noopLogger()
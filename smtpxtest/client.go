@@ -0,0 +1,183 @@
+package smtpxtest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Reply is a reply read by a Client
+type Reply struct {
+	Code int
+	// Enhanced is the enhanced status code of the first line, e.g. "2.1.0", empty if there is none
+	Enhanced string
+	// Lines is the text of each line, without the codes
+	Lines []string
+}
+
+func (r Reply) String() string {
+	if r.Enhanced != "" {
+		return fmt.Sprintf("%d %s %s", r.Code, r.Enhanced, strings.Join(r.Lines, "\n"))
+	}
+	return fmt.Sprintf("%d %s", r.Code, strings.Join(r.Lines, "\n"))
+}
+
+var enhancedCode = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(?: |$)`)
+
+// Client sends raw commands to a server and checks the replies, failing the test on unexpected ones
+type Client struct {
+	t    testing.TB
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// NewClient returns a client on the connection. The greeting is not read, see Server.Client
+func NewClient(t testing.TB, conn net.Conn) *Client {
+	return &Client{t: t, conn: conn, text: textproto.NewConn(conn)}
+}
+
+// Conn returns the connection, which is a *tls.Conn after StartTLS
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Send writes the lines without reading any replies, e.g. to pipeline commands
+func (c *Client) Send(lines ...string) {
+	c.t.Helper()
+	for _, line := range lines {
+		if err := c.text.PrintfLine("%s", line); err != nil {
+			c.t.Fatalf("smtpxtest: could not send %q: %v", line, err)
+		}
+	}
+}
+
+// Read reads the next reply
+func (c *Client) Read() Reply {
+	c.t.Helper()
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		c.t.Fatalf("smtpxtest: could not read reply: %v", err)
+	}
+	r := Reply{Code: code}
+	for i, line := range strings.Split(msg, "\n") {
+		if m := enhancedCode.FindStringSubmatch(line); m != nil {
+			if i == 0 {
+				r.Enhanced = m[1]
+			}
+			line = strings.TrimPrefix(line[len(m[1]):], " ")
+		}
+		r.Lines = append(r.Lines, line)
+	}
+	return r
+}
+
+// Cmd sends a command and reads its reply
+func (c *Client) Cmd(cmd string) Reply {
+	c.t.Helper()
+	c.Send(cmd)
+	return c.Read()
+}
+
+// Expect reads the next reply and checks its code, and its enhanced code if given
+func (c *Client) Expect(code int, enhanced ...string) Reply {
+	c.t.Helper()
+	r := c.Read()
+	c.check("reply", r, code, enhanced...)
+	return r
+}
+
+// ExpectCmd sends a command and checks its reply like Expect
+func (c *Client) ExpectCmd(cmd string, code int, enhanced ...string) Reply {
+	c.t.Helper()
+	r := c.Cmd(cmd)
+	c.check(cmd, r, code, enhanced...)
+	return r
+}
+
+func (c *Client) check(what string, r Reply, code int, enhanced ...string) {
+	c.t.Helper()
+	if r.Code != code || (len(enhanced) > 0 && r.Enhanced != enhanced[0]) {
+		c.t.Fatalf("smtpxtest: %s: got %q, want %d %s", what, r, code, strings.Join(enhanced, " "))
+	}
+}
+
+// Run runs a script of commands and expected replies, one per line. Lines starting with C: are sent, and lines
+// starting with S: read a reply and check its code, its enhanced code and text if given. The text must be
+// contained in the reply. Commands are sent until the next S: line, so several C: lines are pipelined. Blank
+// lines and lines starting with # are skipped, e.g.
+//
+//	C: MAIL FROM:<sender@example.com>
+//	C: RCPT TO:<rcpt@example.com>
+//	S: 250 2.1.0
+//	S: 550 5.1.1 No such user
+func (c *Client) Run(script string) {
+	c.t.Helper()
+	for n, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, arg, _ := strings.Cut(line, ":")
+		arg = strings.TrimPrefix(arg, " ")
+		switch strings.ToUpper(kind) {
+		case "C":
+			c.Send(arg)
+		case "S":
+			code, rest, _ := strings.Cut(arg, " ")
+			want, err := strconv.Atoi(code)
+			if err != nil {
+				c.t.Fatalf("smtpxtest: line %d: invalid reply code %q", n+1, code)
+			}
+			var enhanced []string
+			if m := enhancedCode.FindStringSubmatch(rest); m != nil {
+				enhanced = []string{m[1]}
+				rest = strings.TrimPrefix(rest[len(m[1]):], " ")
+			}
+			r := c.Read()
+			c.check(fmt.Sprintf("line %d", n+1), r, want, enhanced...)
+			if !strings.Contains(strings.Join(r.Lines, "\n"), rest) {
+				c.t.Fatalf("smtpxtest: line %d: got %q, want %q", n+1, r, arg)
+			}
+		default:
+			c.t.Fatalf("smtpxtest: line %d: expected C: or S:, got %q", n+1, line)
+		}
+	}
+}
+
+// StartTLS sends STARTTLS, expects a 220 and makes the TLS handshake. EHLO must be sent again afterwards
+func (c *Client) StartTLS(config *tls.Config) {
+	c.t.Helper()
+	c.ExpectCmd("STARTTLS", 220)
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		c.t.Fatalf("smtpxtest: TLS handshake failed: %v", err)
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+}
+
+// Data sends DATA, expects a 354, and sends the message with dot-stuffing. It returns the reply to the message
+func (c *Client) Data(message string) Reply {
+	c.t.Helper()
+	c.ExpectCmd("DATA", 354)
+	w := c.text.DotWriter()
+	if _, err := w.Write([]byte(message)); err != nil {
+		c.t.Fatalf("smtpxtest: could not send message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		c.t.Fatalf("smtpxtest: could not send message: %v", err)
+	}
+	return c.Read()
+}
+
+// Close sends QUIT and closes the connection, without checking the reply
+func (c *Client) Close() {
+	_ = c.text.PrintfLine("QUIT")
+	_, _, _ = c.text.ReadResponse(0)
+	_ = c.text.Close()
+}
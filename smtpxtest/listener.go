@@ -0,0 +1,258 @@
+package smtpxtest
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener is an in-memory net.Listener. Connections made with Dial are queued until accepted, so a client can
+// connect before the server has started to serve, and no ports are used.
+//
+// Unlike net.Pipe, writes are buffered and do not wait for the peer to read, which lets a client pipeline
+// commands like it would over TCP
+type Listener struct {
+	addr  net.Addr
+	conns chan *Conn
+
+	mu     sync.Mutex
+	open   []*Conn
+	port   uint16
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewListener returns a listener with the address 127.0.0.1:25
+func NewListener() *Listener {
+	return &Listener{
+		addr:   net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:25")),
+		conns:  make(chan *Conn),
+		port:   49152,
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection, returning net.ErrClosed once the listener is closed
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and closes the ones that were made, so that a server waiting for its
+// clients to finish returns
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, c := range l.open {
+			_ = c.Close()
+		}
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial connects to the listener from 127.0.0.1, with a new port for each connection
+func (l *Listener) Dial() (net.Conn, error) {
+	l.mu.Lock()
+	l.port++
+	port := l.port
+	l.mu.Unlock()
+	return l.DialFrom(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port))
+}
+
+// DialFrom connects to the listener, with remote as the address of the client seen by the server
+func (l *Listener) DialFrom(remote netip.AddrPort) (net.Conn, error) {
+	client, server := Pipe(remote, netip.MustParseAddrPort(l.addr.String()))
+
+	l.mu.Lock()
+	select {
+	case <-l.closed:
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	l.open = append(l.open, client, server)
+	l.mu.Unlock()
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Pipe returns the two ends of a buffered in-memory connection between the addresses
+func Pipe(client, server netip.AddrPort) (*Conn, *Conn) {
+	toServer, toClient := newBuffer(), newBuffer()
+	clientAddr, serverAddr := net.TCPAddrFromAddrPort(client), net.TCPAddrFromAddrPort(server)
+	return &Conn{rx: toClient, tx: toServer, local: clientAddr, remote: serverAddr, closed: make(chan struct{})},
+		&Conn{rx: toServer, tx: toClient, local: serverAddr, remote: clientAddr, closed: make(chan struct{})}
+}
+
+// Conn is one end of a connection made by Pipe
+type Conn struct {
+	rx, tx        *buffer
+	local, remote net.Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        chan struct{}
+	once          sync.Once
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.rx.read(p, c.closed, func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.readDeadline
+	})
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.tx.write(p)
+}
+
+// Close closes the connection. The peer reads what was written before io.EOF
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.tx.close()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	// wake a waiting reader to check the new deadline
+	c.rx.signal()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// buffer holds the data written to one direction of a connection, until it is read
+type buffer struct {
+	mu     sync.Mutex
+	data   []byte
+	eof    bool
+	notify chan struct{}
+}
+
+func newBuffer() *buffer {
+	return &buffer{notify: make(chan struct{})}
+}
+
+// signal wakes the readers waiting for data
+func (b *buffer) signal() {
+	b.mu.Lock()
+	close(b.notify)
+	b.notify = make(chan struct{})
+	b.mu.Unlock()
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.eof {
+		b.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.mu.Unlock()
+	b.signal()
+	return len(p), nil
+}
+
+func (b *buffer) close() {
+	b.mu.Lock()
+	b.eof = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+func (b *buffer) read(p []byte, closed <-chan struct{}, deadline func() time.Time) (int, error) {
+	for {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		b.mu.Lock()
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.eof {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		wait := b.notify
+		b.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if d := deadline(); !d.IsZero() {
+			left := time.Until(d)
+			if left <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(left)
+			timeout = timer.C
+		}
+		select {
+		case <-wait:
+		case <-closed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package smtpxtest provides utilities for testing smtpx servers, middlewares and handlers, like net/http/httptest.
+//
+// A Server serves an smtpx.Server on an in-memory Listener, so tests use no ports and do not need to wait for
+// the server to start. The envelopes that reach the handler are captured on a channel, and a scripted Client
+// sends raw commands and checks the replies and their enhanced codes.
+//
+// Example usage:
+//
+//	srv := smtpxtest.NewServer(t, &smtpx.Server{Middlewares: []smtpx.Middleware{mw}})
+//	c := srv.Client()
+//	c.Run(`
+//		C: EHLO client.example.com
+//		S: 250
+//		C: MAIL FROM:<sender@example.com>
+//		S: 250 2.1.0
+//		C: RCPT TO:<rcpt@example.com>
+//		S: 250 2.1.5
+//	`)
+//	c.Data("Subject: Hello\r\n\r\nHi\r\n")
+//	e := srv.Receive()
+package smtpxtest
+
+import (
+	"context"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+// Hostname is the hostname of servers that do not set one, and the name in the certificate of NewTLSServer
+const Hostname = "mx.example.com"
+
+// ReceiveTimeout is how long Server.Receive waits for an envelope
+var ReceiveTimeout = 5 * time.Second
+
+// Server is an smtpx.Server serving on an in-memory Listener
+type Server struct {
+	*smtpx.Server
+
+	Listener *Listener
+	// Envelopes receives the envelopes that reached the handler, before it is called
+	Envelopes <-chan *envelope.Envelope
+	// TLS holds the certificates of a server started by NewTLSServer, nil otherwise
+	TLS *TLS
+
+	t    testing.TB
+	done chan struct{}
+}
+
+// NewServer starts the server on an in-memory listener, and closes it when the test ends. The envelopes that
+// reach Handler are sent to Envelopes, and accepted with a 250 if Handler is nil. A nil server is a server
+// with the defaults
+func NewServer(t testing.TB, server *smtpx.Server) *Server {
+	t.Helper()
+	return start(t, server, nil)
+}
+
+// NewTLSServer is like NewServer, but with a TLSConfig for STARTTLS, using certificates for Hostname signed by
+// a CA in TLS
+func NewTLSServer(t testing.TB, server *smtpx.Server) *Server {
+	t.Helper()
+	if server == nil {
+		server = &smtpx.Server{}
+	}
+	if server.Hostname == "" {
+		server.Hostname = Hostname
+	}
+	fixtures, err := NewTLS(server.Hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLSConfig = fixtures.ServerConfig()
+	return start(t, server, fixtures)
+}
+
+func start(t testing.TB, server *smtpx.Server, fixtures *TLS) *Server {
+	if server == nil {
+		server = &smtpx.Server{}
+	}
+	if server.Hostname == "" {
+		server.Hostname = Hostname
+	}
+
+	envelopes := make(chan *envelope.Envelope, 100)
+	next := server.Handler
+	server.Handler = smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+		select {
+		case envelopes <- e:
+		default:
+			t.Error("smtpxtest: envelope dropped, call Receive to drain Envelopes")
+		}
+		if next == nil {
+			return nil
+		}
+		return next.Data(e)
+	})
+
+	s := &Server{
+		Server:    server,
+		Listener:  NewListener(),
+		Envelopes: envelopes,
+		TLS:       fixtures,
+		t:         t,
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		if err := server.Serve(s.Listener); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Dial connects to the server from 127.0.0.1
+func (s *Server) Dial() net.Conn {
+	s.t.Helper()
+	conn, err := s.Listener.Dial()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return conn
+}
+
+// Client connects to the server and reads the 220 greeting
+func (s *Server) Client() *Client {
+	s.t.Helper()
+	c := NewClient(s.t, s.Dial())
+	c.Expect(220)
+	return c
+}
+
+// SMTPClient connects to the server with net/smtp, for tests of full transactions
+func (s *Server) SMTPClient() *smtp.Client {
+	s.t.Helper()
+	c, err := smtp.NewClient(s.Dial(), s.Hostname)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return c
+}
+
+// Receive returns the next envelope that reached the handler, failing the test if none does within
+// ReceiveTimeout
+func (s *Server) Receive() *envelope.Envelope {
+	s.t.Helper()
+	select {
+	case e := <-s.Envelopes:
+		return e
+	case <-time.After(ReceiveTimeout):
+		s.t.Fatal("smtpxtest: no envelope received")
+		return nil
+	}
+}
+
+// Close closes the listener and all connections, and waits for the server to stop
+func (s *Server) Close() {
+	_ = s.Listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.t.Error("smtpxtest: server did not stop")
+	}
+}
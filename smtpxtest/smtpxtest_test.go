@@ -0,0 +1,124 @@
+package smtpxtest
+
+import (
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/mail"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer(t, &smtpx.Server{
+		Hooks: []smtpx.Hooks{{
+			Rcpt: func(e *envelope.Envelope, rcpt *mail.Address) smtpx.Response {
+				if strings.HasPrefix(rcpt.Address, "unknown@") {
+					return responses.New(550).Enhanced(responses.BadDestinationMailboxAddress).Line("No such user here")
+				}
+				return nil
+			},
+		}},
+	})
+
+	c := srv.Client()
+	c.Run(`
+		C: EHLO client.example.com
+		S: 250 PIPELINING
+		# pipelined
+		C: MAIL FROM:<sender@example.com>
+		C: RCPT TO:<unknown@example.com>
+		C: RCPT TO:<rcpt@example.com>
+		S: 250 2.1.0
+		S: 550 5.1.1 No such user
+		S: 250 2.1.5
+	`)
+	res := c.Data("Subject: Hello\r\n\r\n.dotted\r\n")
+	assert.Equal(t, 250, res.Code)
+	assert.Equal(t, "2.0.0", res.Enhanced)
+	c.Close()
+
+	e := srv.Receive()
+	assert.Equal(t, "sender@example.com", e.MailFrom.Address)
+	require.Len(t, e.RcptTo, 1)
+	assert.Equal(t, "rcpt@example.com", e.RcptTo[0].Address)
+	assert.Contains(t, e.Data.String(), "\n.dotted")
+	assert.Equal(t, "127.0.0.1", e.Remote.Addr().String())
+}
+
+func TestDialFrom(t *testing.T) {
+	srv := NewServer(t, nil)
+	conn, err := srv.Listener.DialFrom(netip.MustParseAddrPort("192.0.2.1:4321"))
+	require.NoError(t, err)
+
+	c := NewClient(t, conn)
+	c.Expect(220)
+	c.ExpectCmd("HELO client.example.com", 250)
+	c.ExpectCmd("MAIL FROM:<sender@example.com>", 250, "2.1.0")
+	c.ExpectCmd("RCPT TO:<rcpt@example.com>", 250, "2.1.5")
+	c.Data("Subject: Hello\r\n\r\nHi\r\n")
+
+	assert.Equal(t, "192.0.2.1:4321", srv.Receive().Remote.String())
+}
+
+func TestTLSServer(t *testing.T) {
+	srv := NewTLSServer(t, nil)
+
+	t.Run("Client", func(t *testing.T) {
+		c := srv.Client()
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.StartTLS(srv.TLS.ClientConfig(Hostname))
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.ExpectCmd("MAIL FROM:<sender@example.com>", 250)
+		c.ExpectCmd("RCPT TO:<rcpt@example.com>", 250)
+		c.Data("Subject: Hello\r\n\r\nHi\r\n")
+		c.Close()
+
+		assert.True(t, srv.Receive().TLS)
+	})
+
+	t.Run("SMTPClient", func(t *testing.T) {
+		c := srv.SMTPClient()
+		require.NoError(t, c.StartTLS(srv.TLS.ClientConfig(Hostname)))
+		require.NoError(t, c.Mail("sender@example.com"))
+		require.NoError(t, c.Rcpt("rcpt@example.com"))
+		w, err := c.Data()
+		require.NoError(t, err)
+		_, _ = io.WriteString(w, "Subject: Hello\r\n\r\nHi\r\n")
+		require.NoError(t, w.Close())
+		require.NoError(t, c.Quit())
+
+		e := srv.Receive()
+		assert.True(t, e.TLS)
+		assert.Contains(t, e.Data.String(), "Subject: Hello")
+	})
+}
+
+func TestConn(t *testing.T) {
+	client, server := Pipe(netip.MustParseAddrPort("127.0.0.1:1"), netip.MustParseAddrPort("127.0.0.1:2"))
+
+	_, err := client.Write([]byte("buffered"))
+	require.NoError(t, err, "writes do not wait for the reader")
+	b := make([]byte, 16)
+	n, err := server.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "buffered", string(b[:n]))
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = server.Read(b)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	_, _ = client.Write([]byte("last"))
+	require.NoError(t, client.Close())
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	n, _ = server.Read(b)
+	assert.Equal(t, "last", string(b[:n]))
+	_, err = server.Read(b)
+	assert.ErrorIs(t, err, io.EOF)
+}
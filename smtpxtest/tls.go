@@ -0,0 +1,104 @@
+package smtpxtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// TLS holds a root CA and a server certificate signed by it, for tests of STARTTLS and SMTPS
+type TLS struct {
+	// CA is the root certificate that signed the server certificate
+	CA *x509.Certificate
+	// RootCAs is a pool holding only CA
+	RootCAs *x509.CertPool
+	// Certificate is the server certificate and its key, valid for the hostnames
+	Certificate tls.Certificate
+}
+
+// NewTLS returns a root CA and a server certificate for the hostnames, using ECDSA P-256 keys so that tests
+// do not spend time generating RSA keys
+func NewTLS(hostnames ...string) (*TLS, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "smtpxtest Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: first(hostnames)},
+		DNSNames:     hostnames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &TLS{
+		CA:          ca,
+		RootCAs:     pool,
+		Certificate: tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key},
+	}, nil
+}
+
+// ServerConfig returns a config that serves the certificate
+func (t *TLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// ClientConfig returns a config that trusts the CA, for connecting to serverName
+func (t *TLS) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		RootCAs:    t.RootCAs,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+func serial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+func first(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	return s[0]
+}
@@ -0,0 +1,234 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/utils"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Status of the delivery to a recipient
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Recipient of a queued message, and the outcome of the last delivery attempt
+type Recipient struct {
+	Address string `json:"address"`
+	Status  Status `json:"status"`
+
+	// Code and Response are the last reply, e.g. 451 and "451 4.7.1 Greylisted"
+	Code     int    `json:"code,omitempty"`
+	Response string `json:"response,omitempty"`
+	// Host is the mail exchanger that gave the reply
+	Host string `json:"host,omitempty"`
+}
+
+// Domain returns the domain of the recipient address
+func (r *Recipient) Domain() string {
+	return utils.DomainOfEmail(&mail.Address{Address: r.Address})
+}
+
+// Message is the metadata of a queued message, the data is stored beside it
+type Message struct {
+	ID         string        `json:"id"`
+	MailFrom   string        `json:"mail_from"`
+	Recipients []*Recipient  `json:"recipients"`
+	UTF8       bool          `json:"utf8,omitempty"`
+	DSN        *envelope.DSN `json:"dsn,omitempty"`
+
+	// Helo and Remote are of the client that sent the message
+	Helo   string `json:"helo,omitempty"`
+	Remote string `json:"remote,omitempty"`
+
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Pending returns the recipients that are not yet delivered or failed
+func (m *Message) Pending() []*Recipient {
+	var rcpts []*Recipient
+	for _, r := range m.Recipients {
+		if r.Status == StatusPending {
+			rcpts = append(rcpts, r)
+		}
+	}
+	return rcpts
+}
+
+func (m *Message) clone() *Message {
+	c := *m
+	c.Recipients = make([]*Recipient, len(m.Recipients))
+	for i, r := range m.Recipients {
+		rcpt := *r
+		c.Recipients[i] = &rcpt
+	}
+	return &c
+}
+
+// envelope returns an envelope of the message, to the recipients
+func (m *Message) envelope(data []byte, rcpts []*Recipient) *envelope.Envelope {
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: m.MailFrom}
+	e.UTF8 = m.UTF8
+	e.DSN = m.DSN
+	e.Helo = m.Helo
+	for _, r := range rcpts {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Address: r.Address})
+	}
+	_, _ = e.Data.Write(data)
+	return e
+}
+
+// domains returns the recipients grouped by domain, in the order they first appear
+func domains(rcpts []*Recipient) ([]string, map[string][]*Recipient) {
+	var order []string
+	groups := map[string][]*Recipient{}
+	for _, r := range rcpts {
+		d := r.Domain()
+		if !slices.Contains(order, d) {
+			order = append(order, d)
+		}
+		groups[d] = append(groups[d], r)
+	}
+	return order, groups
+}
+
+const (
+	metaExt = ".json"
+	dataExt = ".eml"
+	// corruptExt is appended to the files of a message whose metadata can not be read
+	corruptExt = ".corrupt"
+)
+
+// store persists messages in a directory, as <id>.json and <id>.eml
+type store struct {
+	dir string
+}
+
+func (s store) metaPath(id string) string {
+	return filepath.Join(s.dir, id+metaExt)
+}
+
+func (s store) dataPath(id string) string {
+	return filepath.Join(s.dir, id+dataExt)
+}
+
+// create writes the data, and then the metadata. A message without metadata is not queued
+func (s store) create(m *Message, data []byte) error {
+	if err := writeFile(s.dataPath(m.ID), data); err != nil {
+		return err
+	}
+	if err := s.save(m); err != nil {
+		_ = os.Remove(s.dataPath(m.ID))
+		return err
+	}
+	return nil
+}
+
+func (s store) save(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.metaPath(m.ID), b)
+}
+
+func (s store) data(id string) ([]byte, error) {
+	return os.ReadFile(s.dataPath(id))
+}
+
+func (s store) remove(id string) error {
+	err := os.Remove(s.metaPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Remove(s.dataPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// load reads all messages in the directory, removing data left without metadata. A message whose metadata
+// can not be parsed is quarantined, i.e. its files are renamed with corruptExt, and passed to corrupt
+func (s store) load(corrupt func(name string, err error)) ([]*Message, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var messages []*Message
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, ".tmp-"):
+			// left by a crash while writing
+			_ = os.Remove(filepath.Join(s.dir, name))
+		case strings.HasSuffix(name, dataExt):
+			id := strings.TrimSuffix(name, dataExt)
+			if _, err := os.Stat(s.metaPath(id)); errors.Is(err, os.ErrNotExist) {
+				_ = os.Remove(s.dataPath(id))
+			}
+		case strings.HasSuffix(name, metaExt):
+			b, err := os.ReadFile(filepath.Join(s.dir, name))
+			if err != nil {
+				return nil, err
+			}
+			var m Message
+			if err := json.Unmarshal(b, &m); err != nil {
+				corrupt(name, s.quarantine(strings.TrimSuffix(name, metaExt), err))
+				continue
+			}
+			messages = append(messages, &m)
+		}
+	}
+	return messages, nil
+}
+
+// writeFile writes the file atomically, by writing a temporary file that is renamed
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// quarantine renames the files of the message id so that they are not loaded, but kept to be inspected. It
+// returns err, or the error renaming the metadata
+func (s store) quarantine(id string, err error) error {
+	if rerr := os.Rename(s.metaPath(id), s.metaPath(id)+corruptExt); rerr != nil {
+		return fmt.Errorf("%w, could not quarantine: %w", err, rerr)
+	}
+	rerr := os.Rename(s.dataPath(id), s.dataPath(id)+corruptExt)
+	if rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+		return fmt.Errorf("%w, could not quarantine data: %w", err, rerr)
+	}
+	return err
+}
@@ -0,0 +1,480 @@
+// Package spool is a persistent queue of outbound mail.
+//
+// Accepted envelopes are written to a directory, and delivered by a Sender, e.g. a client.Deliverer.
+// Recipients that fail temporarily are retried with exponential backoff until the message expires,
+// and the queue survives restarts since it is reloaded from the directory.
+//
+// Example usage:
+//
+//	q, err := spool.New("/var/spool/smtpx",
+//		spool.WithSender(client.New(client.WithHostname("mx.example.com"))),
+//		spool.WithDomainConcurrency(10),
+//	)
+//	...
+//	go q.Run(ctx)
+//	server.Handler = q.Handler()
+package spool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/client"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/utils"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval          = 30 * time.Second
+	defaultMinBackoff        = 5 * time.Minute
+	defaultMaxBackoff        = time.Hour
+	defaultLifetime          = 5 * 24 * time.Hour
+	defaultDomainConcurrency = 20
+	defaultWorkers           = 100
+)
+
+// Sender delivers an envelope, returning a result per recipient. *client.Deliverer satisfies it
+type Sender interface {
+	Deliver(ctx context.Context, e *envelope.Envelope) []client.Result
+}
+
+// FailureFunc is called with the recipients that have failed permanently, or have expired,
+// e.g. to send a bounce. data is the queued message
+type FailureFunc func(m *Message, data []byte, failed []*Recipient)
+
+type Settings struct {
+	Sender Sender
+	Logger *slog.Logger
+
+	// Interval is how often the queue is scanned for messages to deliver
+	Interval time.Duration
+	// MinBackoff is the delay after the first failed attempt, it is doubled for each attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Lifetime is how long a message is retried before it expires
+	Lifetime time.Duration
+
+	// DomainConcurrency is the maximum number of concurrent deliveries to a domain
+	DomainConcurrency int
+	// Workers is the maximum number of concurrent deliveries
+	Workers int
+
+	OnFailure FailureFunc
+
+	// ReportingMTA is the name used in bounces, no bounces are queued if empty
+	ReportingMTA string
+}
+
+type Option func(*Settings)
+
+// WithSender sets the Sender used to deliver messages, defaults to client.New()
+func WithSender(sender Sender) Option {
+	return func(s *Settings) {
+		s.Sender = sender
+	}
+}
+
+// WithLogger logs deliveries and errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithInterval sets how often the queue is scanned, defaults to 30 seconds
+func WithInterval(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Interval = d
+	}
+}
+
+// WithBackoff sets the delay after the first failed attempt, doubled for each attempt up to max.
+// Defaults to 5 minutes and 1 hour
+func WithBackoff(min, max time.Duration) Option {
+	return func(s *Settings) {
+		s.MinBackoff = min
+		s.MaxBackoff = max
+	}
+}
+
+// WithLifetime sets how long a message is retried before it expires, defaults to 5 days
+func WithLifetime(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Lifetime = d
+	}
+}
+
+// WithDomainConcurrency sets the maximum number of concurrent deliveries to a domain, defaults to 20
+func WithDomainConcurrency(n int) Option {
+	return func(s *Settings) {
+		s.DomainConcurrency = n
+	}
+}
+
+// WithWorkers sets the maximum number of concurrent deliveries, defaults to 100
+func WithWorkers(n int) Option {
+	return func(s *Settings) {
+		s.Workers = n
+	}
+}
+
+// WithFailure sets the function called with recipients that have failed permanently or expired
+func WithFailure(fn FailureFunc) Option {
+	return func(s *Settings) {
+		s.OnFailure = fn
+	}
+}
+
+// WithBounce queues a bounce to the sender when recipients fail permanently or expire,
+// reportingMTA is the name of this host used in the bounce
+func WithBounce(reportingMTA string) Option {
+	return func(s *Settings) {
+		s.ReportingMTA = reportingMTA
+	}
+}
+
+type Queue struct {
+	settings *Settings
+	store    store
+	now      func() time.Time
+
+	mu       sync.Mutex
+	messages map[string]*Message
+	inflight map[string]bool
+	domains  map[string]chan struct{}
+	workers  chan struct{}
+	wake     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New returns a queue stored in dir, loading the messages already in it. A message whose metadata is corrupt
+// is not loaded, its files are renamed <id>.json.corrupt and <id>.eml.corrupt and logged
+func New(dir string, opts ...Option) (*Queue, error) {
+	settings := &Settings{
+		Interval:          defaultInterval,
+		MinBackoff:        defaultMinBackoff,
+		MaxBackoff:        defaultMaxBackoff,
+		Lifetime:          defaultLifetime,
+		DomainConcurrency: defaultDomainConcurrency,
+		Workers:           defaultWorkers,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	if settings.Sender == nil {
+		settings.Sender = client.New()
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		settings: settings,
+		store:    store{dir: dir},
+		now:      time.Now,
+		messages: map[string]*Message{},
+		inflight: map[string]bool{},
+		domains:  map[string]chan struct{}{},
+		workers:  make(chan struct{}, max(settings.Workers, 1)),
+		wake:     make(chan struct{}, 1),
+	}
+
+	messages, err := q.store.load(func(name string, err error) {
+		q.log("spool, quarantined corrupt message", "file", name, "err", err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		q.messages[m.ID] = m
+	}
+	return q, nil
+}
+
+// Handler returns a smtpx.Handler that queues the envelopes it receives
+func (q *Queue) Handler() smtpx.Handler {
+	return smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+		id, err := q.Enqueue(e)
+		if err != nil {
+			q.log("spool, could not queue message", "err", err)
+			return responses.New(451).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+				Line("Could not queue message, try again later")
+		}
+		return responses.New(250).Enhanced(responses.OtherStatus).Line("OK: queued as " + id)
+	})
+}
+
+// Enqueue persists the envelope and schedules it for delivery, returning its id
+func (q *Queue) Enqueue(e *envelope.Envelope) (string, error) {
+	if len(e.RcptTo) == 0 {
+		return "", fmt.Errorf("spool, no recipients")
+	}
+	now := q.now()
+	m := &Message{
+		ID:          utils.XID(),
+		UTF8:        e.UTF8,
+		DSN:         e.DSN,
+		Helo:        e.Helo,
+		Created:     now,
+		Expires:     now.Add(q.settings.Lifetime),
+		NextAttempt: now,
+	}
+	if e.MailFrom != nil {
+		m.MailFrom = e.MailFrom.Address
+	}
+	if remote := e.ClientAddr(); remote.IsValid() {
+		m.Remote = remote.Addr().String()
+	}
+	for _, rcpt := range e.RcptTo {
+		m.Recipients = append(m.Recipients, &Recipient{Address: rcpt.Address, Status: StatusPending})
+	}
+
+	err := q.store.create(m, e.Data.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	q.mu.Lock()
+	q.messages[m.ID] = m
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return m.ID, nil
+}
+
+// Messages returns a snapshot of the queued messages, ordered by creation
+func (q *Queue) Messages() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var messages []*Message
+	for _, m := range q.messages {
+		messages = append(messages, m.clone())
+	}
+	slices.SortFunc(messages, func(a, b *Message) int {
+		return a.Created.Compare(b.Created)
+	})
+	return messages
+}
+
+// Run delivers queued messages until ctx is done, and then waits for ongoing deliveries
+func (q *Queue) Run(ctx context.Context) error {
+	ticker := time.NewTicker(q.settings.Interval)
+	defer ticker.Stop()
+	defer q.wg.Wait()
+
+	for {
+		q.schedule(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// schedule starts an attempt for each message that is due
+func (q *Queue) schedule(ctx context.Context) {
+	now := q.now()
+	q.mu.Lock()
+	var due []*Message
+	for id, m := range q.messages {
+		if q.inflight[id] || m.NextAttempt.After(now) {
+			continue
+		}
+		q.inflight[id] = true
+		due = append(due, m.clone())
+	}
+	q.mu.Unlock()
+
+	for _, m := range due {
+		q.wg.Add(1)
+		go func(m *Message) {
+			defer q.wg.Done()
+			q.attempt(ctx, m)
+
+			q.mu.Lock()
+			delete(q.inflight, m.ID)
+			q.mu.Unlock()
+		}(m)
+	}
+}
+
+// attempt delivers the pending recipients of a copy of the message, domain by domain
+func (q *Queue) attempt(ctx context.Context, m *Message) {
+	data, err := q.store.data(m.ID)
+	if err != nil {
+		q.log("spool, could not read message", "id", m.ID, "err", err)
+		return
+	}
+
+	pending := m.Pending()
+	order, groups := domains(pending)
+	for _, domain := range order {
+		if !q.acquire(ctx, domain) {
+			// shutting down, the recipients delivered so far are saved
+			break
+		}
+		rcpts := groups[domain]
+		results := q.settings.Sender.Deliver(ctx, m.envelope(data, rcpts))
+		q.release(domain)
+
+		for _, res := range results {
+			for _, r := range rcpts {
+				if res.Rcpt == nil || res.Rcpt.Address != r.Address || res.Response == nil {
+					continue
+				}
+				r.Code = res.Response.StatusCode()
+				r.Response = res.Response.String()
+				r.Host = res.Host
+				switch res.Response.Class() {
+				case responses.ClassSuccess:
+					r.Status = StatusDelivered
+				case responses.ClassPermanentFailure:
+					r.Status = StatusFailed
+				}
+			}
+		}
+		q.log("spool, delivery attempt", "id", m.ID, "domain", domain, "attempt", m.Attempts+1)
+	}
+
+	now := q.now()
+	m.Attempts++
+	m.LastAttempt = now
+	m.NextAttempt = now.Add(q.backoff(m.Attempts))
+
+	var failed []*Recipient
+	for _, r := range pending {
+		if r.Status == StatusPending && !now.Before(m.Expires) {
+			res := expired(r.Response)
+			r.Status = StatusFailed
+			r.Code = res.StatusCode()
+			r.Response = res.String()
+		}
+		if r.Status == StatusFailed {
+			failed = append(failed, r)
+		}
+	}
+
+	if len(failed) > 0 && q.settings.OnFailure != nil {
+		q.settings.OnFailure(m.clone(), data, failed)
+	}
+	if len(failed) > 0 && q.settings.ReportingMTA != "" {
+		q.bounce(m, data, failed)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(m.Pending()) == 0 {
+		delete(q.messages, m.ID)
+		err = q.store.remove(m.ID)
+	} else {
+		q.messages[m.ID] = m
+		err = q.store.save(m)
+	}
+	if err != nil {
+		q.log("spool, could not update message", "id", m.ID, "err", err)
+	}
+}
+
+// bounce queues a DSN of the failed recipients to the sender of the message
+func (q *Queue) bounce(m *Message, data []byte, failed []*Recipient) {
+	report := envelope.Report{
+		ReportingMTA: q.settings.ReportingMTA,
+		Arrival:      m.Created,
+	}
+	for _, r := range failed {
+		report.Recipients = append(report.Recipients, envelope.RecipientStatus{
+			Recipient:   r.Address,
+			Action:      envelope.DSNActionFailed,
+			Diagnostic:  r.Response,
+			RemoteMTA:   r.Host,
+			LastAttempt: m.LastAttempt,
+		})
+	}
+
+	b, err := m.envelope(data, nil).Bounce(report)
+	if errors.Is(err, envelope.ErrNullSender) || errors.Is(err, envelope.ErrNoNotification) {
+		return
+	}
+	if err == nil {
+		_, err = q.Enqueue(b)
+	}
+	if err != nil {
+		q.log("spool, could not queue bounce", "id", m.ID, "err", err)
+	}
+}
+
+// expired returns the response of a recipient that expired, with the last response kept for the bounce
+func expired(last string) *responses.Reply {
+	res := responses.New(554).Enhanced(responses.DeliveryTimeExpired).Line("Message expired, delivery time limit exceeded")
+	if last != "" {
+		res = res.Line("Last response: " + last)
+	}
+	return res
+}
+
+// backoff returns the delay before the next attempt
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.settings.MinBackoff
+	for i := 1; i < attempts && d < q.settings.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, q.settings.MaxBackoff)
+}
+
+// acquire waits for a delivery slot for the domain, returning false if ctx is done
+func (q *Queue) acquire(ctx context.Context, domain string) bool {
+	q.mu.Lock()
+	sem, found := q.domains[domain]
+	if !found {
+		sem = make(chan struct{}, max(q.settings.DomainConcurrency, 1))
+		q.domains[domain] = sem
+	}
+	q.mu.Unlock()
+
+	// select picks a ready case at random, a free slot must not win over ctx being done
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case q.workers <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		<-q.workers
+		return false
+	}
+}
+
+func (q *Queue) release(domain string) {
+	q.mu.Lock()
+	sem := q.domains[domain]
+	q.mu.Unlock()
+	<-sem
+	<-q.workers
+}
+
+func (q *Queue) log(msg string, args ...any) {
+	if q.settings.Logger != nil {
+		q.settings.Logger.Debug(msg, args...)
+	}
+}
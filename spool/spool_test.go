@@ -0,0 +1,300 @@
+package spool
+
+import (
+	"context"
+	"github.com/modfin/smtpx/client"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/mail"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sender replies with the code of the recipient domain, 250 if none is given
+type sender struct {
+	mu    sync.Mutex
+	codes map[string]int
+	sent  []*envelope.Envelope
+	delay time.Duration
+	// deliver is called on each delivery, if set
+	deliver func()
+
+	active, peak atomic.Int32
+}
+
+func (s *sender) Deliver(_ context.Context, e *envelope.Envelope) []client.Result {
+	n := s.active.Add(1)
+	defer s.active.Add(-1)
+	for {
+		p := s.peak.Load()
+		if n <= p || s.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	time.Sleep(s.delay)
+	if s.deliver != nil {
+		s.deliver()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, e)
+	var results []client.Result
+	for _, rcpt := range e.RcptTo {
+		code := s.codes[(&Recipient{Address: rcpt.Address}).Domain()]
+		if code == 0 {
+			code = 250
+		}
+		results = append(results, client.Result{Rcpt: rcpt, Host: "mx.test", Response: responses.New(code)})
+	}
+	return results
+}
+
+func newEnvelope(from string, to ...string) *envelope.Envelope {
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: from}
+	for _, rcpt := range to {
+		e.RcptTo = append(e.RcptTo, &mail.Address{Address: rcpt})
+	}
+	_, _ = e.Data.Write([]byte("Subject: test\n\nHello\n"))
+	return e
+}
+
+// run attempts the messages that are due, and waits for them
+func run(q *Queue) {
+	q.schedule(context.Background())
+	q.wg.Wait()
+}
+
+func TestQueue(t *testing.T) {
+	t.Run("Persistence", func(t *testing.T) {
+		dir := t.TempDir()
+		q, err := New(dir, WithSender(&sender{}))
+		require.NoError(t, err)
+		id, err := q.Enqueue(newEnvelope("a@example.com", "b@example.org"))
+		require.NoError(t, err)
+
+		q, err = New(dir, WithSender(&sender{}))
+		require.NoError(t, err)
+		messages := q.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, id, messages[0].ID)
+		assert.Equal(t, "a@example.com", messages[0].MailFrom)
+		assert.Equal(t, StatusPending, messages[0].Recipients[0].Status)
+
+		data, err := q.store.data(id)
+		require.NoError(t, err)
+		assert.Equal(t, "Subject: test\n\nHello\n", string(data))
+	})
+
+	t.Run("Orphans", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(dir+"/orphan"+dataExt, []byte("data"), 0o600))
+		require.NoError(t, os.WriteFile(dir+"/.tmp-123", []byte("data"), 0o600))
+
+		q, err := New(dir, WithSender(&sender{}))
+		require.NoError(t, err)
+		assert.Empty(t, q.Messages())
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		dir := t.TempDir()
+		q, err := New(dir, WithSender(&sender{}))
+		require.NoError(t, err)
+		id, err := q.Enqueue(newEnvelope("a@example.com", "b@example.org"))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dir+"/corrupt"+metaExt, []byte("{"), 0o600))
+		require.NoError(t, os.WriteFile(dir+"/corrupt"+dataExt, []byte("data"), 0o600))
+
+		// the corrupt message is quarantined, the others are loaded
+		q, err = New(dir, WithSender(&sender{}))
+		require.NoError(t, err)
+		messages := q.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, id, messages[0].ID)
+		assert.FileExists(t, dir+"/corrupt"+metaExt+corruptExt)
+		assert.FileExists(t, dir+"/corrupt"+dataExt+corruptExt)
+		assert.NoFileExists(t, dir+"/corrupt"+metaExt)
+
+		q, err = New(dir, WithSender(&sender{}))
+		require.NoError(t, err)
+		assert.Len(t, q.Messages(), 1)
+		assert.FileExists(t, dir+"/corrupt"+dataExt+corruptExt)
+	})
+
+	t.Run("Delivered", func(t *testing.T) {
+		dir := t.TempDir()
+		s := &sender{}
+		q, err := New(dir, WithSender(s))
+		require.NoError(t, err)
+		_, err = q.Enqueue(newEnvelope("a@example.com", "b@example.org", "c@example.net", "d@example.org"))
+		require.NoError(t, err)
+
+		run(q)
+		require.Len(t, s.sent, 2)
+		assert.Empty(t, q.Messages())
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		// the recipients delivered before the queue is stopped are saved, and not delivered again
+		dir := t.TempDir()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		s := &sender{deliver: cancel}
+		q, err := New(dir, WithSender(s))
+		require.NoError(t, err)
+		_, err = q.Enqueue(newEnvelope("a@example.com", "b@example.org", "c@example.net"))
+		require.NoError(t, err)
+
+		q.schedule(ctx)
+		q.wg.Wait()
+		require.Len(t, s.sent, 1)
+
+		q, err = New(dir, WithSender(s))
+		require.NoError(t, err)
+		m := q.Messages()[0]
+		assert.Equal(t, 1, m.Attempts)
+		pending := m.Pending()
+		require.Len(t, pending, 1)
+		assert.NotEqual(t, s.sent[0].RcptTo[0].Address, pending[0].Address)
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		s := &sender{codes: map[string]int{"example.org": 451}}
+		var failures [][]*Recipient
+		q, err := New(t.TempDir(), WithSender(s), WithBackoff(time.Minute, 3*time.Minute), WithLifetime(time.Hour),
+			WithFailure(func(m *Message, data []byte, failed []*Recipient) {
+				assert.Equal(t, "Subject: test\n\nHello\n", string(data))
+				failures = append(failures, failed)
+			}))
+		require.NoError(t, err)
+		q.now = func() time.Time { return now }
+
+		_, err = q.Enqueue(newEnvelope("a@example.com", "b@example.org", "c@example.net"))
+		require.NoError(t, err)
+
+		run(q)
+		m := q.Messages()[0]
+		assert.Equal(t, 1, m.Attempts)
+		assert.Equal(t, now.Add(time.Minute), m.NextAttempt)
+		assert.Equal(t, StatusPending, m.Recipients[0].Status)
+		assert.Equal(t, 451, m.Recipients[0].Code)
+		assert.Equal(t, StatusDelivered, m.Recipients[1].Status)
+
+		// not due yet
+		run(q)
+		assert.Equal(t, 1, q.Messages()[0].Attempts)
+
+		var delays []time.Duration
+		for range 3 {
+			now = q.Messages()[0].NextAttempt
+			run(q)
+			m = q.Messages()[0]
+			delays = append(delays, m.NextAttempt.Sub(now))
+		}
+		assert.Equal(t, []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute}, delays)
+		assert.Len(t, s.sent, 5)
+		for _, e := range s.sent[1:] {
+			assert.Len(t, e.RcptTo, 1, "only pending recipients are retried")
+		}
+		assert.Empty(t, failures)
+
+		now = now.Add(time.Hour)
+		run(q)
+		assert.Empty(t, q.Messages())
+		require.Len(t, failures, 1)
+		require.Len(t, failures[0], 1)
+		assert.Equal(t, "b@example.org", failures[0][0].Address)
+		assert.Equal(t, 554, failures[0][0].Code)
+		assert.Contains(t, failures[0][0].Response, "5.4.7")
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		s := &sender{codes: map[string]int{"example.org": 550, "example.net": 451}}
+		var failed []*Recipient
+		q, err := New(t.TempDir(), WithSender(s), WithFailure(func(m *Message, data []byte, f []*Recipient) {
+			failed = append(failed, f...)
+		}))
+		require.NoError(t, err)
+		_, err = q.Enqueue(newEnvelope("a@example.com", "b@example.org", "c@example.net"))
+		require.NoError(t, err)
+
+		run(q)
+		require.Len(t, failed, 1)
+		assert.Equal(t, "b@example.org", failed[0].Address)
+		assert.Equal(t, "mx.test", failed[0].Host)
+
+		m := q.Messages()[0]
+		assert.Equal(t, StatusFailed, m.Recipients[0].Status)
+		assert.Equal(t, StatusPending, m.Recipients[1].Status)
+	})
+
+	t.Run("Bounce", func(t *testing.T) {
+		s := &sender{codes: map[string]int{"example.org": 550}}
+		q, err := New(t.TempDir(), WithSender(s), WithBounce("mx.example.com"))
+		require.NoError(t, err)
+		_, err = q.Enqueue(newEnvelope("a@example.com", "b@example.org"))
+		require.NoError(t, err)
+
+		run(q)
+		messages := q.Messages()
+		require.Len(t, messages, 1, "the bounce is queued")
+		assert.Equal(t, "", messages[0].MailFrom)
+		assert.Equal(t, "a@example.com", messages[0].Recipients[0].Address)
+		data, err := q.store.data(messages[0].ID)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "Final-Recipient: rfc822; b@example.org")
+
+		// a bounce is never bounced
+		s.codes["example.com"] = 550
+		run(q)
+		assert.Empty(t, q.Messages())
+	})
+
+	t.Run("DomainConcurrency", func(t *testing.T) {
+		s := &sender{delay: 20 * time.Millisecond}
+		q, err := New(t.TempDir(), WithSender(s), WithDomainConcurrency(2))
+		require.NoError(t, err)
+		for range 6 {
+			_, err = q.Enqueue(newEnvelope("a@example.com", "b@example.org"))
+			require.NoError(t, err)
+		}
+
+		run(q)
+		assert.Len(t, s.sent, 6)
+		assert.Equal(t, int32(2), s.peak.Load())
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		s := &sender{}
+		q, err := New(t.TempDir(), WithSender(s), WithInterval(time.Hour))
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			_ = q.Run(ctx)
+			close(done)
+		}()
+
+		res := q.Handler().Data(newEnvelope("a@example.com", "b@example.org"))
+		assert.Equal(t, 250, res.StatusCode())
+		assert.Contains(t, res.String(), "queued as")
+
+		assert.Eventually(t, func() bool { return len(q.Messages()) == 0 }, time.Second, 10*time.Millisecond)
+		cancel()
+		<-done
+		assert.Len(t, s.sent, 1)
+	})
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/client"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/mail"
+	"testing"
+)
+
+type mxResolver map[string][]*net.MX
+
+func (r mxResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return r[name], nil
+}
+
+// localDialer dials the local server whatever the host, except for hosts that are down
+type localDialer struct {
+	down map[string]bool
+}
+
+func (d localDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, _ := net.SplitHostPort(address)
+	if d.down[host] {
+		return nil, errors.New("connection refused")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+}
+
+func TestClientDeliver(t *testing.T) {
+	addr := ":2525"
+	mails, server, pool := StartTLSServer(addr, t)
+	defer server.Shutdown(context.Background())
+	server.Hook(smtpx.Hooks{
+		Rcpt: func(e *envelope.Envelope, rcpt *mail.Address) smtpx.Response {
+			if rcpt.Address == "unknown@example.org" {
+				return smtpx.NewResponse(550, "User unknown")
+			}
+			return nil
+		},
+	})
+
+	d := client.New(
+		client.WithHostname("client.example.org"),
+		client.WithPort("2525"),
+		client.WithResolver(mxResolver{
+			"example.org": {
+				{Host: hostname + ".", Pref: 20},
+				{Host: "down.example.org.", Pref: 10},
+			},
+			"example.net": {{Host: ".", Pref: 0}},
+		}),
+		client.WithDialer(localDialer{down: map[string]bool{"down.example.org": true}}),
+		client.WithTLS(client.TLSRequired, &tls.Config{RootCAs: pool}),
+	)
+
+	e := envelope.NewEnvelope(nil, 0)
+	e.MailFrom = &mail.Address{Address: "from@example.com"}
+	e.RcptTo = []*mail.Address{
+		{Address: "to@example.org"},
+		{Address: "unknown@example.org"},
+		{Address: "to@example.net"},
+	}
+	_, err := e.Data.WriteString("Subject: client\r\n\r\nHello\r\n.dot\r\n")
+	require.NoError(t, err)
+
+	results := d.Deliver(context.Background(), e)
+	require.Len(t, results, 3)
+
+	assert.Equal(t, "to@example.org", results[0].Rcpt.Address)
+	assert.Equal(t, hostname, results[0].Host)
+	assert.Equal(t, 250, results[0].Response.StatusCode())
+
+	assert.Equal(t, "unknown@example.org", results[1].Rcpt.Address)
+	assert.Equal(t, 550, results[1].Response.StatusCode())
+
+	assert.Equal(t, "to@example.net", results[2].Rcpt.Address)
+	assert.Equal(t, 556, results[2].Response.StatusCode())
+
+	received := <-mails
+	assert.True(t, received.TLS)
+	assert.Equal(t, "client.example.org", received.Helo)
+	require.Len(t, received.RcptTo, 1)
+	assert.Equal(t, "to@example.org", received.RcptTo[0].Address)
+	// The server stores the message with the line endings of textproto.DotReader
+	assert.Equal(t, "Subject: client\n\nHello\n.dot\n", received.Data.String())
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/smtpxtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/textproto"
+	"testing"
+)
+
+func TestExtensions(t *testing.T) {
+	addr := ":2525"
+	var flushed []string
+	s := &smtpx.Server{Addr: addr, MaxSize: 1024}
+	s.Register(
+		smtpx.Extension{
+			Verb:    "ETRN",
+			Keyword: "ETRN",
+			Phases:  smtpx.PhaseHelo,
+			Handler: func(s *smtpx.Session, args string) {
+				flushed = append(flushed, args)
+				s.Reply(smtpx.NewResponse(250, "Queuing started"))
+			},
+		},
+		smtpx.Extension{
+			Verb: "VRFY",
+			Handler: func(s *smtpx.Session, args string) {
+				s.Reply(smtpx.NewResponse(252, "Cannot VRFY user"))
+			},
+		},
+	)
+	startServer(t, s)
+
+	c, err := textproto.Dial("tcp", "localhost"+addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	cmd := func(expect int, format string, args ...any) []string {
+		id, err := c.Cmd(format, args...)
+		require.NoError(t, err)
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+		r, err := responses.ReadReply(&c.Reader)
+		require.NoError(t, err, format)
+		require.Equal(t, expect, r.StatusCode(), format)
+		return r.Lines()
+	}
+
+	_, _, err = c.ReadResponse(220)
+	require.NoError(t, err)
+
+	// Not allowed before EHLO
+	cmd(503, "ETRN example.com")
+
+	ehlo := cmd(250, "EHLO client.example.com")
+	assert.Contains(t, ehlo, "SIZE 1024")
+	assert.Contains(t, ehlo, "PIPELINING")
+	assert.Contains(t, ehlo, "ETRN")
+	assert.NotContains(t, ehlo, "STARTTLS")
+
+	cmd(250, "etrn example.com")
+	assert.Equal(t, []string{"example.com"}, flushed)
+
+	// Built-in verbs can be replaced
+	cmd(252, "VRFY user@example.com")
+
+	help := cmd(214, "HELP")
+	require.Len(t, help, 3)
+	assert.Contains(t, help[1], "ETRN")
+
+	// Not allowed in a transaction
+	cmd(250, "MAIL FROM:<from@example.com>")
+	cmd(503, "ETRN example.com")
+
+	// STARTTLS is not advertised without a TLS config, but the verb is known
+	cmd(502, "STARTTLS")
+	cmd(221, "QUIT")
+}
+
+func TestExtensionsSTARTTLS(t *testing.T) {
+	t.Run("NotConfigured", func(t *testing.T) {
+		// a 502 is not counted as an unrecognized command
+		srv := smtpxtest.NewServer(t, &smtpx.Server{MaxUnrecognizedCommands: 2})
+		c := srv.Client()
+		defer c.Close()
+		c.ExpectCmd("EHLO client.example.com", 250)
+		for i := 0; i < 3; i++ {
+			c.ExpectCmd("STARTTLS", 502)
+		}
+		c.ExpectCmd("NOOP", 200)
+	})
+
+	t.Run("Active", func(t *testing.T) {
+		srv := smtpxtest.NewTLSServer(t, nil)
+		c := srv.Client()
+		defer c.Close()
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.StartTLS(srv.TLS.ClientConfig(smtpxtest.Hostname))
+		ehlo := c.ExpectCmd("EHLO client.example.com", 250)
+		assert.NotContains(t, ehlo.Lines, "STARTTLS")
+		c.ExpectCmd("STARTTLS", 554)
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		// an extension advertising STARTTLS replaces the built-in keyword, which is advertised once
+		s := &smtpx.Server{}
+		s.Register(smtpx.Extension{
+			Verb:    "STARTTLS",
+			Keyword: "STARTTLS",
+			Handler: func(s *smtpx.Session, _ string) {
+				s.Reply(smtpx.NewResponse(454, "TLS not available due to temporary reason"))
+			},
+		})
+		srv := smtpxtest.NewServer(t, s)
+		c := srv.Client()
+		defer c.Close()
+		ehlo := c.ExpectCmd("EHLO client.example.com", 250)
+		var n int
+		for _, line := range ehlo.Lines {
+			if line == "STARTTLS" {
+				n++
+			}
+		}
+		assert.Equal(t, 1, n)
+		c.ExpectCmd("STARTTLS", 454)
+	})
+}
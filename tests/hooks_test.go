@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"context"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/middleware/ratelimit"
+	"github.com/modfin/smtpx/responses"
+	"github.com/modfin/smtpx/smtpxtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+func StartHookServer(inf string, hooks ...smtpx.Hooks) (<-chan *envelope.Envelope, *smtpx.Server) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	mails := make(chan *envelope.Envelope, 10)
+	s := &smtpx.Server{
+		Logger: logger,
+		Addr:   inf,
+		Hooks:  hooks,
+		Handler: smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+			mails <- e
+			return nil
+		}),
+	}
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	return mails, s
+}
+
+func TestHookRcpt(t *testing.T) {
+	addr := ":2525"
+	inbox, server := StartHookServer(addr, smtpx.Hooks{
+		Rcpt: func(e *envelope.Envelope, rcpt *mail.Address) smtpx.Response {
+			if rcpt.Address == "blocked@example.com" {
+				return smtpx.NewResponse(550, "blocked")
+			}
+			return nil
+		},
+	})
+	defer server.Shutdown(context.Background())
+
+	c, err := smtp.Dial("localhost" + addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Mail("from@example.com"))
+
+	err = c.Rcpt("blocked@example.com")
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 550, protoErr.Code)
+
+	require.NoError(t, c.Rcpt("to@example.com"))
+
+	w, err := c.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: hooks\r\n\r\nHello\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, c.Quit())
+
+	e := <-inbox
+	require.Len(t, e.RcptTo, 1)
+	assert.Equal(t, "to@example.com", e.RcptTo[0].Address)
+}
+
+func TestHookRateLimitConnections(t *testing.T) {
+	addr := ":2525"
+	limiter := ratelimit.New(ratelimit.Connections(ratelimit.ByIP, 1, time.Minute))
+	_, server := StartHookServer(addr, limiter.Hooks())
+	defer server.Shutdown(context.Background())
+
+	c, err := smtp.Dial("localhost" + addr)
+	require.NoError(t, err)
+	require.NoError(t, c.Quit())
+
+	_, err = smtp.Dial("localhost" + addr)
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 421, protoErr.Code)
+}
+
+func TestHookMultiLineResponse(t *testing.T) {
+	addr := ":2525"
+	_, server := StartHookServer(addr, smtpx.Hooks{
+		Mail: func(e *envelope.Envelope) smtpx.Response {
+			return responses.New(550, "Sender blocked", "See https://example.com/blocked").
+				Enhanced("5.7.1")
+		},
+	})
+	defer server.Shutdown(context.Background())
+
+	c, err := smtp.Dial("localhost" + addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	err = c.Mail("from@example.com")
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 550, protoErr.Code)
+	assert.Equal(t, "5.7.1 Sender blocked\n5.7.1 See https://example.com/blocked", protoErr.Msg)
+
+	// The session is still in sync
+	require.NoError(t, c.Reset())
+	require.NoError(t, c.Quit())
+}
+
+func TestHookConnectProxy(t *testing.T) {
+	var connects []string
+	newServer := func(t *testing.T) *smtpxtest.Server {
+		connects = nil
+		return smtpxtest.NewServer(t, &smtpx.Server{
+			ProxyOn:   true,
+			XClientOn: true,
+			Hooks: []smtpx.Hooks{{
+				Connect: func(e *envelope.Envelope) smtpx.Response {
+					connects = append(connects, e.Remote.Addr().String())
+					if e.Remote.Addr().String() == "192.0.2.66" {
+						return responses.ErrorTooManyConnections
+					}
+					return nil
+				},
+			}},
+		})
+	}
+
+	t.Run("PROXY", func(t *testing.T) {
+		srv := newServer(t)
+		c := srv.Client()
+		// the hooks run once, with the address of the client rather than the proxy
+		c.ExpectCmd("PROXY TCP4 192.0.2.1 192.0.2.2 4321 25", 220)
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.ExpectCmd("MAIL FROM:<from@example.com>", 250)
+		c.Close()
+		assert.Equal(t, []string{"192.0.2.1"}, connects)
+	})
+
+	t.Run("XCLIENT", func(t *testing.T) {
+		srv := newServer(t)
+		c := srv.Client()
+		c.ExpectCmd("XCLIENT HELO=client.example.com", 250)
+		c.ExpectCmd("XCLIENT ADDR=192.0.2.66", 421)
+		assert.Equal(t, []string{"192.0.2.66"}, connects)
+	})
+
+	t.Run("EHLO XCLIENT", func(t *testing.T) {
+		// Postfix and nginx send EHLO before XCLIENT, the hooks wait for the address of the client
+		srv := newServer(t)
+		c := srv.Client()
+		c.ExpectCmd("EHLO proxy.example.com", 250)
+		assert.Empty(t, connects)
+		c.ExpectCmd("XCLIENT ADDR=192.0.2.66 NAME=client.example.com", 421)
+		assert.Equal(t, []string{"192.0.2.66"}, connects)
+	})
+
+	t.Run("Direct", func(t *testing.T) {
+		// a client that does not go through the proxy is checked on its first MAIL
+		srv := newServer(t)
+		c := srv.Client()
+		c.ExpectCmd("EHLO client.example.com", 250)
+		assert.Empty(t, connects)
+		c.ExpectCmd("MAIL FROM:<from@example.com>", 250)
+		c.Close()
+		assert.Equal(t, []string{"127.0.0.1"}, connects)
+	})
+}
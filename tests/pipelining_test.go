@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"bufio"
+	"github.com/modfin/smtpx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestPipelining(t *testing.T) {
+	addr := ":2525"
+	startServer(t, &smtpx.Server{Addr: addr})
+
+	dial := func(t *testing.T) (net.Conn, *textproto.Reader) {
+		conn, err := net.Dial("tcp", "localhost"+addr)
+		require.NoError(t, err)
+		r := textproto.NewReader(bufio.NewReader(conn))
+		_, _, err = r.ReadResponse(220)
+		require.NoError(t, err)
+		return conn, r
+	}
+
+	t.Run("Batch", func(t *testing.T) {
+		conn, r := dial(t)
+		defer conn.Close()
+
+		_, err := io.WriteString(conn, "EHLO client.example.com\r\n"+
+			"MAIL FROM:<from@example.com>\r\n"+
+			"RCPT TO:<to1@example.com>\r\n"+
+			"RCPT TO:<to2@example.com>\r\n"+
+			"DATA\r\n")
+		require.NoError(t, err)
+
+		for _, expect := range []int{250, 250, 250, 250, 354} {
+			_, _, err = r.ReadResponse(expect)
+			require.NoError(t, err)
+		}
+
+		_, err = io.WriteString(conn, "Subject: pipelining\r\n\r\nHello\r\n.\r\nQUIT\r\n")
+		require.NoError(t, err)
+		_, _, err = r.ReadResponse(250)
+		require.NoError(t, err)
+		_, _, err = r.ReadResponse(221)
+		require.NoError(t, err)
+	})
+
+	t.Run("Data after DATA", func(t *testing.T) {
+		conn, r := dial(t)
+		defer conn.Close()
+
+		_, err := io.WriteString(conn, "EHLO client.example.com\r\n"+
+			"MAIL FROM:<from@example.com>\r\n"+
+			"RCPT TO:<to@example.com>\r\n"+
+			"DATA\r\n"+
+			"Subject: too early\r\n\r\nHello\r\n.\r\n")
+		require.NoError(t, err)
+
+		for _, expect := range []int{250, 250, 250} {
+			_, _, err = r.ReadResponse(expect)
+			require.NoError(t, err)
+		}
+		code, _, err := r.ReadResponse(354)
+		require.Error(t, err)
+		assert.Equal(t, 554, code)
+
+		_, err = r.ReadLine()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
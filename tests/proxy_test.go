@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProxyClientAddr(t *testing.T) {
+	addr := ":2525"
+	mails := make(chan *envelope.Envelope, 10)
+	s := &smtpx.Server{
+		Logger:      slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Addr:        addr,
+		ProxyOn:     true,
+		XClientOn:   true,
+		Middlewares: []smtpx.Middleware{middleware.AddReceivedHeaders(hostname)},
+		Handler: smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+			mails <- e
+			return nil
+		}),
+	}
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	defer s.Shutdown(context.Background())
+
+	send := func(t *testing.T, proxy string) *envelope.Envelope {
+		c, err := textproto.Dial("tcp", "127.0.0.1"+addr)
+		require.NoError(t, err)
+		defer c.Close()
+
+		cmd := func(expect int, format string, args ...any) {
+			id, err := c.Cmd(format, args...)
+			require.NoError(t, err)
+			c.StartResponse(id)
+			defer c.EndResponse(id)
+			_, _, err = c.ReadResponse(expect)
+			require.NoError(t, err, format)
+		}
+
+		_, _, err = c.ReadResponse(220)
+		require.NoError(t, err)
+
+		if proxy != "" {
+			cmd(0, "%s", proxy)
+		}
+		cmd(250, "EHLO client.example.com")
+		cmd(250, "MAIL FROM:<from@example.com>")
+		cmd(250, "RCPT TO:<to@example.com>")
+		cmd(354, "DATA")
+		cmd(250, "Subject: proxy\r\n\r\nHello\r\n.")
+		cmd(221, "QUIT")
+
+		return <-mails
+	}
+
+	t.Run("Direct", func(t *testing.T) {
+		e := send(t, "")
+		assert.Equal(t, netip.MustParseAddr("127.0.0.1"), e.Remote.Addr())
+		assert.Equal(t, e.Peer, e.Remote)
+	})
+
+	t.Run("PROXY", func(t *testing.T) {
+		e := send(t, "PROXY TCP6 2001:db8::1 2001:db8::2 4321 25")
+		assert.Equal(t, netip.MustParseAddrPort("[2001:db8::1]:4321"), e.Remote)
+		assert.Equal(t, netip.MustParseAddr("127.0.0.1"), e.Peer.Addr())
+
+		m, err := e.Mail()
+		require.NoError(t, err)
+		h, err := m.Headers()
+		require.NoError(t, err)
+		assert.Contains(t, h.Get("Received"), "[IPv6:2001:db8::1]")
+	})
+
+	t.Run("XCLIENT", func(t *testing.T) {
+		e := send(t, "XCLIENT ADDR=192.0.2.1 PORT=1234 HELO=client.example.com")
+		assert.Equal(t, netip.MustParseAddrPort("192.0.2.1:1234"), e.Remote)
+		assert.Equal(t, netip.MustParseAddr("127.0.0.1"), e.Peer.Addr())
+	})
+}
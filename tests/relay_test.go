@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/client"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/smtpxtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/mail"
+	"testing"
+)
+
+// listenerDialer dials the in-memory listeners of the hosts, any other host can not be reached
+type listenerDialer map[string]*smtpxtest.Listener
+
+func (d listenerDialer) DialContext(_ context.Context, _, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	if l, ok := d[host]; ok {
+		return l.Dial()
+	}
+	return nil, errors.New("connection refused")
+}
+
+func TestRelayHandler(t *testing.T) {
+	upstream := smtpxtest.NewTLSServer(t, &smtpx.Server{
+		Hooks: []smtpx.Hooks{{
+			Rcpt: func(e *envelope.Envelope, rcpt *mail.Address) smtpx.Response {
+				switch rcpt.Address {
+				case "unknown@example.org":
+					return smtpx.NewResponse(550, "User unknown")
+				case "busy@example.org":
+					return smtpx.NewResponse(421, "Too busy")
+				}
+				return nil
+			},
+		}},
+	})
+
+	d := client.New(
+		client.WithHostname("relay.example.org"),
+		client.WithResolver(mxResolver{}),
+		client.WithDialer(listenerDialer{smtpxtest.Hostname: upstream.Listener}),
+		client.WithTLS(client.TLSRequired, upstream.TLS.ClientConfig(smtpxtest.Hostname)),
+	)
+	front := smtpxtest.NewServer(t, &smtpx.Server{
+		Handler: d.RelayHandler("down.example.org:25", smtpxtest.Hostname+":25"),
+	})
+
+	send := func(to ...string) error {
+		c := front.SMTPClient()
+		defer c.Close()
+		if err := c.Mail("from@example.com"); err != nil {
+			return err
+		}
+		for _, rcpt := range to {
+			if err := c.Rcpt(rcpt); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write([]byte("Subject: relay\r\n\r\nHello\r\n")); err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+
+	t.Run("Accepted", func(t *testing.T) {
+		require.NoError(t, send("to@example.org", "unknown@example.org"))
+
+		received := upstream.Receive()
+		assert.True(t, received.TLS)
+		assert.Equal(t, "relay.example.org", received.Helo)
+		require.Len(t, received.RcptTo, 1)
+		assert.Equal(t, "to@example.org", received.RcptTo[0].Address)
+		assert.Contains(t, received.Data.String(), "Subject: relay\n\nHello\n")
+
+		// the recipient that was rejected upstream is bounced to the sender
+		bounce := upstream.Receive()
+		assert.Equal(t, "", bounce.MailFrom.Address)
+		require.Len(t, bounce.RcptTo, 1)
+		assert.Equal(t, "from@example.com", bounce.RcptTo[0].Address)
+		m, err := bounce.Mail()
+		require.NoError(t, err)
+		report, err := m.DeliveryReport()
+		require.NoError(t, err)
+		require.Len(t, report.Recipients, 1)
+		assert.Equal(t, "unknown@example.org", report.Recipients[0].Recipient)
+		assert.Equal(t, envelope.DSNActionFailed, report.Recipients[0].Action)
+		assert.Contains(t, report.Recipients[0].Diagnostic, "User unknown")
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		err := send("unknown@example.org")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "550")
+		assert.Contains(t, err.Error(), "User unknown")
+	})
+
+	t.Run("Temporary", func(t *testing.T) {
+		err := send("unknown@example.org", "busy@example.org")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "451", "a temporary failure is preferred, and 421 is not passed on")
+	})
+}
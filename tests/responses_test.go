@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/responses"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/textproto"
+	"testing"
+)
+
+func TestCustomResponses(t *testing.T) {
+	addr := ":2525"
+	startServer(t, &smtpx.Server{
+		Addr:     addr,
+		Hostname: "mx.example.com",
+		Greeting: func(s *smtpx.Session) string {
+			return "ESMTP Välkommen"
+		},
+		Responses: map[smtpx.Response]smtpx.Response{
+			responses.FailUnrecognizedCmd: responses.Rephrase(responses.FailUnrecognizedCmd, "Okänt kommando"),
+			responses.SuccessQuitCmd:      responses.New(221, "Hej då"),
+		},
+	})
+
+	c, err := textproto.Dial("tcp", "localhost"+addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, msg, err := c.ReadResponse(220)
+	require.NoError(t, err)
+	assert.Equal(t, "mx.example.com ESMTP Välkommen", msg)
+	assert.NotContains(t, msg, smtpx.Name)
+
+	cmd := func(expect int, format string, args ...any) (int, string) {
+		id, err := c.Cmd(format, args...)
+		require.NoError(t, err)
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+		code, msg, _ := c.ReadResponse(expect)
+		return code, msg
+	}
+
+	code, msg := cmd(554, "FOO")
+	assert.Equal(t, 554, code)
+	assert.Equal(t, "5.5.1 Okänt kommando", msg)
+
+	// Responses that are not overridden are unchanged
+	code, _ = cmd(250, "RSET")
+	assert.Equal(t, 250, code)
+
+	code, msg = cmd(221, "QUIT")
+	assert.Equal(t, 221, code)
+	assert.Equal(t, "Hej då", msg)
+}
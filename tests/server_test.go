@@ -8,6 +8,7 @@ import (
 	"github.com/modfin/smtpx"
 	"github.com/modfin/smtpx/envelope"
 	"github.com/modfin/smtpx/middleware"
+	"github.com/modfin/smtpx/smtpxtest"
 	"github.com/modfin/smtpx/tests/mocks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -950,3 +951,42 @@ func ConnWithCA(certPool *x509.CertPool, host string, addr string) (*smtp.Client
 
 	return c, nil
 }
+
+func TestStartTLSResetsSession(t *testing.T) {
+	srv := smtpxtest.NewTLSServer(t, nil)
+	c := srv.Client()
+	c.ExpectCmd("EHLO client.example.com", 250)
+	c.StartTLS(srv.TLS.ClientConfig(smtpxtest.Hostname))
+
+	// what the client told before TLS is discarded, so it has to say EHLO again (RFC 3207 4.2)
+	c.ExpectCmd("MAIL FROM:<from@example.com>", 503)
+	c.ExpectCmd("EHLO client.example.com", 250)
+	c.ExpectCmd("MAIL FROM:<from@example.com>", 250)
+	c.Close()
+}
+
+func TestNullSender(t *testing.T) {
+	srv := smtpxtest.NewServer(t, nil)
+	c := srv.Client()
+	c.ExpectCmd("EHLO client.example.com", 250)
+	c.ExpectCmd("MAIL FROM:<> SIZE=100", 250)
+	c.ExpectCmd("RCPT TO:<to@example.com>", 250)
+	c.Data("Subject: Undelivered Mail\r\n\r\nHello\r\n")
+	c.Close()
+
+	e := srv.Receive()
+	require.NotNil(t, e.MailFrom)
+	assert.Equal(t, "", e.MailFrom.Address)
+}
+
+func TestNullSenderTransaction(t *testing.T) {
+	srv := smtpxtest.NewServer(t, nil)
+	c := srv.Client()
+	c.ExpectCmd("EHLO client.example.com", 250)
+	c.ExpectCmd("MAIL FROM:<>", 250)
+	// the null sender starts a transaction like any other sender
+	c.ExpectCmd("MAIL FROM:<from@example.com>", 503)
+	c.ExpectCmd("RSET", 250)
+	c.ExpectCmd("MAIL FROM:<from@example.com>", 250)
+	c.Close()
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/smtpxtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, s *smtpx.Server) {
+	s.Logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s.Handler = smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+		return nil
+	})
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+}
+
+func TestGreetPause(t *testing.T) {
+	addr := ":2525"
+	startServer(t, &smtpx.Server{Addr: addr, GreetPause: 300 * time.Millisecond})
+
+	t.Run("Patient client", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost"+addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		code, _, err := textproto.NewReader(bufio.NewReader(conn)).ReadResponse(220)
+		require.NoError(t, err)
+		assert.Equal(t, 220, code)
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	})
+
+	t.Run("Early talker", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "localhost"+addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("EHLO example.com\r\n"))
+		require.NoError(t, err)
+
+		code, _, err := textproto.NewReader(bufio.NewReader(conn)).ReadResponse(220)
+		require.Error(t, err)
+		assert.Equal(t, 554, code)
+	})
+}
+
+func TestGreetPauseProxy(t *testing.T) {
+	srv := smtpxtest.NewServer(t, &smtpx.Server{ProxyOn: true, GreetPause: 100 * time.Millisecond})
+
+	t.Run("PROXY line", func(t *testing.T) {
+		// a proxy sends the PROXY line before the greeting, which is not talking early
+		c := smtpxtest.NewClient(t, srv.Dial())
+		c.Send("PROXY TCP4 192.0.2.1 192.0.2.2 4321 25")
+		c.Expect(220)
+		c.Expect(220)
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.Close()
+	})
+
+	t.Run("Early talker", func(t *testing.T) {
+		c := smtpxtest.NewClient(t, srv.Dial())
+		c.Send("PROXY TCP4 192.0.2.1 192.0.2.2 4321 25", "EHLO client.example.com")
+		c.Expect(554)
+	})
+
+	t.Run("Direct", func(t *testing.T) {
+		c := smtpxtest.NewClient(t, srv.Dial())
+		c.Send("EHLO client.example.com")
+		c.Expect(554)
+	})
+}
+
+func TestTarpit(t *testing.T) {
+	addr := ":2525"
+	startServer(t, &smtpx.Server{Addr: addr, TarpitDelay: 100 * time.Millisecond, TarpitMaxDelay: 150 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", "localhost"+addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	_, _, err = tp.ReadResponse(220)
+	require.NoError(t, err)
+
+	send := func(cmd string) (int, time.Duration) {
+		start := time.Now()
+		require.NoError(t, tp.PrintfLine("%s", cmd))
+		code, _, _ := tp.ReadResponse(0)
+		return code, time.Since(start)
+	}
+
+	code, d := send("RSET")
+	assert.Equal(t, 250, code)
+	assert.Less(t, d, 100*time.Millisecond, "no delay without errors")
+
+	code, d = send("BOGUS")
+	assert.Equal(t, 554, code)
+	assert.GreaterOrEqual(t, d, 100*time.Millisecond)
+
+	code, d = send("BOGUS")
+	assert.Equal(t, 554, code)
+	assert.GreaterOrEqual(t, d, 150*time.Millisecond)
+	assert.Less(t, d, 200*time.Millisecond, "delay should be capped")
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/smtpxtest"
+	"github.com/modfin/smtpx/transcript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// buffer is a transcript written in memory
+type buffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *buffer) Close() error {
+	return nil
+}
+
+func (b *buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func record(t *testing.T, recorder *smtpx.Recorder, script func(c *smtpxtest.Client)) string {
+	var b buffer
+	recorder.Open = func(s *smtpx.Session) (io.WriteCloser, error) {
+		return &b, nil
+	}
+	srv := smtpxtest.NewServer(t, &smtpx.Server{Recorder: recorder})
+	c := srv.Client()
+	script(c)
+	c.Close()
+	srv.Close()
+	return b.String()
+}
+
+func TestTranscript(t *testing.T) {
+	session := func(c *smtpxtest.Client) {
+		c.Run(`
+			C: EHLO client.example.com
+			S: 250
+			C: AUTH PLAIN AHVzZXIAc2VjcmV0
+			S: 554
+			C: MAIL FROM:<sender@example.com>
+			C: RCPT TO:<rcpt@example.com>
+			S: 250
+			S: 250
+		`)
+		c.Data("Subject: Hello\r\n\r\n.leading dot\r\nsecret body\r\n")
+	}
+
+	t.Run("Record", func(t *testing.T) {
+		recorded := record(t, &smtpx.Recorder{}, session)
+		assert.Contains(t, recorded, " C AUTH PLAIN AHVzZXIAc2VjcmV0\n")
+		assert.Contains(t, recorded, " D ..leading dot\n")
+		assert.Contains(t, recorded, " S 221 ")
+
+		entries, err := transcript.Parse(strings.NewReader(recorded))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"220", "250", "554", "250", "250", "354", "250", "221"}, transcript.Codes(entries))
+
+		// the pipelined commands are recorded before their replies, as on the wire
+		var order []transcript.Direction
+		for _, e := range entries {
+			if strings.HasPrefix(e.Line, "MAIL") || strings.HasPrefix(e.Line, "RCPT") || strings.HasPrefix(e.Line, "250 2.1") {
+				order = append(order, e.Direction)
+			}
+		}
+		assert.Equal(t, []transcript.Direction{transcript.Client, transcript.Client, transcript.Server, transcript.Server}, order)
+	})
+
+	t.Run("Redact", func(t *testing.T) {
+		recorded := record(t, &smtpx.Recorder{RedactAuth: true, RedactData: true}, session)
+		assert.NotContains(t, recorded, "AHVzZXIAc2VjcmV0")
+		assert.NotContains(t, recorded, "secret body")
+		assert.Contains(t, recorded, " C AUTH PLAIN [redacted]\n")
+		assert.Contains(t, recorded, " D [redacted] 41 bytes\n")
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		entries, err := transcript.Parse(strings.NewReader(record(t, &smtpx.Recorder{}, session)))
+		require.NoError(t, err)
+
+		srv := smtpxtest.NewServer(t, nil)
+		replayed, err := transcript.Replay(srv.Dial(), entries)
+		require.NoError(t, err)
+		assert.Equal(t, transcript.Codes(entries), transcript.Codes(replayed))
+		assert.Equal(t, "Subject: Hello\n\n.leading dot\nsecret body\n", srv.Receive().Data.String())
+	})
+
+	t.Run("STARTTLS", func(t *testing.T) {
+		var b buffer
+		srv := smtpxtest.NewTLSServer(t, &smtpx.Server{Recorder: &smtpx.Recorder{
+			Open: func(s *smtpx.Session) (io.WriteCloser, error) {
+				return &b, nil
+			},
+		}})
+		c := srv.Client()
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.StartTLS(srv.TLS.ClientConfig(smtpxtest.Hostname))
+		c.ExpectCmd("EHLO client.example.com", 250)
+		c.Close()
+		srv.Close()
+		assert.Contains(t, b.String(), "# TLS handshake, TLS 1.3\n")
+
+		entries, err := transcript.Parse(strings.NewReader(b.String()))
+		require.NoError(t, err)
+		other := smtpxtest.NewTLSServer(t, nil)
+		replayed, err := transcript.Replay(other.Dial(), entries, transcript.WithTLS(other.TLS.ClientConfig(smtpxtest.Hostname)))
+		require.NoError(t, err)
+		assert.Equal(t, transcript.Codes(entries), transcript.Codes(replayed))
+	})
+
+	t.Run("RecordToDir", func(t *testing.T) {
+		dir := t.TempDir()
+		srv := smtpxtest.NewServer(t, &smtpx.Server{Recorder: &smtpx.Recorder{Open: smtpx.RecordToDir(dir)}})
+		srv.Client().Close()
+		srv.Close()
+
+		files, err := filepath.Glob(filepath.Join(dir, "*-1.txt"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		b, err := os.ReadFile(files[0])
+		require.NoError(t, err)
+		assert.Contains(t, string(b), " C QUIT\n")
+	})
+}
@@ -0,0 +1,152 @@
+package transcript
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+type Settings struct {
+	// TLSConfig is used to upgrade the connection when the transcript has a STARTTLS that the server accepts
+	TLSConfig *tls.Config
+	// Timing sends the lines of the client with the delays they were recorded with, e.g. to reproduce timeouts
+	Timing bool
+	// Timeout is how long to wait for each reply of the server
+	Timeout time.Duration
+}
+
+type Option func(*Settings)
+
+// WithTLS sets the config used to upgrade the connection on STARTTLS
+func WithTLS(config *tls.Config) Option {
+	return func(s *Settings) {
+		s.TLSConfig = config
+	}
+}
+
+// WithTiming sends the lines of the client with the delays they were recorded with, rather than at once
+func WithTiming() Option {
+	return func(s *Settings) {
+		s.Timing = true
+	}
+}
+
+// WithTimeout sets how long to wait for each reply of the server, defaults to 10 seconds
+func WithTimeout(d time.Duration) Option {
+	return func(s *Settings) {
+		s.Timeout = d
+	}
+}
+
+// Replay sends the client side of the transcript on conn, i.e. the C and D lines, and reads a reply from the
+// server wherever one was recorded. Lines that were sent without waiting for a reply, i.e. pipelined, are sent
+// the same way. It returns the transcript of the replay, so that the replies can be compared to those recorded,
+// e.g. with Codes.
+//
+// Replay stops with io.ErrUnexpectedEOF if the server closes the connection before the transcript ends
+func Replay(conn net.Conn, entries []Entry, opts ...Option) ([]Entry, error) {
+	settings := &Settings{
+		Timeout: 10 * time.Second,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+
+	r := &replay{conn: conn, in: bufio.NewReader(conn), settings: settings}
+	err := r.run(entries)
+	return r.entries, err
+}
+
+type replay struct {
+	conn     net.Conn
+	in       *bufio.Reader
+	settings *Settings
+	entries  []Entry
+
+	// last is the last command sent, to know when to start TLS
+	last string
+}
+
+func (r *replay) run(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	// with Timing, lines are sent at the same offset from the start as they were recorded at
+	start, recorded := time.Now(), entries[0].Time
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if e.Direction != Server {
+			if r.settings.Timing {
+				time.Sleep(time.Until(start.Add(e.Time.Sub(recorded))))
+			}
+			if _, err := io.WriteString(r.conn, e.Line+"\r\n"); err != nil {
+				return err
+			}
+			r.record(e.Direction, e.Line)
+			if e.Direction == Client {
+				r.last = e.Line
+			}
+			continue
+		}
+
+		// skip the rest of the recorded reply, a reply is read as a whole
+		for i < len(entries)-1 && entries[i+1].Direction == Server && !last(entries[i].Line) {
+			i++
+		}
+		code, err := r.reply()
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(r.last, "STARTTLS") && code == "220" {
+			if err := r.startTLS(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reply reads a reply of the server and records it, returning its code
+func (r *replay) reply() (string, error) {
+	_ = r.conn.SetReadDeadline(time.Now().Add(r.settings.Timeout))
+	defer r.conn.SetReadDeadline(time.Time{})
+	for {
+		line, err := r.in.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		r.record(Server, line)
+		if last(line) {
+			return line[:min(3, len(line))], nil
+		}
+	}
+}
+
+func (r *replay) startTLS() error {
+	if r.settings.TLSConfig == nil {
+		return errors.New("transcript: the server accepted STARTTLS, but no TLS config was given")
+	}
+	conn := tls.Client(r.conn, r.settings.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("transcript: TLS handshake failed: %w", err)
+	}
+	r.conn = conn
+	r.in = bufio.NewReader(conn)
+	return nil
+}
+
+func (r *replay) record(direction Direction, line string) {
+	r.entries = append(r.entries, Entry{Time: time.Now(), Direction: direction, Line: line})
+}
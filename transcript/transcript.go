@@ -0,0 +1,187 @@
+// Package transcript records SMTP sessions line by line, and replays them against a server.
+//
+// A transcript is a text file with one entry per line, i.e. a timestamp, the direction and the line as sent
+// on the wire:
+//
+//	2024-01-02T03:04:05.000001Z S 220 mx.example.com ESMTP
+//	2024-01-02T03:04:05.000120Z C EHLO client.example.com
+//	2024-01-02T03:04:05.000131Z S 250-mx.example.com Hello
+//	2024-01-02T03:04:05.000131Z S 250 PIPELINING
+//	2024-01-02T03:04:05.000200Z C DATA
+//	2024-01-02T03:04:05.000210Z S 354 Enter message, ending with '.' on a line by itself
+//	2024-01-02T03:04:05.000300Z D Subject: Hello
+//	2024-01-02T03:04:05.000300Z D .
+//
+// C lines are commands of the client, D lines are the message sent after DATA, dot-stuffed and ending with
+// the terminating ".", and S lines are the replies of the server. Lines starting with # are comments.
+//
+// Transcripts are recorded by setting smtpx.Server.Recorder, and replayed in tests to reproduce a session.
+//
+// Example usage:
+//
+//	entries, err := transcript.Load("testdata/misbehaving-sender.txt")
+//	...
+//	replayed, err := transcript.Replay(conn, entries, transcript.WithTLS(clientConfig))
+//	...
+//	assert.Equal(t, transcript.Codes(entries), transcript.Codes(replayed))
+package transcript
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction tells who sent a line
+type Direction byte
+
+const (
+	// Client is a command sent by the client
+	Client Direction = 'C'
+	// Data is a line of the message sent by the client after DATA
+	Data Direction = 'D'
+	// Server is a line of a reply sent by the server
+	Server Direction = 'S'
+)
+
+// Redacted replaces the text that is redacted from a transcript
+const Redacted = "[redacted]"
+
+// Entry is a line of a transcript
+type Entry struct {
+	Time      time.Time
+	Direction Direction
+	// Line is the line as sent on the wire, without the line break
+	Line string
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s %c %s", e.Time.UTC().Format(time.RFC3339Nano), e.Direction, e.Line)
+}
+
+// Writer writes the entries of a transcript as they happen, it is safe for concurrent use
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Record writes an entry with the current time. Errors are sticky, and returned by Err
+func (w *Writer) Record(direction Direction, line string) {
+	w.Add(Entry{Time: time.Now(), Direction: direction, Line: line})
+}
+
+// Add writes an entry, e.g. a reply that was buffered before it was sent
+func (w *Writer) Add(e Entry) {
+	w.write(e.String())
+}
+
+// Comment writes a comment, e.g. the remote address of the session
+func (w *Writer) Comment(format string, args ...any) {
+	w.write("# " + fmt.Sprintf(format, args...))
+}
+
+func (w *Writer) write(line string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	_, w.err = io.WriteString(w.w, line+"\n")
+}
+
+// Err returns the first error that occurred while writing
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Parse reads the entries of a transcript
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			return entries, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 || len(parts[1]) != 1 {
+			return nil, fmt.Errorf("transcript: line %d: expected <time> <direction> <line>", n)
+		}
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("transcript: line %d: %w", n, err)
+		}
+		e := Entry{Time: t, Direction: Direction(parts[1][0])}
+		if len(parts) == 3 {
+			e.Line = parts[2]
+		}
+		switch e.Direction {
+		case Client, Data, Server:
+		default:
+			return nil, fmt.Errorf("transcript: line %d: unknown direction %q", n, parts[1])
+		}
+		entries = append(entries, e)
+	}
+}
+
+// Load reads the entries of a transcript file
+func Load(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Replies returns the replies of the server, with the lines of multiline replies joined by \n
+func Replies(entries []Entry) []string {
+	var replies []string
+	var lines []string
+	for _, e := range entries {
+		if e.Direction != Server {
+			continue
+		}
+		lines = append(lines, e.Line)
+		if last(e.Line) {
+			replies = append(replies, strings.Join(lines, "\n"))
+			lines = nil
+		}
+	}
+	return replies
+}
+
+// Codes returns the code of each reply of the server, which unlike the text does not change with the time or
+// the connection id
+func Codes(entries []Entry) []string {
+	var codes []string
+	for _, reply := range Replies(entries) {
+		codes = append(codes, reply[:min(3, len(reply))])
+	}
+	return codes
+}
+
+// last returns true if the line is the last line of a reply, i.e. 250 rather than 250-
+func last(line string) bool {
+	return len(line) < 4 || line[3] != '-'
+}
@@ -0,0 +1,79 @@
+package transcript
+
+import (
+	"bufio"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const recorded = `# connection 1 from 127.0.0.1:1234
+2024-01-02T03:04:05.000001Z S 220 mx.example.com ESMTP
+2024-01-02T03:04:05.00012Z C EHLO client.example.com
+2024-01-02T03:04:05.000131Z S 250-mx.example.com Hello
+2024-01-02T03:04:05.000131Z S 250 PIPELINING
+2024-01-02T03:04:05.0002Z C QUIT
+2024-01-02T03:04:05.00021Z S 221 Bye
+`
+
+func TestParse(t *testing.T) {
+	entries, err := Parse(strings.NewReader(recorded))
+	require.NoError(t, err)
+	require.Len(t, entries, 6)
+	assert.Equal(t, Client, entries[1].Direction)
+	assert.Equal(t, "EHLO client.example.com", entries[1].Line)
+
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e.String() + "\n")
+	}
+	assert.Equal(t, recorded[strings.Index(recorded, "\n")+1:], b.String())
+
+	assert.Equal(t, []string{"220 mx.example.com ESMTP", "250-mx.example.com Hello\n250 PIPELINING", "221 Bye"}, Replies(entries))
+	assert.Equal(t, []string{"220", "250", "221"}, Codes(entries))
+
+	_, err = Parse(strings.NewReader("2024-01-02T03:04:05Z X hello\n"))
+	assert.Error(t, err)
+}
+
+// serve replies to each line with the reply in replies, and closes the connection when there are none left
+func serve(conn net.Conn, replies ...string) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	_, _ = io.WriteString(conn, replies[0])
+	for _, reply := range replies[1:] {
+		if _, err := in.ReadString('\n'); err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, reply)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	entries, err := Parse(strings.NewReader(recorded))
+	require.NoError(t, err)
+
+	t.Run("Replies", func(t *testing.T) {
+		client, server := net.Pipe()
+		go serve(server, "220 other.example.com\r\n", "250-other.example.com\r\n250 SIZE\r\n", "221 Bye\r\n")
+
+		replayed, err := Replay(client, entries)
+		require.NoError(t, err)
+		assert.Equal(t, Codes(entries), Codes(replayed))
+		assert.Equal(t, "250-other.example.com\n250 SIZE", Replies(replayed)[1])
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		client, server := net.Pipe()
+		go serve(server, "220 other.example.com\r\n", "421 Go away\r\n")
+
+		replayed, err := Replay(client, entries)
+		// the server closed the connection, which is either seen when writing QUIT, or when reading its reply
+		assert.True(t, errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe), "%v", err)
+		assert.Equal(t, []string{"220", "421"}, Codes(replayed))
+	})
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"net"
+	"net/netip"
+)
+
+// AddrPortOf returns the address and port of addr. IPv4-mapped IPv6 addresses, e.g. ::ffff:192.0.2.1,
+// are unmapped to plain IPv4 addresses. The returned value is invalid if addr does not contain an ip address
+func AddrPortOf(addr net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case nil:
+		return ap
+	case *net.TCPAddr:
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		ap = a.AddrPort()
+	case *net.IPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		ap = netip.AddrPortFrom(ip, 0)
+	default:
+		var err error
+		ap, err = netip.ParseAddrPort(addr.String())
+		if err != nil {
+			ip, _ := netip.ParseAddr(addr.String())
+			ap = netip.AddrPortFrom(ip, 0)
+		}
+	}
+	if !ap.Addr().IsValid() {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// SubnetOf returns the network of addr, as a CIDR string. IPv4 addresses are masked to a /24 and
+// IPv6 addresses to a /64, which is what usually is assigned to a single customer
+func SubnetOf(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return p.String()
+}
+
+// AddressLiteral formats addr as in the Received header and the EHLO command, i.e. 192.0.2.1 or IPv6:2001:db8::1
+func AddressLiteral(addr netip.Addr) string {
+	if addr.Is6() && !addr.Is4In6() {
+		return "IPv6:" + addr.String()
+	}
+	return addr.Unmap().String()
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestAddrPortOf(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}, want: "192.0.2.1:25"},
+		{addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}, want: "[2001:db8::1]:25"},
+		{addr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, want: "192.0.2.1:0"},
+		{addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, want: "invalid AddrPort"},
+		{addr: nil, want: "invalid AddrPort"},
+	}
+	for _, tt := range tests {
+		if got := AddrPortOf(tt.addr).String(); got != tt.want {
+			t.Errorf("AddrPortOf(%v) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestSubnetOf(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.77":           "192.0.2.0/24",
+		"::ffff:192.0.2.77":    "192.0.2.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+	}
+	for in, want := range tests {
+		if got := SubnetOf(netip.MustParseAddr(in)); got != want {
+			t.Errorf("SubnetOf(%s) = %s, want %s", in, got, want)
+		}
+	}
+	if got := SubnetOf(netip.Addr{}); got != "" {
+		t.Errorf("SubnetOf(invalid) = %s, want empty", got)
+	}
+}
+
+func TestAddressLiteral(t *testing.T) {
+	if got := AddressLiteral(netip.MustParseAddr("192.0.2.1")); got != "192.0.2.1" {
+		t.Errorf("got %s", got)
+	}
+	if got := AddressLiteral(netip.MustParseAddr("2001:db8::1")); got != "IPv6:2001:db8::1" {
+		t.Errorf("got %s", got)
+	}
+}
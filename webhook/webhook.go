@@ -0,0 +1,448 @@
+// Package webhook posts received mail as JSON to an HTTP endpoint.
+//
+// The envelope, the decoded headers, the text and HTML bodies and the attachments of each message are sent in one
+// request, either as a JSON document with the attachments base64 encoded, or as multipart/form-data with the JSON
+// document in the "message" field and the attachments as files. Requests may be signed with HMAC-SHA256, and are
+// retried with backoff on network errors and 5xx responses. The status of the last response is mapped to the SMTP
+// reply, i.e. 2xx is accepted, 4xx is rejected with a 550 and 5xx is a temporary 451.
+//
+// Example usage:
+//
+//	wh := webhook.New("https://example.com/hooks/mail", webhook.WithSecret(secret))
+//	server.Handler = wh.Handler()
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/modfin/smtpx"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/modfin/smtpx/responses"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderTimestamp holds the unix time of the request, which is part of the signature
+	HeaderTimestamp = "X-Smtpx-Timestamp"
+	// HeaderSignature holds the signature of the request, i.e. sha256=<hex of the HMAC of "<timestamp>.<body>">
+	HeaderSignature = "X-Smtpx-Signature"
+)
+
+// ErrInvalidSignature is returned by Verify for requests that are not signed with the secret, or are too old
+var ErrInvalidSignature = errors.New("webhook: invalid signature")
+
+// Encoding is how the message is encoded in the request body
+type Encoding int
+
+const (
+	// JSON sends the message as a JSON document, with the attachments base64 encoded in it
+	JSON Encoding = iota
+	// Multipart sends multipart/form-data, with the JSON document in the "message" field and the attachments as
+	// files named by Attachment.Field
+	Multipart
+)
+
+// Message is the JSON document posted for each mail
+type Message struct {
+	ID       string   `json:"id"`
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+	Session  Session  `json:"session"`
+
+	// Headers are decoded to UTF-8, keyed by their canonical name
+	Headers     map[string][]string `json:"headers"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+}
+
+// Session is the SMTP session that the mail was received in
+type Session struct {
+	ConnectionID uint64 `json:"connection_id"`
+	Remote       string `json:"remote"`
+	Helo         string `json:"helo"`
+	TLS          bool   `json:"tls"`
+	ESMTP        bool   `json:"esmtp"`
+	UTF8         bool   `json:"utf8"`
+}
+
+// Attachment is a part of the mail that is not the text or HTML body
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Inline      bool   `json:"inline"`
+	Size        int    `json:"size"`
+
+	// Data is the decoded content, base64 in JSON. It is empty when the Multipart encoding is used
+	Data []byte `json:"data,omitempty"`
+	// Field is the name of the form file holding the content when the Multipart encoding is used
+	Field string `json:"field,omitempty"`
+}
+
+// NewMessage returns the message posted for the envelope. Mail that is not MIME is treated as text/plain
+func NewMessage(e *envelope.Envelope) (*Message, error) {
+	m := &Message{
+		ID:     e.EnvelopeId(),
+		RcptTo: []string{},
+		Session: Session{
+			ConnectionID: e.ConnectionId(),
+			Helo:         e.Helo,
+			TLS:          e.TLS,
+			ESMTP:        e.ESMTP,
+			UTF8:         e.UTF8,
+		},
+	}
+	if e.MailFrom != nil {
+		m.MailFrom = e.MailFrom.Address
+	}
+	for _, rcpt := range e.RcptTo {
+		m.RcptTo = append(m.RcptTo, rcpt.Address)
+	}
+	if e.Remote.IsValid() {
+		m.Session.Remote = e.Remote.String()
+	}
+
+	ml, err := e.Mail()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := ml.Headers()
+	if err != nil {
+		return nil, err
+	}
+	m.Headers = headers.MIMEHeader
+
+	body := &envelope.Content{Headers: textproto.MIMEHeader{"Content-Type": {envelope.MimeTextPlain}}, Body: ml.RawBody}
+	if headers.Get("Content-Type") != "" {
+		body, err = ml.Body()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, part := range body.Flatten() {
+		data, err := part.Decode()
+		if err != nil {
+			return nil, err
+		}
+		mediaType, _, _ := mime.ParseMediaType(part.Headers.Get("Content-Type"))
+		mediaType = strings.ToLower(mediaType)
+
+		if !part.IsAttachment() {
+			if mediaType == envelope.MimeTextPlain && m.Text == "" {
+				m.Text = string(data)
+				continue
+			}
+			if mediaType == envelope.MimeTextHtml && m.HTML == "" {
+				m.HTML = string(data)
+				continue
+			}
+		}
+
+		a := Attachment{
+			ContentType: mediaType,
+			ContentID:   strings.Trim(part.Headers.Get("Content-ID"), "<>"),
+			Inline:      part.IsInline(),
+			Size:        len(data),
+			Data:        data,
+		}
+		if a.ContentType == "" {
+			a.ContentType = envelope.MimeApplicationOctet
+		}
+		if disposition := part.Headers.Get("Content-Disposition"); disposition != "" {
+			_, params, _ := mime.ParseMediaType(disposition)
+			a.Filename = params["filename"]
+		}
+		if a.Filename == "" {
+			_, params, _ := mime.ParseMediaType(part.Headers.Get("Content-Type"))
+			a.Filename = params["name"]
+		}
+		m.Attachments = append(m.Attachments, a)
+	}
+	return m, nil
+}
+
+type Settings struct {
+	Logger *slog.Logger
+	Client *http.Client
+
+	Encoding Encoding
+	// Secret signs the requests, they are not signed if empty
+	Secret []byte
+	// Header is added to each request, e.g. for authorization
+	Header http.Header
+
+	// Attempts is the number of requests made before giving up
+	Attempts int
+	// MinBackoff is the wait after the first failed request, doubled for each following one up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type Option func(*Settings)
+
+// WithLogger logs requests and errors
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Settings) {
+		s.Logger = logger
+	}
+}
+
+// WithClient sets the HTTP client, defaults to a client with a 30 second timeout
+func WithClient(client *http.Client) Option {
+	return func(s *Settings) {
+		s.Client = client
+	}
+}
+
+// WithEncoding sets how the message is encoded, defaults to JSON
+func WithEncoding(encoding Encoding) Option {
+	return func(s *Settings) {
+		s.Encoding = encoding
+	}
+}
+
+// WithSecret signs the requests with HMAC-SHA256, see Sign and Verify
+func WithSecret(secret []byte) Option {
+	return func(s *Settings) {
+		s.Secret = secret
+	}
+}
+
+// WithHeader adds a header to each request, e.g. Authorization
+func WithHeader(key, value string) Option {
+	return func(s *Settings) {
+		s.Header.Add(key, value)
+	}
+}
+
+// WithAttempts sets the number of requests made before giving up, defaults to 3
+func WithAttempts(attempts int) Option {
+	return func(s *Settings) {
+		s.Attempts = attempts
+	}
+}
+
+// WithBackoff sets the wait between requests, starting at min and doubled for each failed request up to max.
+// Defaults to 1 and 10 seconds, keep them short since the SMTP client waits for the reply
+func WithBackoff(min, max time.Duration) Option {
+	return func(s *Settings) {
+		s.MinBackoff = min
+		s.MaxBackoff = max
+	}
+}
+
+type Webhook struct {
+	url      string
+	settings *Settings
+}
+
+func New(url string, opts ...Option) *Webhook {
+	settings := &Settings{
+		Client:     &http.Client{Timeout: 30 * time.Second},
+		Header:     http.Header{},
+		Attempts:   3,
+		MinBackoff: time.Second,
+		MaxBackoff: 10 * time.Second,
+	}
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		o(settings)
+	}
+	if settings.Attempts < 1 {
+		settings.Attempts = 1
+	}
+	return &Webhook{url: url, settings: settings}
+}
+
+// Handler returns a smtpx.Handler that posts each message, and replies according to the HTTP status
+func (w *Webhook) Handler() smtpx.Handler {
+	return smtpx.NewHandler(func(e *envelope.Envelope) smtpx.Response {
+		return w.Post(e.Context(), e)
+	})
+}
+
+// Post posts the message of the envelope, retrying on network errors and 5xx responses. It returns nil if the
+// endpoint accepted the message, a 550 for 4xx responses and messages that can not be parsed, and a 451 otherwise
+func (w *Webhook) Post(ctx context.Context, e *envelope.Envelope) smtpx.Response {
+	m, err := NewMessage(e)
+	if err != nil {
+		w.log("webhook, could not parse message", "envelope", e.EnvelopeId(), "err", err)
+		return responses.New(550).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+			Line("Could not parse message")
+	}
+	contentType, body, err := w.encode(m)
+	if err != nil {
+		w.log("webhook, could not encode message", "envelope", e.EnvelopeId(), "err", err)
+		return responses.New(451).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+			Line("Could not deliver message, try again later")
+	}
+
+	backoff := w.settings.MinBackoff
+	var status int
+	for attempt := 1; ; attempt++ {
+		status, err = w.post(ctx, contentType, body)
+		if err == nil && !retry(status) {
+			break
+		}
+		w.log("webhook, request failed", "envelope", e.EnvelopeId(), "attempt", attempt, "status", status, "err", err)
+		if attempt >= w.settings.Attempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, w.settings.MaxBackoff)
+	}
+
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		w.log("webhook, posted", "envelope", e.EnvelopeId(), "status", status)
+		return nil
+	case err == nil && status >= 400 && status < 500 && !retry(status):
+		return responses.New(550).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+			Line(fmt.Sprintf("Message rejected by endpoint (HTTP %d)", status))
+	default:
+		return responses.New(451).Enhanced(responses.OtherOrUndefinedMailSystemStatus).
+			Line("Could not deliver message, try again later")
+	}
+}
+
+// retry returns true for statuses that may succeed later, i.e. 5xx and 429 Too Many Requests.
+// Other statuses, e.g. redirects that the client did not follow, are not retried
+func retry(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+func (w *Webhook) post(ctx context.Context, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for key, values := range w.settings.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	if len(w.settings.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderSignature, Sign(w.settings.Secret, timestamp, body))
+	}
+
+	res, err := w.settings.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// drain the body so that the connection is reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	_ = res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// encode returns the content type and the body of the request
+func (w *Webhook) encode(m *Message) (string, []byte, error) {
+	if w.settings.Encoding != Multipart {
+		b, err := json.Marshal(m)
+		return "application/json", b, err
+	}
+
+	copied := *m
+	copied.Attachments = make([]Attachment, len(m.Attachments))
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for i, a := range m.Attachments {
+		a.Field = fmt.Sprintf("attachment-%d", i)
+		filename := a.Filename
+		if filename == "" {
+			filename = a.Field
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": a.Field, "filename": filename}))
+		h.Set("Content-Type", a.ContentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err = part.Write(a.Data); err != nil {
+			return "", nil, err
+		}
+		a.Data = nil
+		copied.Attachments[i] = a
+	}
+
+	doc, err := json.Marshal(copied)
+	if err != nil {
+		return "", nil, err
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="message"`)
+	h.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = part.Write(doc); err != nil {
+		return "", nil, err
+	}
+	if err = mw.Close(); err != nil {
+		return "", nil, err
+	}
+	return mw.FormDataContentType(), b.Bytes(), nil
+}
+
+// Sign returns the signature of a request body, i.e. sha256=<hex of the HMAC-SHA256 of "<timestamp>.<body>">
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reads the body of a request made by a Webhook and checks its signature, returning ErrInvalidSignature
+// if it does not match or if the timestamp is further than tolerance from now. A zero tolerance does not check
+// the timestamp, which allows replays
+func Verify(secret []byte, r *http.Request, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := r.Header.Get(HeaderTimestamp)
+	if !hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(r.Header.Get(HeaderSignature))) {
+		return nil, ErrInvalidSignature
+	}
+	if tolerance > 0 {
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidSignature
+		}
+		if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+			return nil, ErrInvalidSignature
+		}
+	}
+	return body, nil
+}
+
+func (w *Webhook) log(msg string, args ...any) {
+	if w.settings.Logger != nil {
+		w.settings.Logger.Debug(msg, args...)
+	}
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/modfin/smtpx/envelope"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const message = "From: =?utf-8?q?J=C3=B6rgen?= <sender@example.com>\r\n" +
+	"Subject: Hello\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"The body\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>The body</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--outer--\r\n"
+
+func newEnvelope() *envelope.Envelope {
+	e := envelope.NewEnvelope(nil, 0)
+	e.Remote = netip.MustParseAddrPort("192.0.2.1:4321")
+	e.Helo = "client.example.com"
+	e.ESMTP = true
+	e.MailFrom = &mail.Address{Address: "sender@example.com"}
+	e.RcptTo = []*mail.Address{{Address: "rcpt@example.com"}}
+	_, _ = e.Data.WriteString(message)
+	return e
+}
+
+func TestNewMessage(t *testing.T) {
+	m, err := NewMessage(newEnvelope())
+	require.NoError(t, err)
+	assert.Equal(t, "sender@example.com", m.MailFrom)
+	assert.Equal(t, []string{"rcpt@example.com"}, m.RcptTo)
+	assert.Equal(t, "192.0.2.1:4321", m.Session.Remote)
+	assert.Equal(t, "client.example.com", m.Session.Helo)
+	assert.Equal(t, []string{"Jörgen <sender@example.com>"}, m.Headers["From"])
+	assert.Equal(t, "The body", m.Text)
+	assert.Equal(t, "<p>The body</p>", m.HTML)
+	require.Len(t, m.Attachments, 1)
+	assert.Equal(t, Attachment{Filename: "report.pdf", ContentType: "application/pdf", Size: 8, Data: []byte("%PDF-1.4")},
+		m.Attachments[0])
+
+	t.Run("NotMIME", func(t *testing.T) {
+		e := envelope.NewEnvelope(nil, 0)
+		_, _ = e.Data.WriteString("Subject: Plain\r\n\r\nJust text\r\n")
+		m, err := NewMessage(e)
+		require.NoError(t, err)
+		assert.Equal(t, "Just text\r\n", m.Text)
+		assert.Empty(t, m.Attachments)
+	})
+}
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("secret")
+
+	t.Run("JSON", func(t *testing.T) {
+		var got Message
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := Verify(secret, r, time.Minute)
+			if !assert.NoError(t, err) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			assert.NoError(t, json.Unmarshal(body, &got))
+		}))
+		defer srv.Close()
+
+		wh := New(srv.URL, WithSecret(secret), WithHeader("Authorization", "Bearer token"))
+		assert.Nil(t, wh.Handler().Data(newEnvelope()))
+		assert.Equal(t, "The body", got.Text)
+		require.Len(t, got.Attachments, 1)
+		assert.Equal(t, []byte("%PDF-1.4"), got.Attachments[0].Data)
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		var got Message
+		var file []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, r.ParseMultipartForm(1<<20))
+			require.NoError(t, json.Unmarshal([]byte(r.FormValue("message")), &got))
+			f, header, err := r.FormFile("attachment-0")
+			require.NoError(t, err)
+			assert.Equal(t, "report.pdf", header.Filename)
+			file, _ = io.ReadAll(f)
+		}))
+		defer srv.Close()
+
+		wh := New(srv.URL, WithEncoding(Multipart))
+		assert.Nil(t, wh.Handler().Data(newEnvelope()))
+		require.Len(t, got.Attachments, 1)
+		assert.Equal(t, "attachment-0", got.Attachments[0].Field)
+		assert.Empty(t, got.Attachments[0].Data)
+		assert.Equal(t, []byte("%PDF-1.4"), file)
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		for status, code := range map[int]int{
+			http.StatusBadRequest:          550,
+			http.StatusNotFound:            550,
+			http.StatusTooManyRequests:     451,
+			http.StatusInternalServerError: 451,
+			http.StatusServiceUnavailable:  451,
+		} {
+			var requests atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(status)
+			}))
+
+			wh := New(srv.URL, WithAttempts(3), WithBackoff(time.Millisecond, 2*time.Millisecond))
+			res := wh.Handler().Data(newEnvelope())
+			require.NotNil(t, res, status)
+			assert.Equal(t, code, res.StatusCode(), status)
+			if code == 451 {
+				assert.Equal(t, int32(3), requests.Load(), "retried %d", status)
+			} else {
+				assert.Equal(t, int32(1), requests.Load(), "not retried %d", status)
+			}
+			srv.Close()
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) < 3 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		}))
+		defer srv.Close()
+
+		wh := New(srv.URL, WithAttempts(3), WithBackoff(time.Millisecond, time.Millisecond))
+		assert.Nil(t, wh.Handler().Data(newEnvelope()))
+		assert.Equal(t, int32(3), requests.Load())
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+
+		wh := New(srv.URL, WithAttempts(2), WithBackoff(time.Millisecond, time.Millisecond))
+		res := wh.Handler().Data(newEnvelope())
+		require.NotNil(t, res)
+		assert.Equal(t, 451, res.StatusCode())
+	})
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(timestamp time.Time, body string) *http.Request {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(HeaderTimestamp, ts)
+		r.Header.Set(HeaderSignature, Sign(secret, ts, []byte(body)))
+		return r
+	}
+
+	body, err := Verify(secret, sign(time.Now(), "{}"), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(body))
+
+	_, err = Verify([]byte("other"), sign(time.Now(), "{}"), time.Minute)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	_, err = Verify(secret, sign(time.Now().Add(-time.Hour), "{}"), time.Minute)
+	assert.ErrorIs(t, err, ErrInvalidSignature, "too old")
+
+	r := sign(time.Now(), "{}")
+	r.Body = io.NopCloser(strings.NewReader("{\"tampered\":true}"))
+	_, err = Verify(secret, r, 0)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}